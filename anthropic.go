@@ -0,0 +1,137 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// maxCacheBreakpoints is the maximum number of cache breakpoints the Anthropic
+// Messages API supports in a request.
+const maxCacheBreakpoints = 4
+
+// usage records the tokens used by an invocation, across all of the agent's
+// calls to the model.
+type usage struct {
+	InputTokens              int
+	OutputTokens             int
+	CacheCreationInputTokens int
+	CacheReadInputTokens     int
+}
+
+// An anthropicModel passes options the agent framework doesn't support through
+// to the Anthropic Messages API. The agent sends each call as a single human
+// message, so cache breakpoints are placed after the supplied cacheable
+// prefixes of that message.
+type anthropicModel struct {
+	llms.Model
+
+	cacheable      []string
+	thinkingBudget int
+	usage          *usage
+}
+
+// Call the model with a single prompt.
+func (m *anthropicModel) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, m, prompt, options...)
+}
+
+// GenerateContent generates content from the supplied messages. Thinking
+// choices are dropped, so the agent only sees Claude's answer.
+func (m *anthropicModel) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	for i, msg := range messages {
+		if msg.Role == llms.ChatMessageTypeHuman {
+			messages[i].Parts = cacheBreakpoints(msg.Parts, m.cacheable)
+		}
+	}
+	if m.thinkingBudget > 0 {
+		options = append(options, llms.WithThinkingBudget(m.thinkingBudget))
+	}
+
+	rsp, err := m.Model.GenerateContent(ctx, messages, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	choices := make([]*llms.ContentChoice, 0, len(rsp.Choices))
+	for _, c := range rsp.Choices {
+		if _, thinking := c.GenerationInfo["ThinkingSignature"]; thinking {
+			continue
+		}
+		choices = append(choices, c)
+	}
+	if m.usage != nil && len(rsp.Choices) > 0 {
+		// Every choice reports the usage of the whole response.
+		info := rsp.Choices[0].GenerationInfo
+		m.usage.InputTokens += intValue(info["InputTokens"])
+		m.usage.OutputTokens += intValue(info["OutputTokens"])
+		m.usage.CacheCreationInputTokens += intValue(info["CacheCreationInputTokens"])
+		m.usage.CacheReadInputTokens += intValue(info["CacheReadInputTokens"])
+	}
+	rsp.Choices = choices
+	return rsp, nil
+}
+
+// cacheBreakpoints splits a single text part after each of the supplied
+// prefixes, which must appear in order, and marks each split part as
+// cacheable. Other parts are returned unchanged.
+func cacheBreakpoints(parts []llms.ContentPart, prefixes []string) []llms.ContentPart {
+	if len(parts) != 1 || len(prefixes) == 0 {
+		return parts
+	}
+	t, ok := parts[0].(llms.TextContent)
+	if !ok {
+		return parts
+	}
+
+	out := []llms.ContentPart{}
+	text, start := t.Text, 0
+	for _, p := range prefixes {
+		if len(out) == maxCacheBreakpoints || p == "" {
+			break
+		}
+		i := strings.Index(text[start:], p)
+		if i < 0 {
+			break
+		}
+		end := start + i + len(p)
+		out = append(out, llms.WithCacheControl(llms.TextContent{Text: text[start:end]}, &llms.CacheControl{Type: "ephemeral"}))
+		start = end
+	}
+	if len(out) == 0 {
+		return parts
+	}
+	if start < len(text) {
+		out = append(out, llms.TextContent{Text: text[start:]})
+	}
+	return out
+}
+
+func intValue(v any) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return 0
+}
@@ -0,0 +1,286 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/crossplane/function-sdk-go/errors"
+	"github.com/crossplane/function-sdk-go/logging"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/response"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+)
+
+const (
+	// annotationProposalHash records the hash of the composed resources
+	// Claude most recently proposed.
+	annotationProposalHash = "claude.fn.upbound.io/proposal-hash"
+	// annotationProposalFingerprint records the fingerprint of the XR spec
+	// (and prompt) the proposal was derived from.
+	annotationProposalFingerprint = "claude.fn.upbound.io/proposal-fingerprint"
+	// annotationProposal caches the proposed composed resources, as gzipped,
+	// base64 encoded JSON, so they can be applied without asking Claude
+	// again.
+	annotationProposal = "claude.fn.upbound.io/proposal"
+	// annotationApprovedHash is set by a human to approve a proposal.
+	annotationApprovedHash = "claude.fn.upbound.io/approved-hash"
+
+	// proposalHashLength is the number of hex characters of the proposal's
+	// SHA-256 hash that identify it. Long enough to be unique per XR, short
+	// enough to copy and paste.
+	proposalHashLength = 16
+
+	// maxProposalSize is the largest encoded proposal, in bytes, that will be
+	// cached on the XR. Kubernetes limits the total size of an object's
+	// annotations to 256KiB, so this leaves room for the XR's other
+	// annotations.
+	maxProposalSize = 192 * 1024
+)
+
+// approvalEnabled returns true if the supplied input asks for an approval
+// gate.
+func approvalEnabled(in *v1alpha1.Prompt) bool {
+	return in.Approval != nil && in.Approval.Enabled
+}
+
+// approvalPipeline composes resources with the assumption that Claude's
+// proposed changes must be approved before they're applied. Claude is only
+// asked for a new proposal when the XR's spec changes. An approved proposal is
+// applied from the copy cached on the XR.
+func (f *Function) approvalPipeline(ctx context.Context, log logging.Logger, d pipelineDetails) (*fnv1.RunFunctionResponse, error) {
+	fingerprint, err := specFingerprint(d.req.GetObserved().GetComposite(), d.in, d.lib)
+	if err != nil {
+		response.Fatal(d.rsp, errors.Wrap(err, "cannot fingerprint observed XR"))
+		return d.rsp, err
+	}
+
+	a := annotations(d.req.GetObserved().GetComposite())
+	hash, blob := a[annotationProposalHash], a[annotationProposal]
+
+	p, current, err := cachedProposal(a, fingerprint)
+	if err != nil {
+		log.Debug("Ignoring cached proposal", "proposal", hash, "error", err)
+		response.Warning(d.rsp, errors.Wrapf(err, "ignoring cached proposal %s", hash))
+	}
+	if !current {
+		log.Debug("No current proposal, asking Claude for one", "fingerprint", fingerprint)
+
+		p.Resources, p.ContextOutputs, err = f.compose(ctx, log, d)
+		if err != nil {
+			return d.rsp, err
+		}
+		hash, blob, err = encodeProposal(p)
+		if err != nil {
+			response.Fatal(d.rsp, errors.Wrap(err, "cannot encode proposed composed resources"))
+			return d.rsp, err
+		}
+		reportDiff(log, d.rsp, composedDiff(d.req.GetObserved().GetResources(), p.Resources))
+	}
+
+	approved := a[annotationApprovedHash] == hash
+
+	pa, err := proposalAnnotations(a, p, hash, fingerprint, blob, approved)
+	if err != nil {
+		response.Fatal(d.rsp, err)
+		return d.rsp, err
+	}
+	setCompositeAnnotations(d.rsp, pa)
+
+	if d.in.Approval.StatusField != "" {
+		var changes *structpb.Value
+		if !approved {
+			changes = diffStatus(composedDiff(d.req.GetObserved().GetResources(), p.Resources))
+		}
+		setCompositeStatusField(d.rsp, d.in.Approval.StatusField, proposalStatus(hash, approved, changes))
+	}
+
+	if !approved {
+		log.Debug("Proposal awaiting approval, reusing observed composed resources", "proposal", hash)
+		d.rsp.Desired.Resources = desiredFromObserved(d.req.GetObserved().GetResources())
+		holdContextOutputs(d.req, d.in, d.rsp)
+		response.Normalf(d.rsp, "proposal %s is awaiting approval; annotate the XR with %s: %q to apply it", hash, annotationApprovedHash, hash)
+		return d.rsp, nil
+	}
+
+	// Context outputs are only written with the resources they describe.
+	log.Debug("Applying approved proposal", "proposal", hash, "resourceCount", len(p.Resources))
+	d.rsp.Desired.Resources = p.Resources
+	setContextOutputs(d.rsp, d.in.ContextOutputs, p.ContextOutputs)
+	return d.rsp, nil
+}
+
+// proposalAnnotations returns the annotations that cache the supplied proposal
+// on the XR. The desired XR replaces any annotations this function set on
+// earlier calls, so they must be returned on every call. The composed
+// resources are only derived from the proposal once it's approved and
+// applied, so until then the spec fingerprint and context outputs recorded
+// with the observed composed resources are kept.
+func proposalAnnotations(observed map[string]string, p proposal, hash, fingerprint, blob string, approved bool) (map[string]string, error) {
+	a := map[string]string{
+		annotationProposalHash:        hash,
+		annotationProposalFingerprint: fingerprint,
+		annotationProposal:            blob,
+	}
+	if !approved {
+		for _, k := range []string{annotationSpecFingerprint, annotationContextOutputs} {
+			if v, ok := observed[k]; ok {
+				a[k] = v
+			}
+		}
+		return a, nil
+	}
+	a[annotationSpecFingerprint] = fingerprint
+	if p.ContextOutputs == nil {
+		return a, nil
+	}
+	j, err := encodeContextOutputs(p.ContextOutputs)
+	if err != nil {
+		return nil, err
+	}
+	a[annotationContextOutputs] = j
+	return a, nil
+}
+
+// A proposal is the composed resources Claude proposed, and any context
+// outputs it returned with them.
+type proposal struct {
+	Resources      map[string]*fnv1.Resource
+	ContextOutputs *structpb.Value
+}
+
+// encodedProposal is the JSON encoding of a proposal.
+type encodedProposal struct {
+	Resources      map[string]map[string]any `json:"resources"`
+	ContextOutputs any                       `json:"contextOutputs,omitempty"`
+}
+
+// cachedProposal returns the proposal cached in the supplied XR annotations,
+// and true if it's current. A proposal is current if it was derived from the
+// supplied fingerprint. An error is returned if a proposal derived from the
+// fingerprint can't be decoded or doesn't match its hash, e.g. because it was
+// edited after it was proposed.
+func cachedProposal(a map[string]string, fingerprint string) (proposal, bool, error) {
+	hash := a[annotationProposalHash]
+	if hash == "" || a[annotationProposalFingerprint] != fingerprint {
+		return proposal{}, false, nil
+	}
+	p, err := decodeProposal(hash, a[annotationProposal])
+	if err != nil {
+		return proposal{}, false, err
+	}
+	return p, true, nil
+}
+
+// proposalHash returns the hash that identifies the supplied JSON encoded
+// proposal.
+func proposalHash(j []byte) string {
+	sum := sha256.Sum256(j)
+	return hex.EncodeToString(sum[:])[:proposalHashLength]
+}
+
+// encodeProposal returns the hash of the supplied proposal, and an encoding of
+// it suitable for caching in an annotation. It returns an error if the encoded
+// proposal is too large to cache.
+func encodeProposal(p proposal) (string, string, error) {
+	e := encodedProposal{Resources: asMaps(p.Resources)}
+	if p.ContextOutputs != nil {
+		e.ContextOutputs = p.ContextOutputs.AsInterface()
+	}
+	// encoding/json sorts map keys, so the hash is stable.
+	j, err := json.Marshal(e)
+	if err != nil {
+		return "", "", errors.Wrap(err, "cannot marshal proposal to JSON")
+	}
+
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(j); err != nil {
+		return "", "", errors.Wrap(err, "cannot compress proposal")
+	}
+	if err := zw.Close(); err != nil {
+		return "", "", errors.Wrap(err, "cannot compress proposal")
+	}
+
+	blob := base64.StdEncoding.EncodeToString(buf.Bytes())
+	if len(blob) > maxProposalSize {
+		return "", "", errors.Errorf("proposal is %d bytes when encoded, which is more than the %d bytes that can be cached in the %s annotation; approval can't be used to compose this many resources", len(blob), maxProposalSize, annotationProposal)
+	}
+	return proposalHash(j), blob, nil
+}
+
+// decodeProposal decodes a proposal encoded by encodeProposal. It returns an
+// error if the proposal doesn't match the supplied hash.
+func decodeProposal(hash, blob string) (proposal, error) {
+	z, err := base64.StdEncoding.DecodeString(blob)
+	if err != nil {
+		return proposal{}, errors.Wrap(err, "cannot decode proposal")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(z))
+	if err != nil {
+		return proposal{}, errors.Wrap(err, "cannot decompress proposal")
+	}
+	j, err := io.ReadAll(zr)
+	if err != nil {
+		return proposal{}, errors.Wrap(err, "cannot decompress proposal")
+	}
+	if got := proposalHash(j); got != hash {
+		return proposal{}, errors.Errorf("proposal content has hash %s, not %s", got, hash)
+	}
+
+	e := encodedProposal{}
+	if err := json.Unmarshal(j, &e); err != nil {
+		return proposal{}, errors.Wrap(err, "cannot unmarshal proposal")
+	}
+	p := proposal{Resources: make(map[string]*fnv1.Resource, len(e.Resources))}
+	for name, m := range e.Resources {
+		s, err := structpb.NewStruct(m)
+		if err != nil {
+			return proposal{}, errors.Wrapf(err, "cannot convert proposed resource %q", name)
+		}
+		p.Resources[name] = &fnv1.Resource{Resource: s}
+	}
+	if e.ContextOutputs != nil {
+		if p.ContextOutputs, err = structpb.NewValue(e.ContextOutputs); err != nil {
+			return proposal{}, errors.Wrap(err, "cannot convert proposed context outputs")
+		}
+	}
+	return p, nil
+}
+
+// proposalStatus returns a summary of a proposal suitable for writing to the
+// XR's status.
+func proposalStatus(hash string, approved bool, changes *structpb.Value) *structpb.Value {
+	s := &structpb.Struct{Fields: map[string]*structpb.Value{
+		"hash":     structpb.NewStringValue(hash),
+		"approved": structpb.NewBoolValue(approved),
+	}}
+	if changes != nil {
+		s.Fields["changes"] = changes
+	}
+	return structpb.NewStructValue(s)
+}
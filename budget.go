@@ -0,0 +1,244 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/crossplane/function-sdk-go/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+)
+
+// retrievalToolName is the name of the tool Claude can use to retrieve
+// summarized composed resources.
+const retrievalToolName = "get_composed_resource"
+
+// estimateTokens returns the approximate number of tokens in the supplied
+// text.
+func estimateTokens(text ...string) int {
+	n := 0
+	for _, t := range text {
+		n += len(t)
+	}
+	return (n + charsPerToken - 1) / charsPerToken
+}
+
+// budgetStrategy returns the strategy of the supplied budget.
+func budgetStrategy(b *v1alpha1.Budget) v1alpha1.BudgetStrategy {
+	if b.Strategy == "" {
+		return v1alpha1.BudgetStrategyFail
+	}
+	return b.Strategy
+}
+
+// checkBudget returns an error if the supplied prompts exceed the supplied
+// budget, which may be nil.
+func checkBudget(b *v1alpha1.Budget, system, user string) error {
+	if b == nil {
+		return nil
+	}
+	if n := estimateTokens(system, user); n > b.MaxTokens {
+		return errors.Errorf("prompt is about %d tokens, exceeding the budget of %d tokens", n, b.MaxTokens)
+	}
+	return nil
+}
+
+// fitBudget summarizes composed resources as stubs until the user prompt,
+// rendered by the supplied function, fits the supplied budget with the
+// supplied system prompt. It returns the rendered user prompt and the names of
+// the summarized resources.
+func fitBudget(b *v1alpha1.Budget, ocds map[string]*fnv1.Resource, system, user string, render func(stubs map[string]bool) (string, error)) (string, []string, error) {
+	if b == nil || checkBudget(b, system, user) == nil {
+		return user, nil, nil
+	}
+
+	strategy := budgetStrategy(b)
+	if strategy == v1alpha1.BudgetStrategyFail || len(ocds) == 0 {
+		return "", nil, checkBudget(b, system, user)
+	}
+
+	order := summarizeOrder(ocds)
+	stubs := map[string]bool{}
+	for i, name := range order {
+		stubs[name] = true
+
+		// Retrieval summarizes every composed resource at once.
+		if strategy == v1alpha1.BudgetStrategyRetrieve && i < len(order)-1 {
+			continue
+		}
+
+		var err error
+		if user, err = render(stubs); err != nil {
+			return "", nil, err
+		}
+		summarized := order[:i+1]
+		if checkBudget(b, system+summarizedInstructions(summarized, strategy), user) == nil {
+			sort.Strings(summarized)
+			return user, summarized, nil
+		}
+	}
+	return "", nil, errors.Wrap(checkBudget(b, system+summarizedInstructions(order, strategy), user), "cannot fit prompt within budget by summarizing composed resources")
+}
+
+// summarizeOrder returns the names of the supplied composed resources in the
+// order they should be summarized. Ready resources are less likely to need
+// changes, so they're summarized first. Larger resources are summarized before
+// smaller ones.
+func summarizeOrder(ocds map[string]*fnv1.Resource) []string {
+	type candidate struct {
+		name  string
+		ready bool
+		size  int
+	}
+	cs := make([]candidate, 0, len(ocds))
+	for name, r := range ocds {
+		j, _ := r.GetResource().MarshalJSON()
+		cs = append(cs, candidate{name: name, ready: observedReady(r), size: len(j)})
+	}
+	sort.Slice(cs, func(i, j int) bool {
+		if cs[i].ready != cs[j].ready {
+			return cs[i].ready
+		}
+		if cs[i].size != cs[j].size {
+			return cs[i].size > cs[j].size
+		}
+		return cs[i].name < cs[j].name
+	})
+	out := make([]string, len(cs))
+	for i, c := range cs {
+		out[i] = c.name
+	}
+	return out
+}
+
+// observedReady returns true if the supplied observed resource has a Ready
+// condition with status True.
+func observedReady(r *fnv1.Resource) bool {
+	conds := r.GetResource().GetFields()["status"].GetStructValue().GetFields()["conditions"].GetListValue()
+	for _, c := range conds.GetValues() {
+		f := c.GetStructValue().GetFields()
+		if f["type"].GetStringValue() == "Ready" && f["status"].GetStringValue() == "True" {
+			return true
+		}
+	}
+	return false
+}
+
+// stub returns a summary of the supplied resource, containing only its
+// apiVersion, kind, name, and namespace.
+func stub(r *fnv1.Resource) *fnv1.Resource {
+	in := r.GetResource().GetFields()
+	meta := &structpb.Struct{Fields: map[string]*structpb.Value{}}
+	for _, f := range []string{"name", "namespace"} {
+		if v, ok := in["metadata"].GetStructValue().GetFields()[f]; ok {
+			meta.Fields[f] = v
+		}
+	}
+	s := &structpb.Struct{Fields: map[string]*structpb.Value{
+		"metadata": structpb.NewStructValue(meta),
+	}}
+	for _, f := range []string{"apiVersion", "kind"} {
+		if v, ok := in[f]; ok {
+			s.Fields[f] = v
+		}
+	}
+	return &fnv1.Resource{Resource: s}
+}
+
+// summarizedInstructions tells Claude which composed resources are summarized,
+// and that it may omit them. keepSummarized keeps any it omits.
+func summarizedInstructions(names []string, strategy v1alpha1.BudgetStrategy) string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, `
+To save space, the following observed composed resources are summarized as
+stubs containing only their apiVersion, kind, and name: %s.
+Do not return summarized resources unless you need to change them. Summarized
+resources you do not return are kept as they are.
+`, strings.Join(names, ", "))
+	if strategy == v1alpha1.BudgetStrategyRetrieve {
+		fmt.Fprintf(b, `Use the %s tool to retrieve the full manifest of a summarized resource,
+passing its upbound.io/name annotation as input. You must retrieve a resource
+before returning it.
+`, retrievalToolName)
+	}
+	return b.String()
+}
+
+// keepSummarized adds the summarized observed composed resources Claude didn't
+// return to the supplied desired composed resources.
+func keepSummarized(dcds, ocds map[string]*fnv1.Resource, summarized []string) {
+	kept := desiredFromObserved(ocds)
+	for _, name := range summarized {
+		if _, ok := dcds[name]; !ok {
+			dcds[name] = kept[name]
+		}
+	}
+}
+
+// A retrievalTool lets Claude retrieve summarized composed resources.
+type retrievalTool struct {
+	resources map[string]string
+}
+
+// newRetrievalTool returns a tool that retrieves the named composed resources.
+// Resources are prepared by the supplied filters.
+func newRetrievalTool(ocds map[string]*fnv1.Resource, names []string, f resourceFilters) (*retrievalTool, error) {
+	t := &retrievalTool{resources: make(map[string]string, len(names))}
+	for _, name := range names {
+		r, err := f.observedResource(ocds[name])
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot prepare composed resource %q", name)
+		}
+		y, err := ComposedToYAML(map[string]*fnv1.Resource{name: r})
+		if err != nil {
+			return nil, err
+		}
+		t.resources[name] = y
+	}
+	return t, nil
+}
+
+// Name of the tool.
+func (t *retrievalTool) Name() string {
+	return retrievalToolName
+}
+
+// Description of the tool.
+func (t *retrievalTool) Description() string {
+	return "Returns the full YAML manifest of a summarized observed composed resource. The input is the resource's upbound.io/name annotation."
+}
+
+// Call the tool.
+func (t *retrievalTool) Call(_ context.Context, input string) (string, error) {
+	name := strings.Trim(strings.TrimSpace(input), `"'`)
+	if y, ok := t.resources[name]; ok {
+		return y, nil
+	}
+	names := make([]string, 0, len(t.resources))
+	for n := range t.resources {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("There is no summarized composed resource named %q. Summarized resources are: %s.", name, strings.Join(names, ", ")), nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/response"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+)
+
+// cacheBreakpointMarker is rendered by the cacheBreakpoint template function.
+// It never reaches Claude.
+const cacheBreakpointMarker = "\x00claude.fn.upbound.io/cache-breakpoint\x00"
+
+// thinkingBlock matches thinking Claude returns as text.
+var thinkingBlock = regexp.MustCompile(`(?s)<thinking>.*?</thinking>\s*`)
+
+// promptCachingEnabled returns true if the supplied input asks for prompt
+// caching.
+func promptCachingEnabled(in *v1alpha1.Prompt) bool {
+	return in.PromptCaching != nil && in.PromptCaching.Enabled
+}
+
+// cacheablePrefixes removes cache breakpoint markers from the supplied user
+// prompt. If the input enables prompt caching it also returns the cacheable
+// prefixes of the prompt: the system prompt, then each segment of the user
+// prompt that ends at a breakpoint. Each prefix follows the previous one.
+func cacheablePrefixes(in *v1alpha1.Prompt, system, user string) (string, []string) {
+	segments := strings.Split(user, cacheBreakpointMarker)
+	clean := strings.Join(segments, "")
+	if !promptCachingEnabled(in) {
+		return clean, nil
+	}
+
+	prefixes := []string{}
+	if system != "" {
+		prefixes = append(prefixes, system)
+	}
+	for _, s := range segments[:len(segments)-1] {
+		if s != "" {
+			prefixes = append(prefixes, s)
+		}
+	}
+	return clean, prefixes
+}
+
+// withCaching marks the supplied prefixes of the prompt as cacheable, and
+// records the tokens used in the supplied usage.
+func withCaching(prefixes []string, u *usage) invokeOption {
+	return func(o *invokeOptions) {
+		o.cacheable = prefixes
+		o.usage = u
+	}
+}
+
+// stripThinking removes any thinking Claude returned as text from the supplied
+// response, so it's never parsed as part of the answer.
+func stripThinking(resp string) string {
+	return thinkingBlock.ReplaceAllString(resp, "")
+}
+
+// reportUsage reports the prompt cache usage of an invocation.
+func reportUsage(rsp *fnv1.RunFunctionResponse, u *usage) {
+	response.Normalf(rsp, "prompt cache read %d tokens and wrote %d tokens", u.CacheReadInputTokens, u.CacheCreationInputTokens)
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/types/known/structpb"
+	"sigs.k8s.io/yaml"
+
+	"github.com/crossplane/function-sdk-go/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/response"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+	"github.com/upbound/function-claude/internal/schema"
+)
+
+const (
+	// defaultContextOutputsKey is the pipeline context key values are
+	// written under if none is configured.
+	defaultContextOutputsKey = "claude.fn.upbound.io/outputs"
+
+	// annotationContextOutputs records the context outputs Claude returned
+	// with the current composed resources, as JSON, so they can be written
+	// again when the composed resources are reused or held.
+	annotationContextOutputs = "claude.fn.upbound.io/context-outputs"
+
+	contextOutputsTag = "context"
+)
+
+// contextOutputsEnabled returns true if the supplied input asks for context
+// outputs.
+func contextOutputsEnabled(in *v1alpha1.Prompt) bool {
+	return in.ContextOutputs != nil && len(in.ContextOutputs.Values) > 0
+}
+
+// contextOutputsKey returns the pipeline context key values should be
+// written under.
+func contextOutputsKey(co *v1alpha1.ContextOutputs) string {
+	if co.Key != "" {
+		return co.Key
+	}
+	return defaultContextOutputsKey
+}
+
+// contextOutputsInstructions returns instructions asking Claude for the
+// supplied values, in a <context> section after its YAML stream.
+func contextOutputsInstructions(co *v1alpha1.ContextOutputs) string {
+	b := &strings.Builder{}
+	b.WriteString(`
+After the YAML stream, return the following values inside <context></context>
+tags. The content of the tags must be a single YAML map keyed by value name.
+Do not put the tags inside the YAML stream.
+`)
+	for _, v := range co.Values {
+		fmt.Fprintf(b, "- %s:", v.Name)
+		if v.Description != "" {
+			fmt.Fprintf(b, " %s", v.Description)
+		}
+		if v.Schema != nil && len(v.Schema.Raw) > 0 {
+			s := &bytes.Buffer{}
+			if err := json.Compact(s, v.Schema.Raw); err == nil {
+				fmt.Fprintf(b, " It must satisfy the JSON schema %s.", s.String())
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// splitContextOutputs splits the supplied response into its YAML stream and
+// the context output values that follow it. Each configured value must be
+// present and satisfy its schema. Values that weren't asked for are dropped.
+func splitContextOutputs(resp string, co *v1alpha1.ContextOutputs) (string, *structpb.Value, error) {
+	manifests, body, found, err := splitSection(resp, contextOutputsTag)
+	if err != nil {
+		return manifests, nil, err
+	}
+	if !found {
+		return manifests, nil, errors.Errorf("missing <%s> section", contextOutputsTag)
+	}
+
+	got := map[string]any{}
+	if err := yaml.Unmarshal([]byte(body), &got); err != nil {
+		return manifests, nil, errors.Wrap(err, "cannot parse context outputs as a YAML map")
+	}
+
+	out := make(map[string]any, len(co.Values))
+	for _, v := range co.Values {
+		val, ok := got[v.Name]
+		if !ok {
+			return manifests, nil, errors.Errorf("missing value %q", v.Name)
+		}
+		if v.Schema != nil {
+			s, err := schema.Parse(v.Schema.Raw)
+			if err != nil {
+				return manifests, nil, errors.Wrapf(err, "invalid schema for value %q", v.Name)
+			}
+			if err := s.Validate(val); err != nil {
+				return manifests, nil, errors.Wrapf(err, "invalid value %q", v.Name)
+			}
+		}
+		out[v.Name] = val
+	}
+
+	sv, err := structpb.NewValue(out)
+	return manifests, sv, errors.Wrap(err, "cannot convert context outputs")
+}
+
+// setContextOutputs writes the supplied context outputs to the pipeline
+// context. It does nothing if outputs is nil.
+func setContextOutputs(rsp *fnv1.RunFunctionResponse, co *v1alpha1.ContextOutputs, outputs *structpb.Value) {
+	if outputs == nil {
+		return
+	}
+	response.SetContextKey(rsp, contextOutputsKey(co), outputs)
+}
+
+// encodeContextOutputs returns the supplied context outputs as JSON, suitable
+// for recording in an annotation.
+func encodeContextOutputs(outputs *structpb.Value) (string, error) {
+	j, err := json.Marshal(outputs.AsInterface())
+	return string(j), errors.Wrap(err, "cannot marshal context outputs to JSON")
+}
+
+// recordedContextOutputs returns the context outputs recorded on the supplied
+// XR. It returns nil if the input doesn't ask for context outputs, and an
+// error if it does but none are recorded.
+func recordedContextOutputs(xr *fnv1.Resource, in *v1alpha1.Prompt) (*structpb.Value, error) {
+	if !contextOutputsEnabled(in) {
+		return nil, nil
+	}
+	j, ok := annotations(xr)[annotationContextOutputs]
+	if !ok {
+		return nil, errors.New("no context outputs recorded")
+	}
+	var v any
+	if err := json.Unmarshal([]byte(j), &v); err != nil {
+		return nil, errors.Wrap(err, "cannot unmarshal recorded context outputs")
+	}
+	out, err := structpb.NewValue(v)
+	return out, errors.Wrap(err, "cannot convert recorded context outputs")
+}
+
+// holdContextOutputs writes the context outputs recorded on the observed XR to
+// the pipeline context, so that later functions still see them when Claude
+// isn't asked for new ones. It does nothing if none are recorded.
+func holdContextOutputs(req *fnv1.RunFunctionRequest, in *v1alpha1.Prompt, rsp *fnv1.RunFunctionResponse) {
+	outputs, err := recordedContextOutputs(req.GetObserved().GetComposite(), in)
+	if err != nil {
+		return
+	}
+	setContextOutputs(rsp, in.ContextOutputs, outputs)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/crossplane/function-sdk-go/errors"
+	"github.com/crossplane/function-sdk-go/logging"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/response"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+	"github.com/upbound/function-claude/internal/diff"
+)
+
+// maxDiffFields is the maximum number of changed fields named in a single
+// diff result.
+const maxDiffFields = 5
+
+// diffEnabled returns true if the supplied input asks for diff reporting.
+func diffEnabled(in *v1alpha1.Prompt) bool {
+	return in.Diff != nil && in.Diff.Enabled
+}
+
+// composedDiff returns the differences between the supplied observed and
+// desired composed resources.
+func composedDiff(observed, desired map[string]*fnv1.Resource) []diff.Resource {
+	return diff.Resources(asMaps(observed), asMaps(desired))
+}
+
+// reportComposedDiff reports the differences between the observed and supplied
+// desired composed resources, if the input asks for them.
+func reportComposedDiff(log logging.Logger, d pipelineDetails, dcds map[string]*fnv1.Resource) {
+	if !diffEnabled(d.in) {
+		return
+	}
+	ds := composedDiff(d.req.GetObserved().GetResources(), dcds)
+	reportDiff(log, d.rsp, ds)
+	if d.in.Diff.StatusField != "" {
+		setCompositeStatusField(d.rsp, d.in.Diff.StatusField, diffStatus(ds))
+	}
+}
+
+// reportDiff reports the supplied differences as results. Removed resources
+// are reported as warnings, since deleting a composed resource is usually the
+// most disruptive change. Changed fields are logged at debug level.
+func reportDiff(log logging.Logger, rsp *fnv1.RunFunctionResponse, ds []diff.Resource) {
+	if len(ds) == 0 {
+		log.Debug("No changes to composed resources")
+		return
+	}
+	for _, r := range ds {
+		for _, f := range r.Fields {
+			log.Debug("Composed resource field changed", "resource", r.Name, "path", f.Path, "change", f.Type, "observed", f.Observed, "desired", f.Desired)
+		}
+		if r.Type == diff.Removed {
+			response.Warning(rsp, errors.New(diff.Summary(r, maxDiffFields)))
+			continue
+		}
+		response.Normal(rsp, diff.Summary(r, maxDiffFields))
+	}
+}
+
+// diffStatus returns a summary of the supplied differences suitable for
+// writing to the XR's status.
+func diffStatus(ds []diff.Resource) *structpb.Value {
+	out := make([]any, len(ds))
+	for i, r := range ds {
+		s := map[string]any{"name": r.Name, "type": string(r.Type)}
+		if len(r.Fields) > 0 {
+			paths := make([]any, len(r.Fields))
+			for j, p := range diff.Paths(r.Fields) {
+				paths[j] = p
+			}
+			s["fields"] = paths
+		}
+		out[i] = s
+	}
+	// NewValue can only fail for unsupported types, which we don't use.
+	v, _ := structpb.NewValue(out)
+	return v
+}
+
+// setCompositeStatusField sets the supplied value at the supplied dot
+// separated path within the desired XR's status.
+func setCompositeStatusField(rsp *fnv1.RunFunctionResponse, path string, v *structpb.Value) {
+	s := subStruct(desiredComposite(rsp), "status")
+	parts := strings.Split(strings.TrimPrefix(path, "status."), ".")
+	for _, p := range parts[:len(parts)-1] {
+		s = subStruct(s, p)
+	}
+	s.Fields[parts[len(parts)-1]] = v
+}
+
+// asMaps converts the supplied resources to unstructured maps.
+func asMaps(rs map[string]*fnv1.Resource) map[string]map[string]any {
+	out := make(map[string]map[string]any, len(rs))
+	for name, r := range rs {
+		out[name] = r.GetResource().AsMap()
+	}
+	return out
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/crossplane/function-sdk-go/logging"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/request"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/response"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+	"github.com/upbound/function-claude/internal/diff"
+)
+
+// dryRunContextKey enables dry run when set to true in the pipeline context.
+const dryRunContextKey = "claude.fn.upbound.io/dry-run"
+
+// dryRun returns true if the supplied input, or the pipeline context, asks
+// for a dry run.
+func dryRun(req *fnv1.RunFunctionRequest, in *v1alpha1.Prompt) bool {
+	if in.DryRun {
+		return true
+	}
+	v, ok := request.GetContextKey(req, dryRunContextKey)
+	return ok && v.GetBoolValue()
+}
+
+// reportDryRun reports the differences between the supplied desired resources
+// and the existing resources they target. Existing resources that aren't
+// targeted are not reported, since operations never delete resources by
+// omitting them.
+func reportDryRun(log logging.Logger, rsp *fnv1.RunFunctionResponse, existing map[string][]resource.Required, desired map[string]*fnv1.Resource) {
+	observed := map[string]map[string]any{}
+	for _, rs := range existing {
+		for _, r := range rs {
+			key := resourceKey(r.Resource)
+			if _, ok := desired[key]; ok {
+				observed[key] = r.Resource.UnstructuredContent()
+			}
+		}
+	}
+
+	ds := diff.Resources(observed, asMaps(desired))
+	if len(ds) == 0 {
+		response.Normal(rsp, "dry run: no changes would be made")
+		return
+	}
+	for _, r := range ds {
+		for _, f := range r.Fields {
+			log.Debug("Dry run field change", "resource", r.Name, "path", f.Path, "change", f.Type, "observed", f.Observed, "desired", f.Desired)
+		}
+		response.Normalf(rsp, "dry run: %s", diff.Summary(r, maxDiffFields))
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+)
+
+// eventsRequirementKey is the name under which the function requires the
+// Events about the watched resource.
+const eventsRequirementKey = requirementPrefix + "events"
+
+// defaultEventLimit is the default maximum number of deduplicated events
+// supplied to the prompt.
+const defaultEventLimit = 20
+
+// eventsEnabled returns true unless the supplied input opts out of Events.
+func eventsEnabled(in *v1alpha1.Prompt) bool {
+	return in.Events == nil || in.Events.Enabled == nil || *in.Events.Enabled
+}
+
+// maxEvents is the maximum number of Events in the watched resource's
+// namespace that summarizeEvents considers. Busy namespaces can hold thousands
+// of Events, so only the most recent are considered.
+const maxEvents = 500
+
+// eventsRequirement adds a requirement for the Events about the supplied
+// watched resource to the supplied requirements, unless the input opts out of
+// them.
+func eventsRequirement(rq *fnv1.Requirements, in *v1alpha1.Prompt, watched map[string]any) *fnv1.Requirements {
+	if watched == nil || !eventsEnabled(in) {
+		return rq
+	}
+	if rq == nil {
+		rq = &fnv1.Requirements{}
+	}
+	if rq.Resources == nil {
+		rq.Resources = map[string]*fnv1.ResourceSelector{}
+	}
+	rq.Resources[eventsRequirementKey] = eventsSelector(watched)
+	return rq
+}
+
+// eventsSelector returns a selector for the Events in the namespace of the
+// supplied watched resource. Events can't be selected by involvedObject, so
+// all Events in the namespace are required and filtered by summarizeEvents.
+// Events about cluster scoped resources are recorded in the default namespace.
+func eventsSelector(watched map[string]any) *fnv1.ResourceSelector {
+	ns := (&unstructured.Unstructured{Object: watched}).GetNamespace()
+	if ns == "" {
+		ns = "default"
+	}
+	return &fnv1.ResourceSelector{
+		ApiVersion: "v1",
+		Kind:       "Event",
+		Namespace:  &ns,
+		Match:      &fnv1.ResourceSelector_MatchLabels{MatchLabels: &fnv1.MatchLabels{}},
+	}
+}
+
+// operationEvents returns the summarized Events about the supplied watched
+// resource, or an empty string if the input opts out of them.
+func operationEvents(in *v1alpha1.Prompt, rr map[string][]resource.Required, watched map[string]any) string {
+	if watched == nil || !eventsEnabled(in) {
+		return ""
+	}
+	limit := defaultEventLimit
+	if in.Events != nil && in.Events.Limit != nil {
+		limit = *in.Events.Limit
+	}
+	return summarizeEvents(rr[eventsRequirementKey], watched, limit)
+}
+
+// An eventSummary is one or more Events with the same type, reason and
+// message.
+type eventSummary struct {
+	Type     string
+	Reason   string
+	Message  string
+	Count    int64
+	LastSeen string
+}
+
+// summarizeEvents returns the supplied Events about the supplied watched
+// resource, deduplicated and most recent first, as one line per summary. At
+// most limit summaries are returned.
+func summarizeEvents(events []resource.Required, watched map[string]any, limit int) string {
+	w := &unstructured.Unstructured{Object: watched}
+
+	byKey := map[string]*eventSummary{}
+	for _, r := range recentEvents(events, maxEvents) {
+		e := r.Resource
+		if !involves(e, w) {
+			continue
+		}
+		typ, _, _ := unstructured.NestedString(e.Object, "type")
+		reason, _, _ := unstructured.NestedString(e.Object, "reason")
+		msg, _, _ := unstructured.NestedString(e.Object, "message")
+		msg = strings.TrimSpace(msg)
+
+		k := typ + "\x00" + reason + "\x00" + msg
+		s, ok := byKey[k]
+		if !ok {
+			s = &eventSummary{Type: typ, Reason: reason, Message: msg}
+			byKey[k] = s
+		}
+		s.Count += eventCount(e)
+		// RFC 3339 timestamps in UTC sort lexically.
+		if t := lastSeen(e); t > s.LastSeen {
+			s.LastSeen = t
+		}
+	}
+
+	out := make([]*eventSummary, 0, len(byKey))
+	for _, s := range byKey {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].LastSeen != out[j].LastSeen {
+			return out[i].LastSeen > out[j].LastSeen
+		}
+		return out[i].Count > out[j].Count
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+
+	b := &strings.Builder{}
+	for _, s := range out {
+		fmt.Fprintf(b, "%s %s %s (x%d): %s\n", s.LastSeen, s.Type, s.Reason, s.Count, s.Message)
+	}
+	return b.String()
+}
+
+// recentEvents returns at most limit of the supplied Events, most recent
+// first.
+func recentEvents(events []resource.Required, limit int) []resource.Required {
+	if len(events) <= limit {
+		return events
+	}
+	out := make([]resource.Required, len(events))
+	copy(out, events)
+	sort.SliceStable(out, func(i, j int) bool {
+		return lastSeen(out[i].Resource) > lastSeen(out[j].Resource)
+	})
+	return out[:limit]
+}
+
+// involves returns true if the supplied Event is about the supplied resource.
+func involves(e, u *unstructured.Unstructured) bool {
+	io, _, _ := unstructured.NestedStringMap(e.Object, "involvedObject")
+	if uid := string(u.GetUID()); uid != "" && io["uid"] != "" {
+		return io["uid"] == uid
+	}
+	return io["kind"] == u.GetKind() && io["name"] == u.GetName() && io["namespace"] == u.GetNamespace()
+}
+
+// eventCount returns how many times the supplied Event occurred.
+func eventCount(e *unstructured.Unstructured) int64 {
+	for _, path := range [][]string{{"series", "count"}, {"count"}} {
+		v, _, _ := unstructured.NestedFieldNoCopy(e.Object, path...)
+		// Numbers may be float64 when converted from a protobuf struct.
+		switch c := v.(type) {
+		case int64:
+			if c > 0 {
+				return c
+			}
+		case float64:
+			if c > 0 {
+				return int64(c)
+			}
+		}
+	}
+	return 1
+}
+
+// lastSeen returns when the supplied Event last occurred.
+func lastSeen(e *unstructured.Unstructured) string {
+	for _, path := range [][]string{
+		{"series", "lastObservedTime"},
+		{"lastTimestamp"},
+		{"eventTime"},
+		{"metadata", "creationTimestamp"},
+	} {
+		if t, _, _ := unstructured.NestedString(e.Object, path...); t != "" {
+			return t
+		}
+	}
+	return ""
+}
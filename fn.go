@@ -18,10 +18,11 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"io"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
@@ -31,6 +32,8 @@ import (
 	"github.com/tmc/langchaingo/tools"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/types/known/structpb"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
 	"sigs.k8s.io/yaml"
 
 	"github.com/crossplane/function-sdk-go/errors"
@@ -51,27 +54,62 @@ const (
 	defaultModel = "claude-sonnet-4-5-20250929"
 )
 
-// Variables used to form the prompt.
-type Variables struct {
-	// Observed composite resource, as a YAML manifest.
-	Composite string
-
-	// Observed composed resources, as a stream of YAML manifests.
-	Composed string
-}
-
 // Function asks Claude to compose resources.
 type Function struct {
 	fnv1.UnimplementedFunctionRunnerServiceServer
 	ai agentInvoker
 
-	log logging.Logger
+	log     logging.Logger
+	now     func() time.Time
+	limiter rateLimiter
 }
 
 // agentInvoker is a consumer interface for working with agents. Notably this
 // is helpful for writing tests that mock the agent invocations.
 type agentInvoker interface {
-	Invoke(ctx context.Context, key, system, prompt, modelName string) (string, error)
+	Invoke(ctx context.Context, key, system, prompt, modelName string, opts ...invokeOption) (string, error)
+}
+
+// invokeOptions configure an agent invocation.
+type invokeOptions struct {
+	// tools made available to the agent, in addition to MCP tools.
+	tools []tools.Tool
+
+	temperature   float64
+	maxTokens     int
+	maxIterations int
+	stopSequences []string
+
+	// cacheable prefixes of the prompt.
+	cacheable []string
+	// thinkingBudget enables extended thinking if greater than zero.
+	thinkingBudget int
+	// usage, if set, records the tokens used.
+	usage *usage
+}
+
+// An invokeOption configures an agent invocation.
+type invokeOption func(o *invokeOptions)
+
+// withTools makes the supplied tools available to the agent.
+func withTools(ts ...tools.Tool) invokeOption {
+	return func(o *invokeOptions) {
+		o.tools = append(o.tools, ts...)
+	}
+}
+
+// newInvokeOptions returns the invocation options configured by the supplied
+// options.
+func newInvokeOptions(opts ...invokeOption) invokeOptions {
+	o := invokeOptions{
+		temperature:   defaultTemperature,
+		maxTokens:     defaultMaxTokens,
+		maxIterations: defaultMaxIterations,
+	}
+	for _, fn := range opts {
+		fn(&o)
+	}
+	return o
 }
 
 // Option modifies the underlying Function.
@@ -88,6 +126,7 @@ func WithLogger(log logging.Logger) Option {
 func NewFunction(opts ...Option) *Function {
 	f := &Function{
 		log: logging.NewNopLogger(),
+		now: time.Now,
 	}
 
 	for _, o := range opts {
@@ -121,6 +160,23 @@ func (f *Function) RunFunction(ctx context.Context, req *fnv1.RunFunctionRequest
 		response.Fatal(rsp, errors.Wrapf(err, "cannot get Function input from %T", req))
 		return rsp, nil
 	}
+	if err := validatePresetPipeline(in.Preset, inCompositionPipeline(req)); err != nil {
+		response.Fatal(rsp, err)
+		return rsp, nil
+	}
+
+	reason, err := skipReason(req, in)
+	if err != nil {
+		response.Fatal(rsp, errors.Wrap(err, "cannot evaluate skip policy"))
+		return rsp, nil
+	}
+	if reason != "" {
+		log.Debug("Skipping", "reason", reason)
+		holdObserved(req, in, rsp)
+		response.ConditionTrue(rsp, "FunctionSuccess", "Success").TargetCompositeAndClaim()
+		response.Normalf(rsp, "skipping, %s", reason)
+		return rsp, nil
+	}
 
 	c, err := request.GetCredentials(req, credName)
 	if err != nil {
@@ -259,36 +315,153 @@ func extractJSONFromAgentError(err error) (string, bool) {
 	return cleaned, true
 }
 
-// resourceFrom produces a map of resource name to resources derived from the
-// given string. If the string is neither JSON nor YAML, an error is returned.
-// Returns the parsed resources, the cleaned input string (with markdown stripped), and any error.
-func (f *Function) resourceFrom(i string) (map[string]*fnv1.Resource, string, error) {
-	out := make(map[string]*fnv1.Resource)
-
+// errNoResources indicates that a response did not contain any resources,
+// e.g. because Claude responded with prose.
+var errNoResources = errors.New("response does not contain any resources")
+
+// resourcesFrom produces a map of desired resources derived from the given
+// string, which may be a stream of YAML or JSON documents, a JSON array, or a
+// v1 List. Each document must be a full object or a JSON merge patch with an
+// apiVersion, kind, and metadata.name. A document that omits its namespace
+// inherits the namespace of the existing resource it targets, if any.
+// Metadata managed by the API server is stripped. Returns the parsed
+// resources, the cleaned input string (with markdown stripped), and any error.
+// If the string contains no resources errNoResources is returned.
+func (f *Function) resourcesFrom(i string, existing map[string][]resource.Required) (map[string]*fnv1.Resource, string, error) {
 	// Strip markdown code blocks if present
 	cleaned := stripMarkdownCodeBlocks(i)
 
-	b := []byte(cleaned)
-
-	// Is i YAML?
-	jb, err := yaml.YAMLToJSON(b)
+	docs, err := decodeDocuments(cleaned)
 	if err != nil {
-		f.log.Debug("error seen while attempting to convert YAML to JSON", "error", err)
-		// i doesn't appear to be YAML, maybe it's JSON...
-		jb = b
+		f.log.Debug("error seen while attempting to decode response", "error", err)
+		return nil, cleaned, errors.Wrap(errNoResources, err.Error())
 	}
-
-	s := &structpb.Struct{}
-	if err := protojson.Unmarshal(jb, s); err != nil {
-		return nil, cleaned, errors.Wrap(err, "cannot parse JSON")
+	if len(docs) == 0 {
+		return nil, cleaned, errNoResources
 	}
 
-	name := gjson.GetBytes(jb, "metadata.name").String()
-	out[name] = &fnv1.Resource{Resource: s}
+	out := make(map[string]*fnv1.Resource, len(docs))
+	for n, doc := range docs {
+		o, ok := doc.(map[string]any)
+		if !ok {
+			if n == 0 && len(docs) == 1 {
+				// Likely prose that happens to be valid YAML.
+				return nil, cleaned, errNoResources
+			}
+			return nil, cleaned, errors.Errorf("document %d is not an object", n)
+		}
+
+		key, err := validateDocument(o, existing)
+		if err != nil {
+			return nil, cleaned, errors.Wrapf(err, "invalid document %d", n)
+		}
+		if _, seen := out[key]; seen {
+			return nil, cleaned, errors.Errorf("document %d: %s appears more than once", n, key)
+		}
+
+		s, err := structpb.NewStruct(o)
+		if err != nil {
+			return nil, cleaned, errors.Wrapf(err, "cannot convert document %d", n)
+		}
+		out[key] = &fnv1.Resource{Resource: s}
+	}
 
 	return out, cleaned, nil
 }
 
+// decodeDocuments decodes the supplied stream of YAML or JSON documents.
+// JSON arrays and v1 Lists are flattened into their items.
+func decodeDocuments(s string) ([]any, error) {
+	out := make([]any, 0)
+	d := k8syaml.NewYAMLOrJSONDecoder(strings.NewReader(s), 4096)
+	for {
+		var doc any
+		err := d.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			return out, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot decode YAML or JSON")
+		}
+		out = append(out, flatten(doc)...)
+	}
+}
+
+// flatten returns the items of the supplied document if it's an array or a v1
+// List, or the document itself otherwise. Empty documents are dropped.
+func flatten(doc any) []any {
+	switch d := doc.(type) {
+	case nil:
+		return nil
+	case []any:
+		return d
+	case map[string]any:
+		if items, ok := d["items"].([]any); ok && d["apiVersion"] == "v1" && d["kind"] == "List" {
+			return items
+		}
+	}
+	return []any{doc}
+}
+
+// validateDocument validates that the supplied document identifies the
+// resource it applies to, and returns a key that uniquely identifies it. The
+// document is modified in place to fill in its namespace and strip metadata
+// managed by the API server.
+func validateDocument(o map[string]any, existing map[string][]resource.Required) (string, error) {
+	u := &unstructured.Unstructured{Object: o}
+	if u.GetAPIVersion() == "" {
+		return "", errors.New("missing apiVersion")
+	}
+	if u.GetKind() == "" {
+		return "", errors.New("missing kind")
+	}
+	if u.GetName() == "" {
+		return "", errors.New("missing metadata.name")
+	}
+
+	if u.GetNamespace() == "" {
+		u.SetNamespace(existingNamespace(u, existing))
+	}
+
+	if meta, ok := o["metadata"].(map[string]any); ok {
+		for _, f := range metadataNoise {
+			delete(meta, f)
+		}
+	}
+
+	return resourceKey(u), nil
+}
+
+// existingNamespace returns the namespace of the existing resource with the
+// same apiVersion, kind, and name as the supplied resource, if any.
+func existingNamespace(u *unstructured.Unstructured, existing map[string][]resource.Required) string {
+	ns := ""
+	for _, rs := range existing {
+		for _, r := range rs {
+			e := r.Resource
+			if e.GetAPIVersion() == u.GetAPIVersion() && e.GetKind() == u.GetKind() && e.GetName() == u.GetName() && e.GetNamespace() != "" {
+				ns = e.GetNamespace()
+			}
+		}
+	}
+	return ns
+}
+
+// resourceKey returns a key that uniquely identifies the supplied resource
+// among the resources of an operation, e.g. Deployment.apps/default/web. The
+// key includes the resource's API group, but not its version, because every
+// version of a group serves the same resources.
+func resourceKey(u *unstructured.Unstructured) string {
+	kind := u.GetKind()
+	if g := u.GroupVersionKind().Group; g != "" {
+		kind = kind + "." + g
+	}
+	if u.GetNamespace() == "" {
+		return fmt.Sprintf("%s/%s", kind, u.GetName())
+	}
+	return fmt.Sprintf("%s/%s/%s", kind, u.GetNamespace(), u.GetName())
+}
+
 // attempts to identify if the function is operating within a composition
 // pipeline or not by looking to see if a composite was sent with the request.
 func inCompositionPipeline(req *fnv1.RunFunctionRequest) bool {
@@ -305,131 +478,624 @@ type pipelineDetails struct {
 	in *v1alpha1.Prompt
 	// LLM API credential
 	cred string
+	// Outputs of the earlier steps of a prompt chain
+	steps map[string]StepVariables
+	// Required resources supplied by Crossplane
+	rr map[string][]resource.Required
+	// Prompt fragments of the built in and configured prompt libraries
+	lib promptLibrary
 }
 
 // compositionPipeline processes the given pipelineDetails with the assumption
 // that the function is defined in a composition pipeline and will be working
 // with composites and desired resources.
 func (f *Function) compositionPipeline(ctx context.Context, log logging.Logger, d pipelineDetails) (*fnv1.RunFunctionResponse, error) {
-	prompt, err := template.New("prompt").Parse(d.in.UserPrompt)
+	// Requirements must be returned on every call, or Crossplane will stop
+	// supplying the required resources.
+	var err error
+	d.rsp.Requirements, err = requirements(d.in.RequiredResources, map[string]any{"Composite": d.req.GetObserved().GetComposite().GetResource().AsMap()})
+	if err != nil {
+		response.Fatal(d.rsp, errors.Wrap(err, "cannot build required resource selectors"))
+		return d.rsp, err
+	}
+	d.rsp.Requirements = libraryRequirements(d.rsp.Requirements, d.in.PromptLibraries)
+	d.rr, err = request.GetRequiredResources(d.req)
 	if err != nil {
-		response.Fatal(d.rsp, errors.Wrap(err, "cannot parse userPrompt"))
+		response.Fatal(d.rsp, errors.Wrapf(err, "cannot get Function required resources from %T", d.req))
 		return d.rsp, err
 	}
+	if !requirementsSatisfied(d.rsp.GetRequirements(), d.rr) {
+		// Crossplane will call us again with the required resources.
+		log.Debug("Waiting for required resources")
+		return d.rsp, nil
+	}
 
-	// TODO(negz): I'm using YAML as input/output because I assume the model
-	// will be better able to represent Kubernetes stuff as YAML manifests
-	// than as e.g. JSON. YAML's much more prevalent in examples etc. Could
-	// be worth validating this - could we use JSON instead to skip extra
-	// conversion?
-	xr, err := CompositeToYAML(d.req.GetObserved().GetComposite())
+	d.lib, err = loadPromptLibrary(d.in.PromptLibraries, d.rr)
 	if err != nil {
-		response.Fatal(d.rsp, errors.Wrap(err, "cannot convert observed XR to YAML"))
+		response.Fatal(d.rsp, errors.Wrap(err, "cannot load prompt libraries"))
 		return d.rsp, err
 	}
 
-	cds, err := ComposedToYAML(d.req.GetObserved().GetResources())
+	if approvalEnabled(d.in) {
+		return f.approvalPipeline(ctx, log, d)
+	}
+
+	fingerprint, err := compositionFingerprint(d)
 	if err != nil {
-		response.Fatal(d.rsp, errors.Wrap(err, "cannot convert observed composed resources to YAML"))
+		response.Fatal(d.rsp, errors.Wrap(err, "cannot fingerprint observed XR"))
 		return d.rsp, err
 	}
+	if f.reuseObserved(log, d, fingerprint) {
+		return d.rsp, nil
+	}
 
-	vars := &strings.Builder{}
-	if err := prompt.Execute(vars, &Variables{Composite: xr, Composed: cds}); err != nil {
-		response.Fatal(d.rsp, errors.Wrapf(err, "cannot build prompt from template"))
+	dcds, outputs, err := f.compose(ctx, log, d)
+	if err != nil {
 		return d.rsp, err
 	}
+	d.rsp.Desired.Resources = dcds
+	setContextOutputs(d.rsp, d.in.ContextOutputs, outputs)
 
-	log.Debug("Using prompt", "prompt", vars.String())
+	reportComposedDiff(log, d, dcds)
 
-	resp, err := f.ai.Invoke(ctx, d.cred, d.in.SystemPrompt, vars.String(), d.in.ModelName)
+	if err := f.recordComposition(d, fingerprint, outputs); err != nil {
+		response.Fatal(d.rsp, err)
+		return d.rsp, err
+	}
+	return d.rsp, nil
+}
+
+// compositionFingerprint returns the fingerprint of the observed XR's spec,
+// if the input needs it. It returns an empty string otherwise.
+func compositionFingerprint(d pipelineDetails) (string, error) {
+	if !stabilizationEnabled(d.in) && !routesBySpec(d.in) {
+		return "", nil
+	}
+	return specFingerprint(d.req.GetObserved().GetComposite(), d.in, d.lib)
+}
+
+// reuseObserved reuses the observed composed resources, and the context
+// outputs recorded with them, if stabilization allows it. It returns true if
+// they were reused.
+func (f *Function) reuseObserved(log logging.Logger, d pipelineDetails, fingerprint string) bool {
+	if !stabilizationEnabled(d.in) {
+		return false
+	}
+	xr := d.req.GetObserved().GetComposite()
+	if reuse, reason := canReuseObserved(d.req, d.in.Stabilization, fingerprint, f.now()); !reuse {
+		log.Debug("Cannot reuse observed composed resources", "reason", reason, "fingerprint", fingerprint)
+		return false
+	}
+	outputs, err := recordedContextOutputs(xr, d.in)
+	if err != nil {
+		log.Debug("Cannot reuse observed composed resources", "reason", err, "fingerprint", fingerprint)
+		return false
+	}
+
+	log.Debug("XR spec unchanged since last composition, reusing observed composed resources", "fingerprint", fingerprint)
+	d.rsp.Desired.Resources = desiredFromObserved(d.req.GetObserved().GetResources())
+	setContextOutputs(d.rsp, d.in.ContextOutputs, outputs)
+	// Annotations missing from the desired XR are removed, so return those
+	// recorded with the reused resources.
+	a := map[string]string{
+		annotationSpecFingerprint: fingerprint,
+		annotationComposedAt:      annotations(xr)[annotationComposedAt],
+	}
+	if outputs != nil {
+		a[annotationContextOutputs] = annotations(xr)[annotationContextOutputs]
+	}
+	setCompositeAnnotations(d.rsp, a)
+	response.Normal(d.rsp, "XR spec unchanged since last composition, reusing observed composed resources")
+	return true
+}
+
+// recordComposition annotates the XR with what stabilization, model routing,
+// and skipping need to know about the composition on later calls.
+func (f *Function) recordComposition(d pipelineDetails, fingerprint string, outputs *structpb.Value) error {
+	a := map[string]string{}
+	switch {
+	case stabilizationEnabled(d.in):
+		a[annotationSpecFingerprint] = fingerprint
+		a[annotationComposedAt] = f.now().UTC().Format(time.RFC3339)
+	case routesBySpec(d.in):
+		a[annotationSpecFingerprint] = fingerprint
+	}
+	// Context outputs are recorded so skipped calls can write them again.
+	if outputs != nil {
+		j, err := encodeContextOutputs(outputs)
+		if err != nil {
+			return err
+		}
+		a[annotationContextOutputs] = j
+	}
+	if len(a) > 0 {
+		setCompositeAnnotations(d.rsp, a)
+	}
+	return nil
+}
 
+// compose asks Claude to compose resources for the observed XR, and returns
+// the desired composed resources and any context outputs it produced. Any
+// error is also reported as a fatal result.
+func (f *Function) compose(ctx context.Context, log logging.Logger, d pipelineDetails) (map[string]*fnv1.Resource, *structpb.Value, error) {
+	// The spec fingerprint covers the whole input, so check it before the
+	// input is replaced by the final step of any prompt chain.
+	unchanged := specUnchanged(d.req, d.in, d.lib)
+	d, prompt, err := f.compositionSteps(ctx, log, d, unchanged)
+	if err != nil {
+		response.Fatal(d.rsp, err)
+		return nil, nil, err
+	}
+
+	system, err := compositionSystemPrompt(d.in, d.lib)
+	if err != nil {
+		response.Fatal(d.rsp, errors.Wrap(err, "cannot build system prompt"))
+		return nil, nil, err
+	}
+
+	user, filters, summarized, err := composePrompt(d, prompt, system)
+	if err != nil {
+		response.Fatal(d.rsp, err)
+		return nil, nil, err
+	}
+
+	system, opts, err := composeOptions(log, d, filters, summarized, system)
+	if err != nil {
+		response.Fatal(d.rsp, err)
+		return nil, nil, err
+	}
+	reportSanitized(d.rsp, log, filters.sanitizer)
+	reportRedacted(d.rsp, log, filters.redactor)
+
+	log.Debug("Using prompt", "prompt", user)
+
+	resp, err := f.invoke(ctx, log, d, system, user, unchanged, opts...)
 	if err != nil {
 		response.Fatal(d.rsp, errors.Wrap(err, "failed to run chain"))
-		return d.rsp, err
+		return nil, nil, err
+	}
+
+	return composedFrom(log, d, filters.redactor, summarized, resp)
+}
+
+// compositionSteps runs any earlier steps of the input's prompt chain, and
+// returns the pipeline details and user prompt template of the final
+// invocation of Claude.
+func (f *Function) compositionSteps(ctx context.Context, log logging.Logger, d pipelineDetails, unchanged bool) (pipelineDetails, *template.Template, error) {
+	d, err := f.runSteps(ctx, log, d, d.lib, unchanged, func(input string) (*Variables, error) {
+		red, err := newRedactor(d.in)
+		if err != nil {
+			return nil, err
+		}
+		return compositionVariables(d.req, input, d.rr, resourceFilters{sanitizer: newSanitizer(d.in), redactor: red})
+	})
+	if err != nil {
+		return d, nil, err
+	}
+	prompt, err := promptTemplate(d.in, d.lib)
+	return d, prompt, err
+}
+
+// composePrompt renders the user prompt of a composition pipeline. It
+// summarizes composed resources as stubs until the prompt fits the input's
+// budget with the supplied system prompt, and returns the names of the
+// summarized resources.
+func composePrompt(d pipelineDetails, prompt *template.Template, system string) (string, resourceFilters, []string, error) {
+	user, filters, err := compositionPrompt(d, prompt, nil)
+	if err != nil {
+		return "", filters, nil, err
+	}
+
+	user, summarized, err := fitBudget(d.in.Budget, d.req.GetObserved().GetResources(), system, user, func(stubs map[string]bool) (string, error) {
+		var u string
+		var err error
+		u, filters, err = compositionPrompt(d, prompt, stubs)
+		return u, err
+	})
+	return user, filters, summarized, err
+}
+
+// compositionSystemPrompt returns the system prompt of a composition
+// pipeline, including the instructions for its rationale and context outputs.
+func compositionSystemPrompt(in *v1alpha1.Prompt, lib promptLibrary) (string, error) {
+	system, err := lib.systemPrompt(in)
+	if err != nil {
+		return "", err
+	}
+	if rationaleEnabled(in) {
+		system += rationaleInstructions
+	}
+	if contextOutputsEnabled(in) {
+		system += contextOutputsInstructions(in.ContextOutputs)
+	}
+	return system, nil
+}
+
+// composeOptions returns the options used to invoke Claude to compose
+// resources. If the named composed resources were summarized to fit the
+// prompt budget it adds instructions about them to the supplied system prompt,
+// and a tool to retrieve them if the budget's strategy asks for one.
+func composeOptions(log logging.Logger, d pipelineDetails, filters resourceFilters, summarized []string, system string) (string, []invokeOption, error) {
+	gen, err := generationOption(d.in)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "invalid generation parameters")
+	}
+	opts := []invokeOption{gen}
+	if len(summarized) == 0 {
+		return system, opts, nil
+	}
+
+	strategy := budgetStrategy(d.in.Budget)
+	system += summarizedInstructions(summarized, strategy)
+	if strategy == v1alpha1.BudgetStrategyRetrieve {
+		t, err := newRetrievalTool(d.req.GetObserved().GetResources(), summarized, resourceFilters{sanitizer: newSanitizer(d.in), redactor: filters.redactor})
+		if err != nil {
+			return "", nil, errors.Wrap(err, "cannot build retrieval tool")
+		}
+		opts = append(opts, withTools(t))
+	}
+	log.Debug("Summarized composed resources to fit the prompt budget", "strategy", strategy, "summarized", summarized)
+	response.Normalf(d.rsp, "summarized %d composed resources to fit the prompt budget of %d tokens", len(summarized), d.in.Budget.MaxTokens)
+	return system, opts, nil
+}
+
+// composedFrom returns the desired composed resources and context outputs in
+// the supplied response from Claude, and reports any rationale. Composed
+// resources that were summarized to fit the prompt budget are kept as
+// observed. Any error is also reported as a fatal result.
+func composedFrom(log logging.Logger, d pipelineDetails, red *redactor, summarized []string, resp string) (map[string]*fnv1.Resource, *structpb.Value, error) {
+	var outputs *structpb.Value
+	var err error
+	if contextOutputsEnabled(d.in) {
+		resp, outputs, err = splitContextOutputs(resp, d.in.ContextOutputs)
+		if err != nil {
+			response.Fatal(d.rsp, errors.Wrap(err, "did not receive valid context outputs from Claude"))
+			return nil, nil, err
+		}
+	}
+
+	var rationale map[string]string
+	if rationaleEnabled(d.in) {
+		resp, rationale, err = splitRationale(resp)
+		if err != nil {
+			// The rationale is informational; don't fail composition over it.
+			log.Debug("Cannot parse rationale", "error", err)
+			response.Warning(d.rsp, errors.Wrap(err, "cannot parse rationale from Claude"))
+		}
 	}
 
-	result := ""
 	dcds, err := ComposedFromYAML(resp)
 	if err != nil {
-		result = err.Error()
-		log.Debug("Submitted YAML stream", "result", result, "isError", true)
+		log.Debug("Submitted YAML stream", "result", err.Error(), "isError", true)
 		response.Fatal(d.rsp, errors.Wrap(err, "did not receive a YAML stream from Claude"))
-		return d.rsp, err
+		return nil, nil, err
 	}
 
 	log.Debug("Received YAML manifests from Claude", "resourceCount", len(dcds))
-	d.rsp.Desired.Resources = dcds
-	return d.rsp, nil
+
+	if err := red.Restore(dcds); err != nil {
+		response.Fatal(d.rsp, err)
+		return nil, nil, err
+	}
+
+	if rationaleEnabled(d.in) {
+		reportRationale(d.rsp, d.in.Rationale, rationale, dcds)
+	}
+	keepSummarized(dcds, d.req.GetObserved().GetResources(), summarized)
+	return dcds, outputs, nil
 }
 
-// OperationVariables used to form the prompt.
-type OperationVariables struct {
-	Input     string `json:"input"`
-	Resources string `json:"resources"`
+// compositionPrompt renders the user prompt of a composition pipeline. The
+// named composed resources are summarized as stubs.
+func compositionPrompt(d pipelineDetails, prompt *template.Template, stubs map[string]bool) (string, resourceFilters, error) {
+	red, err := newRedactor(d.in)
+	if err != nil {
+		return "", resourceFilters{}, err
+	}
+	f := resourceFilters{sanitizer: newSanitizer(d.in), redactor: red, stubs: stubs}
+
+	// TODO(negz): I'm using YAML as input/output because I assume the model
+	// will be better able to represent Kubernetes stuff as YAML manifests
+	// than as e.g. JSON. YAML's much more prevalent in examples etc. Could
+	// be worth validating this - could we use JSON instead to skip extra
+	// conversion?
+	data, err := compositionVariables(d.req, d.in.UserPrompt, d.rr, f)
+	if err != nil {
+		return "", f, errors.Wrap(err, "cannot build prompt variables")
+	}
+	data.Steps = d.steps
+
+	vars := &strings.Builder{}
+	if err := prompt.Execute(vars, data); err != nil {
+		return "", f, errors.Wrapf(err, "cannot build prompt from template")
+	}
+	return vars.String(), f, nil
 }
 
 // operationPipeline processes the given pipelineDetails with the assumption
 // that the function is defined in an operations pipeline.
 func (f *Function) operationPipeline(ctx context.Context, log logging.Logger, d pipelineDetails) (*fnv1.RunFunctionResponse, error) {
-	prompt, err := template.New("prompt").Parse(d.in.UserPrompt)
-	if err != nil {
-		response.Fatal(d.rsp, errors.New("failed to parse UserPrompt as a go-template"))
-		return d.rsp, err
-	}
 	rr, err := request.GetRequiredResources(d.req)
 	if err != nil {
 		response.Fatal(d.rsp, errors.Wrapf(err, "cannot get Function extra resources from %T", d.req))
 		return d.rsp, err
 	}
 
-	// TODO(tnthornton) reference const from c/c instead. Currently too many
-	// conflicting dependencies are pulled in when updating c/c in this repo.
-	rs, ok := rr["ops.crossplane.io/watched-resource"]
+	wobj, ok, err := operationRequirements(log, d, rr)
+	if err != nil {
+		response.Fatal(d.rsp, err)
+		return d.rsp, err
+	}
 	if !ok {
-		f.log.Debug("no resource to process")
-		response.ConditionTrue(d.rsp, "FunctionSuccess", "Success").TargetCompositeAndClaim()
 		return d.rsp, nil
 	}
 
-	if len(rs) != 1 {
-		response.Fatal(d.rsp, errors.New("too many resources sent to the function. expected 1"))
+	lib, err := loadPromptLibrary(d.in.PromptLibraries, rr)
+	if err != nil {
+		response.Fatal(d.rsp, errors.Wrap(err, "cannot load prompt libraries"))
 		return d.rsp, err
 	}
 
-	rb, err := json.MarshalIndent(rs[0].Resource.UnstructuredContent(), "", "    ")
+	release, limited := f.rateLimited(log, d, wobj)
+	if limited {
+		return d.rsp, nil
+	}
+
+	d, resp, red, err := f.operationInvoke(ctx, log, d, lib, rr, wobj)
 	if err != nil {
-		response.Fatal(d.rsp, errors.New("failed to unmarshal required resource"))
+		// Failed runs don't count towards the rate limit.
+		release()
+		response.Fatal(d.rsp, err)
 		return d.rsp, err
 	}
 
-	vars := &strings.Builder{}
-	if err := prompt.Execute(vars, &OperationVariables{Input: d.in.UserPrompt, Resources: string(rb)}); err != nil {
-		response.Fatal(d.rsp, errors.Wrapf(err, "cannot build prompt from template"))
-		return d.rsp, err
+	return d.rsp, f.operationResponse(log, d, rr, wobj, red, resp)
+}
+
+// operationInvoke invokes Claude for the supplied watched resource, running
+// any earlier steps of the input's prompt chain first. It returns the pipeline
+// details, Claude's response, and the redactor used to build the user prompt.
+func (f *Function) operationInvoke(ctx context.Context, log logging.Logger, d pipelineDetails, lib promptLibrary, rr map[string][]resource.Required, watched map[string]any) (pipelineDetails, string, *redactor, error) {
+	d, system, user, red, err := f.operationPrompts(ctx, log, d, lib, rr, watched)
+	if err != nil {
+		return d, "", nil, err
 	}
 
-	log.Debug("Using prompt", "prompt", vars.String())
+	gen, err := generationOption(d.in)
+	if err != nil {
+		return d, "", nil, errors.Wrap(err, "invalid generation parameters")
+	}
 
-	resp, err := f.ai.Invoke(ctx, d.cred, d.in.SystemPrompt, vars.String(), d.in.ModelName)
+	resp, err := f.invoke(ctx, log, d, system, user, false, gen)
+	return d, resp, red, errors.Wrap(err, "failed to run chain")
+}
 
+// operationPrompts runs any earlier steps of the input's prompt chain, and
+// returns the pipeline details, system prompt, and user prompt of the final
+// invocation of Claude, and the redactor used to build the user prompt.
+func (f *Function) operationPrompts(ctx context.Context, log logging.Logger, d pipelineDetails, lib promptLibrary, rr map[string][]resource.Required, watched map[string]any) (pipelineDetails, string, string, *redactor, error) {
+	events := operationEvents(d.in, rr, watched)
+
+	// The final step of a prompt chain replaces the user prompt.
+	d, err := f.runSteps(ctx, log, d, lib, false, func(input string) (*Variables, error) {
+		red, err := newRedactor(d.in)
+		if err != nil {
+			return nil, err
+		}
+		return operationVariables(d.req, input, rr, watched, events, resourceFilters{sanitizer: newSanitizer(d.in), redactor: red})
+	})
 	if err != nil {
-		response.Fatal(d.rsp, errors.Wrap(err, "failed to run chain"))
-		return d.rsp, err
+		return d, "", "", nil, err
+	}
+
+	user, filters, err := operationPrompt(d, lib, rr, watched, events)
+	if err != nil {
+		return d, "", "", nil, err
+	}
+	reportSanitized(d.rsp, log, filters.sanitizer)
+	reportRedacted(d.rsp, log, filters.redactor)
+	log.Debug("Using prompt", "prompt", user)
+
+	system, err := operationSystemPrompt(d.in, lib, watched)
+	if err != nil {
+		return d, "", "", nil, err
+	}
+
+	// Summarizing composed resources doesn't apply to operations, so any
+	// budget strategy fails.
+	if err := checkBudget(d.in.Budget, system, user); err != nil {
+		return d, "", "", nil, err
+	}
+	return d, system, user, filters.redactor, nil
+}
+
+// operationPrompt renders the user prompt of an operation pipeline.
+func operationPrompt(d pipelineDetails, lib promptLibrary, rr map[string][]resource.Required, watched map[string]any, events string) (string, resourceFilters, error) {
+	prompt, err := promptTemplate(d.in, lib)
+	if err != nil {
+		return "", resourceFilters{}, err
+	}
+
+	red, err := newRedactor(d.in)
+	if err != nil {
+		return "", resourceFilters{}, err
+	}
+	f := resourceFilters{sanitizer: newSanitizer(d.in), redactor: red}
+
+	data, err := operationVariables(d.req, d.in.UserPrompt, rr, watched, events, f)
+	if err != nil {
+		return "", f, errors.Wrap(err, "cannot build prompt variables")
 	}
+	data.Steps = d.steps
 
-	desired, cleanResp, err := f.resourceFrom(resp)
+	vars := &strings.Builder{}
+	if err := prompt.Execute(vars, data); err != nil {
+		return "", f, errors.Wrapf(err, "cannot build prompt from template")
+	}
+	return vars.String(), f, nil
+}
+
+// operationSystemPrompt returns the system prompt of an operation pipeline,
+// including the instructions for its report, playbook, and output.
+func operationSystemPrompt(in *v1alpha1.Prompt, lib promptLibrary, watched map[string]any) (string, error) {
+	system, err := lib.systemPrompt(in)
 	if err != nil {
-		// we didn't get a JSON based response from claude
-		log.Debug("failed to get a JSON response back, no desired resources will be sent back to crossplane")
+		return "", errors.Wrap(err, "cannot build system prompt")
+	}
+	instructions, err := operationInstructions(in, watched)
+	if err != nil {
+		return "", err
+	}
+	system += instructions
+	if !outputEnabled(in) {
+		return system, nil
+	}
+	if err := validateOperationOutput(in.Output, watched); err != nil {
+		return "", err
+	}
+	return system + outputInstructions(in.Output), nil
+}
+
+// operationResponse handles Claude's response to an operation pipeline. It
+// reports findings in report mode, and otherwise sets the desired resources
+// in the response unless this is a dry run.
+func (f *Function) operationResponse(log logging.Logger, d pipelineDetails, rr map[string][]resource.Required, watched map[string]any, red *redactor, resp string) error {
+	resp, out, err := operationOutput(d.in, resp)
+	if err != nil {
+		response.Fatal(d.rsp, errors.Wrap(err, "did not receive a valid output from Claude"))
+		return err
+	}
+
+	if reportEnabled(d.in) {
+		return f.reportOperation(log, d, watched, resp, out)
+	}
+
+	desired, cleanResp, err := f.operationResources(log, d, rr, watched, resp)
+	if err != nil {
+		return err
+	}
+
+	if err := red.Restore(desired); err != nil {
+		response.Fatal(d.rsp, err)
+		return err
+	}
+
+	if dryRun(d.req, d.in) {
+		log.Debug("Dry run, no desired resources will be sent back to crossplane", "resourceCount", len(desired))
+		reportDryRun(log, d.rsp, rr, desired)
+		response.ConditionTrue(d.rsp, "FunctionSuccess", "Success").TargetCompositeAndClaim()
+		return nil
 	}
 
 	response.ConditionTrue(d.rsp, "FunctionSuccess", "Success").TargetCompositeAndClaim()
 	// Use cleaned response for event message (markdown stripped, works in both success and error cases)
 	response.Normal(d.rsp, cleanResp)
 
-	d.rsp.Desired.Resources = desired
-	return d.rsp, nil
+	return f.setDesired(d, watched, desired, out)
+}
+
+// operationInstructions returns the instructions added to the system prompt
+// for the input's report or playbook, if any.
+func operationInstructions(in *v1alpha1.Prompt, watched map[string]any) (string, error) {
+	switch {
+	case reportEnabled(in):
+		return reportInstructions, nil
+	case playbookEnabled(in):
+		if watched == nil {
+			return "", errors.New("remediation playbooks require a watched resource")
+		}
+		return playbookInstructions(in.Playbook), nil
+	}
+	return "", nil
+}
+
+// operationResources returns the desired resources in the supplied response,
+// and the response with them removed. If the input configures a playbook the
+// desired resources are the patch of the watched resource produced by the
+// actions Claude chose.
+func (f *Function) operationResources(log logging.Logger, d pipelineDetails, rr map[string][]resource.Required, watched map[string]any, resp string) (map[string]*fnv1.Resource, string, error) {
+	if playbookEnabled(d.in) {
+		desired, clean, err := remediate(d.in.Playbook, resp, watched)
+		if err != nil {
+			response.Fatal(d.rsp, errors.Wrap(err, "refusing remediation from Claude"))
+			return nil, "", err
+		}
+		return desired, clean, nil
+	}
+
+	desired, clean, err := f.resourcesFrom(resp, rr)
+	switch {
+	case errors.Is(err, errNoResources):
+		// we didn't get any resources back from claude
+		log.Debug("no resources in response, no desired resources will be sent back to crossplane", "error", err)
+		response.Warning(d.rsp, errors.New("response from Claude did not contain any resources, no changes will be made"))
+	case err != nil:
+		response.Fatal(d.rsp, errors.Wrap(err, "response from Claude is not actionable"))
+		return nil, "", err
+	}
+	return desired, clean, nil
+}
+
+// operationRequirements returns the watched resource, if any, and true if
+// Crossplane has supplied every resource the operation requires. It sets the
+// requirements of the response, which must be returned on every call or
+// Crossplane will stop supplying the required resources.
+func operationRequirements(log logging.Logger, d pipelineDetails, rr map[string][]resource.Required) (map[string]any, bool, error) {
+	rs, watched := rr[watchedResourceKey]
+	if watched && len(rs) != 1 {
+		return nil, false, errors.Errorf("expected 1 watched resource, got %d", len(rs))
+	}
+
+	var wobj map[string]any
+	if watched {
+		wobj = rs[0].Resource.UnstructuredContent()
+	}
+
+	var err error
+	d.rsp.Requirements, err = requirements(d.in.RequiredResources, map[string]any{"Watched": wobj})
+	if err != nil {
+		return nil, false, errors.Wrap(err, "cannot build required resource selectors")
+	}
+	d.rsp.Requirements = eventsRequirement(d.rsp.Requirements, d.in, wobj)
+	d.rsp.Requirements = libraryRequirements(d.rsp.Requirements, d.in.PromptLibraries)
+
+	if !watched && len(d.in.RequiredResources) == 0 {
+		log.Debug("no resource to process")
+		response.ConditionTrue(d.rsp, "FunctionSuccess", "Success").TargetCompositeAndClaim()
+		return nil, false, nil
+	}
+
+	if !requirementsSatisfied(d.rsp.GetRequirements(), rr) {
+		// Crossplane will call us again with the required resources.
+		log.Debug("Waiting for required resources")
+		return nil, false, nil
+	}
+	return wobj, true, nil
+}
+
+// setDesired sets the supplied desired resources. It adds the supplied output
+// value, and the time Claude was invoked if the rate limit asks for it to be
+// persisted, to the watched resource.
+func (f *Function) setDesired(d pipelineDetails, watched map[string]any, desired map[string]*fnv1.Resource, out any) error {
+	var err error
+	if watched != nil && outputEnabled(d.in) {
+		desired, err = writeOutput(desired, watched, d.in.Output, out, f.now())
+		if err != nil {
+			response.Fatal(d.rsp, errors.Wrap(err, "cannot write output to watched resource"))
+			return err
+		}
+	}
+	if watched != nil && d.in.RateLimit != nil && d.in.RateLimit.PersistCooldown {
+		desired, err = persistLastInvoked(desired, watched, f.now())
+		if err != nil {
+			response.Fatal(d.rsp, errors.Wrap(err, "cannot persist cooldown to watched resource"))
+			return err
+		}
+	}
+	if desired != nil {
+		d.rsp.Desired.Resources = desired
+	}
+	return nil
 }
 
 // shouldIgnore returns true if the caller has communicated that the resource
@@ -455,7 +1121,8 @@ type agent struct {
 
 // Invoke makes an external call to the configured LLM with the supplied
 // credential key, system and user prompts.
-func (a *agent) Invoke(ctx context.Context, key, system, prompt, inputModel string) (string, error) {
+func (a *agent) Invoke(ctx context.Context, key, system, prompt, inputModel string, options ...invokeOption) (string, error) {
+	o := newInvokeOptions(options...)
 	opts := []anthropicllm.Option{
 		anthropicllm.WithToken(key),
 	}
@@ -471,16 +1138,30 @@ func (a *agent) Invoke(ctx context.Context, key, system, prompt, inputModel stri
 	}
 
 	agent := agents.NewOneShotAgent(
-		model,
-		a.tools(ctx),
-		agents.WithMaxIterations(20),
+		&anthropicModel{Model: model, cacheable: o.cacheable, thinkingBudget: o.thinkingBudget, usage: o.usage},
+		append(a.tools(ctx), o.tools...),
 	)
 
+	temperature := o.temperature
+	if o.thinkingBudget > 0 {
+		// The Messages API only supports thinking at temperature 1.
+		temperature = 1
+	}
+	callOpts := []chains.ChainCallOption{
+		chains.WithTemperature(temperature),
+		chains.WithMaxTokens(o.maxTokens),
+	}
+	if len(o.stopSequences) > 0 {
+		// Stop words replace the agent's own, which it needs to use tools.
+		callOpts = append(callOpts, chains.WithStopWords(append([]string{"\nObservation:", "\n\tObservation:"}, o.stopSequences...)))
+	}
+
+	// The executor, not the agent, enforces the maximum iterations.
 	resp, err := chains.Run(
 		ctx,
-		agents.NewExecutor(agent),
+		agents.NewExecutor(agent, agents.WithMaxIterations(o.maxIterations)),
 		fmt.Sprintf("%s\n%s", system, prompt),
-		chains.WithTemperature(float64(0)),
+		callOpts...,
 	)
 
 	// If the agent framework failed to parse the output, try to extract the JSON from the error
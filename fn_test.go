@@ -18,22 +18,210 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/tmc/langchaingo/llms"
 	"google.golang.org/protobuf/testing/protocmp"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/structpb"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 
 	"github.com/crossplane/function-sdk-go/logging"
 	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
 	"github.com/crossplane/function-sdk-go/resource"
 	"github.com/crossplane/function-sdk-go/response"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
 )
 
 func TestRunFunction(t *testing.T) {
+	now := time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	// fingerprint returns the spec fingerprint of the supplied XR and input.
+	fingerprint := func(xr, input *structpb.Struct) string {
+		in := &v1alpha1.Prompt{}
+		_ = resource.AsObject(input, in)
+		lib, _ := loadPromptLibrary(in.PromptLibraries, nil)
+		fp, _ := specFingerprint(&fnv1.Resource{Resource: xr}, in, lib)
+		return fp
+	}
+
+	stableXR := resource.MustStructJSON(`{"spec":{"replicas":3}}`)
+	stableInput := resource.MustStructJSON(`{
+		"apiVersion": "claude.fn.upbound.io/v1alpha1",
+		"kind": "Prompt",
+		"systemPrompt": "I'm a system",
+		"userPrompt": "I'm a user",
+		"stabilization": {
+			"enabled": true,
+			"refreshInterval": "24h"
+		}
+	}`)
+	stableFingerprint := fingerprint(stableXR, stableInput)
+	stableObservedXR := func(composedAt time.Time) *fnv1.Resource {
+		return &fnv1.Resource{Resource: resource.MustStructJSON(fmt.Sprintf(`{
+			"metadata": {
+				"annotations": {
+					"claude.fn.upbound.io/spec-fingerprint": %q,
+					"claude.fn.upbound.io/composed-at": %q
+				}
+			},
+			"spec": {"replicas": 3}
+		}`, stableFingerprint, composedAt.Format(time.RFC3339)))}
+	}
+
+	proposed := map[string]*fnv1.Resource{
+		"deployment": {Resource: resource.MustStructJSON(`{
+			"apiVersion": "apps/v1",
+			"kind": "Deployment",
+			"metadata": {"annotations": {"upbound.io/name": "deployment"}},
+			"spec": {"replicas": 3}
+		}`)},
+	}
+	proposalHash, proposalBlob, _ := encodeProposal(proposal{Resources: proposed})
+	tamperedHash, tamperedBlob, _ := encodeProposal(proposal{Resources: map[string]*fnv1.Resource{
+		"deployment": {Resource: resource.MustStructJSON(`{
+			"apiVersion": "apps/v1",
+			"kind": "Deployment",
+			"metadata": {"annotations": {"upbound.io/name": "deployment"}},
+			"spec": {"replicas": 100}
+		}`)},
+	}})
+	approvalInput := resource.MustStructJSON(`{
+		"apiVersion": "claude.fn.upbound.io/v1alpha1",
+		"kind": "Prompt",
+		"systemPrompt": "I'm a system",
+		"userPrompt": "I'm a user",
+		"approval": {
+			"enabled": true
+		}
+	}`)
+	approvalFingerprint := fingerprint(stableXR, approvalInput)
+
+	contextOutputsInput := resource.MustStructJSON(`{
+		"apiVersion": "claude.fn.upbound.io/v1alpha1",
+		"kind": "Prompt",
+		"systemPrompt": "I'm a system",
+		"userPrompt": "I'm a user",
+		"contextOutputs": {
+			"key": "example.org/claude",
+			"values": [{
+				"name": "tier",
+				"description": "The chosen tier.",
+				"schema": {"type": "string", "enum": ["small", "large"]}
+			}]
+		}
+	}`)
+
+	contextOutputs := structpb.NewStructValue(resource.MustStructJSON(`{"tier": "small"}`))
+	stableContextOutputsInput := resource.MustStructJSON(`{
+		"apiVersion": "claude.fn.upbound.io/v1alpha1",
+		"kind": "Prompt",
+		"systemPrompt": "I'm a system",
+		"userPrompt": "I'm a user",
+		"stabilization": {"enabled": true},
+		"contextOutputs": {
+			"key": "example.org/claude",
+			"values": [{"name": "tier"}]
+		}
+	}`)
+	stableContextOutputsFingerprint := fingerprint(stableXR, stableContextOutputsInput)
+	approvalContextOutputsInput := resource.MustStructJSON(`{
+		"apiVersion": "claude.fn.upbound.io/v1alpha1",
+		"kind": "Prompt",
+		"systemPrompt": "I'm a system",
+		"userPrompt": "I'm a user",
+		"approval": {"enabled": true},
+		"contextOutputs": {
+			"key": "example.org/claude",
+			"values": [{"name": "tier"}]
+		}
+	}`)
+	approvalContextOutputsFingerprint := fingerprint(stableXR, approvalContextOutputsInput)
+	contextProposalHash, contextProposalBlob, _ := encodeProposal(proposal{Resources: proposed, ContextOutputs: contextOutputs})
+
+	requiredInput := resource.MustStructJSON(`{
+		"apiVersion": "claude.fn.upbound.io/v1alpha1",
+		"kind": "Prompt",
+		"systemPrompt": "I'm a system",
+		"userPrompt": "{{ .Required.pods }}",
+		"requiredResources": [{
+			"name": "pods",
+			"apiVersion": "v1",
+			"kind": "Pod",
+			"namespace": "{{ .Watched.metadata.namespace }}",
+			"matchLabels": {"app": "{{ .Watched.metadata.name }}"}
+		}]
+	}`)
+	watchedEvents := &fnv1.ResourceSelector{
+		ApiVersion: "v1",
+		Kind:       "Event",
+		Namespace:  ptr("default"),
+		Match:      &fnv1.ResourceSelector_MatchLabels{MatchLabels: &fnv1.MatchLabels{}},
+	}
+	requiredRequirements := &fnv1.Requirements{Resources: map[string]*fnv1.ResourceSelector{
+		"pods": {
+			ApiVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  ptr("default"),
+			Match:      &fnv1.ResourceSelector_MatchLabels{MatchLabels: &fnv1.MatchLabels{Labels: map[string]string{"app": "my-app"}}},
+		},
+		"claude.fn.upbound.io/events": watchedEvents,
+	}}
+	eventsRequirements := &fnv1.Requirements{Resources: map[string]*fnv1.ResourceSelector{
+		"claude.fn.upbound.io/events": watchedEvents,
+	}}
+	watchedDeployment := &fnv1.Resources{Items: []*fnv1.Resource{{
+		Resource: resource.MustStructJSON(`{
+			"apiVersion": "apps/v1",
+			"kind": "Deployment",
+			"metadata": {"name": "my-app", "namespace": "default"}
+		}`),
+	}}}
+
+	playbookInput := `{
+		"apiVersion": "claude.fn.upbound.io/v1alpha1",
+		"kind": "Prompt",
+		"systemPrompt": "I'm a system",
+		"userPrompt": "I'm a user",
+		"playbook": {
+			"actions": [
+				{
+					"name": "scale",
+					"description": "Scale the Deployment.",
+					"parameters": {
+						"type": "object",
+						"required": ["replicas"],
+						"properties": {"replicas": {"type": "integer", "minimum": 1, "maximum": 10}}
+					},
+					"patch": "spec:\n  replicas: {{ .Params.replicas }}"
+				},
+				{
+					"name": "annotate",
+					"parameters": {
+						"type": "object",
+						"required": ["reason"],
+						"properties": {"reason": {"type": "string"}}
+					},
+					"patch": "metadata:\n  annotations:\n    example.org/remediated: {{ .Params.reason }}"
+				},
+				{
+					"name": "pause",
+					"patch": "spec:\n  paused: true"
+				}
+			]
+		}
+	}`
 
 	type args struct {
 		ctx context.Context
@@ -87,6 +275,193 @@ func TestRunFunction(t *testing.T) {
 				},
 			},
 		},
+		"PausedComposite": {
+			reason: "We should skip a paused XR, keeping its observed composed resources.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "", errors.New("should not be invoked")
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user"
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{
+							"apiVersion": "example.org/v1",
+							"kind": "XApp",
+							"metadata": {
+								"name": "my-xr",
+								"annotations": {
+									"claude.fn.upbound.io/paused": "true",
+									"claude.fn.upbound.io/composed-at": "2025-10-01T11:00:00Z"
+								}
+							}
+						}`)},
+						Resources: map[string]*fnv1.Resource{
+							"bucket": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "s3.aws.upbound.io/v1beta1",
+								"kind": "Bucket",
+								"metadata": {"name": "my-bucket", "uid": "bucket-uid"},
+								"status": {"atProvider": {"arn": "arn"}}
+							}`)},
+						},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{
+							"metadata": {
+								"annotations": {"claude.fn.upbound.io/composed-at": "2025-10-01T11:00:00Z"}
+							}
+						}`)},
+						Resources: map[string]*fnv1.Resource{
+							"bucket": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "s3.aws.upbound.io/v1beta1",
+								"kind": "Bucket",
+								"metadata": {"name": "my-bucket"}
+							}`)},
+						},
+					},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_NORMAL,
+						Message:  "skipping, XApp.example.org/my-xr is paused by the claude.fn.upbound.io/paused annotation",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+					Conditions: []*fnv1.Condition{{
+						Type:   "FunctionSuccess",
+						Status: fnv1.Status_STATUS_CONDITION_TRUE,
+						Reason: "Success",
+						Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+					}},
+				},
+			},
+		},
+		"PausedCompositeContextOutputs": {
+			reason: "We should write the context outputs recorded on a paused XR again, so later functions still see them.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "", errors.New("should not be invoked")
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"userPrompt": "I'm a user",
+						"contextOutputs": {
+							"key": "example.org/claude",
+							"values": [{"name": "tier"}]
+						}
+					}`),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{
+							"apiVersion": "example.org/v1",
+							"kind": "XApp",
+							"metadata": {
+								"name": "my-xr",
+								"annotations": {
+									"claude.fn.upbound.io/paused": "true",
+									"claude.fn.upbound.io/context-outputs": "{\"tier\":\"small\"}"
+								}
+							}
+						}`)},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{
+						"example.org/claude": {"tier": "small"}
+					}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{
+							"metadata": {
+								"annotations": {"claude.fn.upbound.io/context-outputs": "{\"tier\":\"small\"}"}
+							}
+						}`)},
+					},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_NORMAL,
+						Message:  "skipping, XApp.example.org/my-xr is paused by the claude.fn.upbound.io/paused annotation",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+					Conditions: []*fnv1.Condition{{
+						Type:   "FunctionSuccess",
+						Status: fnv1.Status_STATUS_CONDITION_TRUE,
+						Reason: "Success",
+						Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+					}},
+				},
+			},
+		},
+		"SkipRuleMatched": {
+			reason: "We should skip a watched resource that matches a skip rule, and report the rule.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "", errors.New("should not be invoked")
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user",
+						"skip": {
+							"rules": [
+								{"name": "system", "namespaces": ["kube-system"]},
+								{
+									"name": "frozen",
+									"selector": {"matchLabels": {"team": "web"}},
+									"expression": "has(object.spec) && object.spec.replicas > 2"
+								}
+							]
+						}
+					}`),
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"ops.crossplane.io/watched-resource": {Items: []*fnv1.Resource{{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "apps/v1",
+								"kind": "Deployment",
+								"metadata": {"name": "my-app", "namespace": "default", "labels": {"team": "web"}},
+								"spec": {"replicas": 3}
+							}`),
+						}}},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_NORMAL,
+						Message:  "skipping, Deployment.apps/default/my-app matched skip rule \"frozen\"",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+					Conditions: []*fnv1.Condition{{
+						Type:   "FunctionSuccess",
+						Status: fnv1.Status_STATUS_CONDITION_TRUE,
+						Reason: "Success",
+						Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+					}},
+				},
+			},
+		},
 		"ResponseIsReturned": {
 			reason: "The Function should return a fatal result if credential cannot be found.",
 			args: args{
@@ -196,12 +571,15 @@ metadata:
 				},
 			},
 		},
-		"SimpleOperationPipeline": {
-			reason: "We should go through the operation pipeline without error.",
+		"CompositionPipelineTemplateVariables": {
+			reason: "We should expose parsed resources, the pipeline context, request metadata, and desired state to composition templates.",
 			args: args{
 				ai: &mockAgentInvoker{
-					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
-						return `some-response`, nil
+					InvokeFn: func(_ context.Context, _, _, prompt, _ string) (string, error) {
+						if want := "hello [claude] us-east-1 prod bucket=Bucket {\n    \"spec\": {\n        \"region\": \"us-east-1\"\n    }\n}"; prompt != want {
+							return "", fmt.Errorf("want prompt %q, got %q", want, prompt)
+						}
+						return "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  annotations:\n    upbound.io/name: configmap\n", nil
 					},
 				},
 				req: &fnv1.RunFunctionRequest{
@@ -210,384 +588,4371 @@ metadata:
 						"apiVersion": "claude.fn.upbound.io/v1alpha1",
 						"kind": "Prompt",
 						"systemPrompt": "I'm a system",
-						"userPrompt": "I'm a user"
+						"userPrompt": "{{ .Meta.Tag }} {{ .Meta.Credentials }} {{ .Composite.Object.spec.region }} {{ .Context.env }} {{ range $name, $r := .Desired.Resources }}{{ $name }}={{ $r.Object.kind }}{{ end }} {{ .Composite.JSON }}"
 					}`),
+					Context:     resource.MustStructJSON(`{"env": "prod"}`),
 					Credentials: mockCredentials(),
-					RequiredResources: map[string]*fnv1.Resources{
-						"ops.crossplane.io/watched-resource": {
-							Items: []*fnv1.Resource{
-								{
-									Resource: &structpb.Struct{},
-								},
-							},
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{"spec": {"region": "us-east-1"}}`)},
+					},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"bucket": {Resource: resource.MustStructJSON(`{"apiVersion": "s3.aws.upbound.io/v1beta1", "kind": "Bucket"}`)},
 						},
 					},
-					Desired: &fnv1.State{},
 				},
 			},
 			want: want{
 				rsp: &fnv1.RunFunctionResponse{
-					Meta: &fnv1.ResponseMeta{
-						Tag: "hello",
-						Ttl: &durationpb.Duration{
-							Seconds: 60,
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{"env": "prod"}`),
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"configmap": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1",
+								"kind": "ConfigMap",
+								"metadata": {"annotations": {"upbound.io/name": "configmap"}}
+							}`)},
 						},
 					},
-					Results: []*fnv1.Result{{
-						Severity: fnv1.Severity_SEVERITY_NORMAL,
-						Message:  "some-response",
-						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
-					}},
-					Conditions: []*fnv1.Condition{{
-						Type:   "FunctionSuccess",
-						Status: fnv1.Status_STATUS_CONDITION_TRUE,
-						Reason: "Success",
-						Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
-					}},
-					Desired: &fnv1.State{},
 				},
 			},
 		},
-	}
-
-	for name, tc := range cases {
-		t.Run(name, func(t *testing.T) {
-			f := &Function{log: logging.NewNopLogger(), ai: tc.args.ai}
-			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
-
-			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
-				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
-			}
-
-			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
-				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
-			}
-		})
-	}
-}
-
-func mockCredentials() map[string]*fnv1.Credentials {
-	return map[string]*fnv1.Credentials{
-		credName: {
-			Source: &fnv1.Credentials_CredentialData{
-				CredentialData: &fnv1.CredentialData{
-					Data: map[string][]byte{
-						credKey: []byte("data"),
+		"CompositionPipelineSanitize": {
+			reason: "We should sanitize observed resources before supplying them to the prompt template, and report how much we stripped.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, prompt, _ string) (string, error) {
+						for _, noise := range []string{"uid", "managedFields", "status", "notes"} {
+							if strings.Contains(prompt, noise) {
+								return "", fmt.Errorf("prompt %q contains %q", prompt, noise)
+							}
+						}
+						if !strings.Contains(prompt, "us-east-1") {
+							return "", fmt.Errorf("prompt %q is missing spec.region", prompt)
+						}
+						return "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  annotations:\n    upbound.io/name: configmap\n", nil
 					},
 				},
-			},
-		},
-	}
-}
-
-func TestResourceFrom(t *testing.T) {
-	type args struct {
-		resp string
-	}
-	type want struct {
-		resource map[string]*fnv1.Resource
-		cleaned  string
-		err      error
-	}
-
-	cases := map[string]struct {
-		reason string
-		args   args
-		want   want
-	}{
-		"String": {
-			reason: "We should return an error if we received a string that is neither JSON nor YAML",
-			args: args{
-				resp: "some-response",
-			},
-			want: want{
-				err: cmpopts.AnyError,
-			},
-		},
-		"ValidJSON": {
-			reason: "We should not return an error if we processed valid JSON",
-			args: args{
-				resp: `{}`,
-			},
-			want: want{
-				resource: map[string]*fnv1.Resource{
-					"": {Resource: &structpb.Struct{}},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "{{ .Composite.JSON }}",
+						"sanitize": {
+							"enabled": true,
+							"rules": [{"apiVersion": "example.org/v1", "kind": "XApp", "exclude": ["spec.notes"]}]
+						}
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{
+							"apiVersion": "example.org/v1",
+							"kind": "XApp",
+							"metadata": {"name": "my-xr", "uid": "1234", "managedFields": [{"manager": "crossplane"}]},
+							"spec": {"region": "us-east-1", "notes": "lorem ipsum"},
+							"status": {"ready": true}
+						}`)},
+					},
+					Desired: &fnv1.State{},
 				},
 			},
-		},
-		"ValidYAML": {
-			reason: "We should not return an error if we processed valid YAML",
-			args: args{
-				resp: `a: b`,
-			},
 			want: want{
-				resource: map[string]*fnv1.Resource{
-					"": {Resource: &structpb.Struct{Fields: map[string]*structpb.Value{"a": structpb.NewStringValue("b")}}},
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_NORMAL,
+						Message:  "sanitized 1 resources, stripping about 25 tokens",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"configmap": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1",
+								"kind": "ConfigMap",
+								"metadata": {"annotations": {"upbound.io/name": "configmap"}}
+							}`)},
+						},
+					},
 				},
 			},
 		},
-		"InvalidJSON": {
-			reason: "We should return an error if we attempt to process invalid JSON",
-			args: args{
-				resp: `{a: `,
-			},
-			want: want{
-				err: cmpopts.AnyError,
-			},
-		},
-		"InvalidYAML": {
-			reason: "We should return an error if we attempt to process invalid YAML",
+		"CompositionPipelineRedactsSecrets": {
+			reason: "We should replace sensitive values with placeholders in the prompt, and restore them in the resources Claude returns.",
 			args: args{
-				resp: ``,
-			},
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, prompt, _ string) (string, error) {
+						if strings.Contains(prompt, "aHVudGVyMg==") || strings.Contains(prompt, "s3cr3t") {
+							return "", fmt.Errorf("prompt %q contains a sensitive value", prompt)
+						}
+						phs := regexp.MustCompile(`REDACTED_[0-9A-F]{12}`).FindAllString(prompt, -1)
+						if len(phs) != 2 {
+							return "", fmt.Errorf("want 2 placeholders in prompt %q, got %d", prompt, len(phs))
+						}
+						return fmt.Sprintf("---\napiVersion: v1\nkind: Secret\nmetadata:\n  annotations:\n    upbound.io/name: secret\ndata:\n  password: %s\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  annotations:\n    upbound.io/name: configmap\ndata:\n  apiToken: %s\n", phs[0], phs[1]), nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "{{ (getResource .Composed \"secret\").Object.data.password }} {{ (getResource .Composed \"configmap\").Object.data.apiToken }}"
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+						Resources: map[string]*fnv1.Resource{
+							"secret": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1",
+								"kind": "Secret",
+								"metadata": {"name": "db"},
+								"data": {"password": "aHVudGVyMg=="}
+							}`)},
+							"configmap": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1",
+								"kind": "ConfigMap",
+								"metadata": {"name": "app"},
+								"data": {"apiToken": "s3cr3t"}
+							}`)},
+						},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
 			want: want{
-				err: cmpopts.AnyError,
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_NORMAL,
+						Message:  "redacted 2 sensitive values",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"secret": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1",
+								"kind": "Secret",
+								"metadata": {"annotations": {"upbound.io/name": "secret"}},
+								"data": {"password": "aHVudGVyMg=="}
+							}`)},
+							"configmap": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1",
+								"kind": "ConfigMap",
+								"metadata": {"annotations": {"upbound.io/name": "configmap"}},
+								"data": {"apiToken": "s3cr3t"}
+							}`)},
+						},
+					},
+				},
 			},
 		},
-		"JSONWithMarkdownCodeBlock": {
-			reason: "We should strip markdown code blocks and process the JSON",
+		"CompositionPipelinePromptLibrary": {
+			reason: "We should load the system prompt and included fragments from built in and ConfigMap prompt libraries.",
 			args: args{
-				resp: "```json\n{\"metadata\": {\"name\": \"test\"}}\n```",
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, system, prompt, _ string) (string, error) {
+						if !strings.HasPrefix(system, "You are a Kubernetes templating tool") || !strings.HasSuffix(system, "resources.\n\nBe concise.") {
+							return "", fmt.Errorf("unexpected system prompt %q", system)
+						}
+						if want := "Request hello. Compose a bucket."; prompt != want {
+							return "", fmt.Errorf("want prompt %q, got %q", want, prompt)
+						}
+						return "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  annotations:\n    upbound.io/name: configmap\n", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPromptRef": {"name": "krm-system-v1"},
+						"systemPrompt": "Be concise.",
+						"userPrompt": "{{ include \"intro-v1\" . }} Compose a bucket.",
+						"promptLibraries": [{"name": "team-prompts"}]
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+					},
+					RequiredResources: map[string]*fnv1.Resources{
+						"claude.fn.upbound.io/prompt-library/team-prompts": {Items: []*fnv1.Resource{{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1",
+								"kind": "ConfigMap",
+								"metadata": {"name": "team-prompts", "namespace": "crossplane-system"},
+								"data": {"intro-v1": "Request {{ .Meta.Tag }}."}
+							}`),
+						}}},
+					},
+					Desired: &fnv1.State{},
+				},
 			},
 			want: want{
-				resource: map[string]*fnv1.Resource{
-					"test": {
-						Resource: &structpb.Struct{
-							Fields: map[string]*structpb.Value{
-								"metadata": {
-									Kind: &structpb.Value_StructValue{
-										StructValue: &structpb.Struct{
-											Fields: map[string]*structpb.Value{
-												"name": structpb.NewStringValue("test"),
-											},
-										},
-									},
-								},
-							},
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Requirements: &fnv1.Requirements{Resources: map[string]*fnv1.ResourceSelector{
+						"claude.fn.upbound.io/prompt-library/team-prompts": {
+							ApiVersion: "v1",
+							Kind:       "ConfigMap",
+							Namespace:  ptr("crossplane-system"),
+							Match:      &fnv1.ResourceSelector_MatchName{MatchName: "team-prompts"},
+						},
+					}},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"configmap": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1",
+								"kind": "ConfigMap",
+								"metadata": {"annotations": {"upbound.io/name": "configmap"}}
+							}`)},
 						},
 					},
 				},
-				cleaned: "{\"metadata\": {\"name\": \"test\"}}",
 			},
 		},
-		"YAMLWithMarkdownCodeBlock": {
-			reason: "We should strip markdown code blocks and process the YAML",
+		"CompositionPipelinePreset": {
+			reason: "We should wrap the user prompt in the preset's prompts, appending it as the task.",
 			args: args{
-				resp: "```yaml\nmetadata:\n  name: test\n```",
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, system, prompt, _ string) (string, error) {
+						if !strings.HasPrefix(system, "You are a Kubernetes templating tool") || !strings.HasSuffix(system, "\n\nBe concise.") {
+							return "", fmt.Errorf("unexpected system prompt %q", system)
+						}
+						if !strings.Contains(prompt, `"upbound.io/name"`) {
+							return "", fmt.Errorf("prompt %q does not contain the preset's rules", prompt)
+						}
+						if !strings.Contains(prompt, "<composite>\nspec:\n  region: us-east-1\n\n</composite>") {
+							return "", fmt.Errorf("prompt %q does not contain the composite", prompt)
+						}
+						if !strings.HasSuffix(prompt, "<task>\nCompose a bucket in us-east-1.\n</task>\n") {
+							return "", fmt.Errorf("prompt %q does not end with the task", prompt)
+						}
+						return "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  annotations:\n    upbound.io/name: configmap\n", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"preset": "krm-compose/v1",
+						"systemPrompt": "Be concise.",
+						"userPrompt": "Compose a bucket in {{ .Composite.Object.spec.region }}."
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{"spec": {"region": "us-east-1"}}`)},
+					},
+					Desired: &fnv1.State{},
+				},
 			},
 			want: want{
-				resource: map[string]*fnv1.Resource{
-					"test": {
-						Resource: &structpb.Struct{
-							Fields: map[string]*structpb.Value{
-								"metadata": {
-									Kind: &structpb.Value_StructValue{
-										StructValue: &structpb.Struct{
-											Fields: map[string]*structpb.Value{
-												"name": structpb.NewStringValue("test"),
-											},
-										},
-									},
-								},
-							},
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"configmap": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1",
+								"kind": "ConfigMap",
+								"metadata": {"annotations": {"upbound.io/name": "configmap"}}
+							}`)},
 						},
 					},
 				},
-				cleaned: "metadata:\n  name: test",
 			},
 		},
-		"GenericMarkdownCodeBlock": {
-			reason: "We should strip generic markdown code blocks",
+		"CompositionPipelineUnknownPreset": {
+			reason: "We should return a fatal result if the preset doesn't exist.",
 			args: args{
-				resp: "```\n{\"metadata\": {\"name\": \"test\"}}\n```",
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"preset": "krm-compose/v99",
+						"userPrompt": "Compose a bucket."
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+					},
+					Desired: &fnv1.State{},
+				},
 			},
 			want: want{
-				resource: map[string]*fnv1.Resource{
-					"test": {
-						Resource: &structpb.Struct{
-							Fields: map[string]*structpb.Value{
-								"metadata": {
-									Kind: &structpb.Value_StructValue{
-										StructValue: &structpb.Struct{
-											Fields: map[string]*structpb.Value{
-												"name": structpb.NewStringValue("test"),
-											},
-										},
-									},
-								},
-							},
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_FATAL,
+						Message:  `unknown preset "krm-compose/v99"`,
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+				},
+				err: cmpopts.AnyError,
+			},
+		},
+		"CompositionPipelineOperationPreset": {
+			reason: "We should return a fatal result if the preset is written for operation pipelines.",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"preset": "krm-operate/v1",
+						"userPrompt": "Compose a bucket."
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_FATAL,
+						Message:  `preset "krm-operate/v1" can only be used in operation pipelines`,
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+				},
+			},
+		},
+		"OperationPipelineCompositionPreset": {
+			reason: "We should return a fatal result if the preset is written for composition pipelines.",
+			args: args{
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"preset": "krm-compose/v1",
+						"userPrompt": "Scale the deployment."
+					}`),
+					Credentials: mockCredentials(),
+					Desired:     &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_FATAL,
+						Message:  `preset "krm-compose/v1" can only be used in composition pipelines`,
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+				},
+			},
+		},
+		"CompositionPipelineBudgetExceeded": {
+			reason: "We should return a fatal result without invoking Claude if the prompt exceeds its budget.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "", errors.New("should not be invoked")
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user",
+						"budget": {"maxTokens": 5}
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_FATAL,
+						Message:  "prompt is about 6 tokens, exceeding the budget of 5 tokens",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+				},
+				err: cmpopts.AnyError,
+			},
+		},
+		"CompositionPipelineBudgetSummarize": {
+			reason: "We should summarize ready composed resources until the prompt fits its budget, and keep summarized resources Claude doesn't return.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, system, prompt, _ string) (string, error) {
+						if strings.Contains(prompt, "lorem") {
+							return "", fmt.Errorf("prompt %q contains the summarized bucket", prompt)
+						}
+						if !strings.Contains(system, "summarized as\nstubs containing only their apiVersion, kind, and name: bucket.") {
+							return "", fmt.Errorf("system prompt %q doesn't list summarized resources", system)
+						}
+						return "---\napiVersion: example.org/v1\nkind: Table\nmetadata:\n  annotations:\n    upbound.io/name: table\nspec:\n  size: 2\n", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "{{ .Composed }}",
+						"budget": {"maxTokens": 200, "strategy": "Summarize"}
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+						Resources: map[string]*fnv1.Resource{
+							"bucket": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "Bucket",
+								"metadata": {"name": "bucket", "uid": "1234"},
+								"spec": {"notes": "` + strings.Repeat("lorem ipsum ", 100) + `"},
+								"status": {"conditions": [{"type": "Ready", "status": "True"}]}
+							}`)},
+							"table": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "Table",
+								"metadata": {"name": "table"},
+								"spec": {"size": 1}
+							}`)},
+						},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_NORMAL,
+						Message:  "summarized 1 composed resources to fit the prompt budget of 200 tokens",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"bucket": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "Bucket",
+								"metadata": {"name": "bucket"},
+								"spec": {"notes": "` + strings.Repeat("lorem ipsum ", 100) + `"}
+							}`)},
+							"table": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "Table",
+								"metadata": {"annotations": {"upbound.io/name": "table"}},
+								"spec": {"size": 2}
+							}`)},
 						},
 					},
 				},
-				cleaned: "{\"metadata\": {\"name\": \"test\"}}",
 			},
 		},
-		"MarkdownWithWhitespace": {
-			reason: "We should strip markdown and trim whitespace",
+		"CompositionPipelineBudgetRetrieve": {
+			reason: "We should summarize all composed resources and let Claude retrieve them with a tool.",
 			args: args{
-				resp: "  \n```json\n{\"metadata\": {\"name\": \"test\"}}\n```\n  ",
+				ai: &mockAgentInvoker{
+					InvokeWithOptionsFn: func(ctx context.Context, _, _, prompt, _ string, o invokeOptions) (string, error) {
+						if strings.Contains(prompt, "lorem") {
+							return "", fmt.Errorf("prompt %q contains the summarized bucket", prompt)
+						}
+						if len(o.tools) != 1 || o.tools[0].Name() != "get_composed_resource" {
+							return "", fmt.Errorf("want the retrieval tool, got %v", o.tools)
+						}
+						y, err := o.tools[0].Call(ctx, "bucket")
+						if err != nil {
+							return "", err
+						}
+						if !strings.Contains(y, "lorem") || strings.Contains(y, "uid") {
+							return "", fmt.Errorf("tool returned unexpected bucket %q", y)
+						}
+						return "---\napiVersion: example.org/v1\nkind: Bucket\nmetadata:\n  annotations:\n    upbound.io/name: bucket\nspec:\n  notes: short\n", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "{{ .Composed }}",
+						"sanitize": {"enabled": true},
+						"budget": {"maxTokens": 300, "strategy": "Retrieve"}
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+						Resources: map[string]*fnv1.Resource{
+							"bucket": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "Bucket",
+								"metadata": {"name": "bucket", "uid": "1234"},
+								"spec": {"notes": "` + strings.Repeat("lorem ipsum ", 100) + `"}
+							}`)},
+							"table": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "Table",
+								"metadata": {"name": "table"},
+								"spec": {"size": 1}
+							}`)},
+						},
+					},
+					Desired: &fnv1.State{},
+				},
 			},
 			want: want{
-				resource: map[string]*fnv1.Resource{
-					"test": {
-						Resource: &structpb.Struct{
-							Fields: map[string]*structpb.Value{
-								"metadata": {
-									Kind: &structpb.Value_StructValue{
-										StructValue: &structpb.Struct{
-											Fields: map[string]*structpb.Value{
-												"name": structpb.NewStringValue("test"),
-											},
-										},
-									},
-								},
-							},
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "summarized 2 composed resources to fit the prompt budget of 300 tokens",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "sanitized 3 resources, stripping about 0 tokens",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"bucket": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "Bucket",
+								"metadata": {"annotations": {"upbound.io/name": "bucket"}},
+								"spec": {"notes": "short"}
+							}`)},
+							"table": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "example.org/v1",
+								"kind": "Table",
+								"metadata": {"name": "table"},
+								"spec": {"size": 1}
+							}`)},
 						},
 					},
 				},
-				cleaned: "{\"metadata\": {\"name\": \"test\"}}",
 			},
 		},
+		"CompositionPipelineGenerationDefaults": {
+			reason: "We should invoke Claude with default generation parameters if none are configured.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeWithOptionsFn: func(_ context.Context, _, _, _, _ string, o invokeOptions) (string, error) {
+						want := invokeOptions{temperature: 0, maxTokens: 8192, maxIterations: 20}
+						if diff := cmp.Diff(want, o, cmp.AllowUnexported(invokeOptions{}), cmpopts.IgnoreFields(invokeOptions{}, "usage")); diff != "" {
+							return "", fmt.Errorf("invoke options: -want, +got:\n%s", diff)
+						}
+						return "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  annotations:\n    upbound.io/name: configmap\n", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user"
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"configmap": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1",
+								"kind": "ConfigMap",
+								"metadata": {"annotations": {"upbound.io/name": "configmap"}}
+							}`)},
+						},
+					},
+				},
+			},
+		},
+		"CompositionPipelineGenerationParameters": {
+			reason: "We should invoke Claude with the configured generation parameters.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeWithOptionsFn: func(_ context.Context, _, _, _, _ string, o invokeOptions) (string, error) {
+						want := invokeOptions{temperature: 0.7, maxTokens: 16000, maxIterations: 3, stopSequences: []string{"</yaml>"}}
+						if diff := cmp.Diff(want, o, cmp.AllowUnexported(invokeOptions{}), cmpopts.IgnoreFields(invokeOptions{}, "usage")); diff != "" {
+							return "", fmt.Errorf("invoke options: -want, +got:\n%s", diff)
+						}
+						return "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  annotations:\n    upbound.io/name: configmap\n", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user",
+						"temperature": "0.7",
+						"maxTokens": 16000,
+						"maxIterations": 3,
+						"stopSequences": ["</yaml>"]
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"configmap": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1",
+								"kind": "ConfigMap",
+								"metadata": {"annotations": {"upbound.io/name": "configmap"}}
+							}`)},
+						},
+					},
+				},
+			},
+		},
+		"CompositionPipelineInvalidGenerationParameters": {
+			reason: "We should return a fatal result without invoking Claude if a generation parameter is out of bounds.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeWithOptionsFn: func(_ context.Context, _, _, _, _ string, o invokeOptions) (string, error) {
+						return "", errors.New("should not be invoked")
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user",
+						"temperature": "1.5"
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_FATAL,
+						Message:  "invalid generation parameters: temperature must be between 0 and 1, got 1.5",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+				},
+				err: cmpopts.AnyError,
+			},
+		},
+		"CompositionPipelinePromptCachingAndThinking": {
+			reason: "We should mark the system prompt and the user prompt up to each cache breakpoint as cacheable, report cache usage, and never parse thinking as output.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeWithOptionsFn: func(_ context.Context, _, _, prompt, _ string, o invokeOptions) (string, error) {
+						if prompt != "Static instructions. Dynamic state." {
+							return "", fmt.Errorf("unexpected prompt %q", prompt)
+						}
+						want := invokeOptions{
+							temperature:    0,
+							maxTokens:      8192,
+							maxIterations:  20,
+							cacheable:      []string{"I'm a system", "Static instructions. "},
+							thinkingBudget: 2048,
+						}
+						if diff := cmp.Diff(want, o, cmp.AllowUnexported(invokeOptions{}), cmpopts.IgnoreFields(invokeOptions{}, "usage")); diff != "" {
+							return "", fmt.Errorf("invoke options: -want, +got:\n%s", diff)
+						}
+						o.usage.CacheReadInputTokens = 1200
+						o.usage.CacheCreationInputTokens = 30
+						return "<thinking>\nkind: Secret\n</thinking>\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  annotations:\n    upbound.io/name: configmap\n", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "Static instructions. {{ cacheBreakpoint }}Dynamic state.",
+						"promptCaching": {"enabled": true},
+						"thinking": {"budgetTokens": 2048}
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"configmap": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1",
+								"kind": "ConfigMap",
+								"metadata": {"annotations": {"upbound.io/name": "configmap"}}
+							}`)},
+						},
+					},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_NORMAL,
+						Message:  "prompt cache read 1200 tokens and wrote 30 tokens",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+				},
+			},
+		},
+		"CompositionPipelineInvalidThinkingBudget": {
+			reason: "We should return a fatal result without invoking Claude if the thinking budget isn't less than maxTokens.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeWithOptionsFn: func(_ context.Context, _, _, _, _ string, o invokeOptions) (string, error) {
+						return "", errors.New("should not be invoked")
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user",
+						"maxTokens": 4096,
+						"thinking": {"budgetTokens": 4096}
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_FATAL,
+						Message:  "invalid generation parameters: thinking budgetTokens must be at least 1024 and less than maxTokens (4096), got 4096",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+				},
+				err: cmpopts.AnyError,
+			},
+		},
+		"CompositionPipelineSteps": {
+			reason: "We should run each step of a prompt chain in order, supply earlier outputs to later steps, and only parse the final step's output.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, system, prompt, model string) (string, error) {
+						switch {
+						case system == "You plan." && prompt == "Plan for bucket-xr." && model == "claude-haiku-4-5":
+							return "  A ConfigMap named configmap.\n", nil
+						case system == "You generate." && prompt == "Generate: A ConfigMap named configmap." && model == "":
+							return "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  annotations:\n    upbound.io/name: configmap\n", nil
+						}
+						return "", fmt.Errorf("unexpected invocation: system %q, prompt %q, model %q", system, prompt, model)
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"steps": [
+							{
+								"name": "plan",
+								"systemPrompt": "You plan.",
+								"userPrompt": "Plan for {{ .Composite.Object.metadata.name }}.",
+								"modelName": "claude-haiku-4-5"
+							},
+							{
+								"name": "generate",
+								"systemPrompt": "You generate.",
+								"userPrompt": "Generate: {{ .Steps.plan.Output }}"
+							}
+						]
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{"metadata": {"name": "bucket-xr"}}`)},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"configmap": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1",
+								"kind": "ConfigMap",
+								"metadata": {"annotations": {"upbound.io/name": "configmap"}}
+							}`)},
+						},
+					},
+				},
+			},
+		},
+		"CompositionPipelineStepsAndUserPrompt": {
+			reason: "We should return a fatal result without invoking Claude if both a user prompt and steps are specified.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "", errors.New("should not be invoked")
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"userPrompt": "I'm a user",
+						"steps": [{"name": "generate", "userPrompt": "I'm a step"}]
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_FATAL,
+						Message:  "userPrompt and steps are mutually exclusive",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+				},
+				err: cmpopts.AnyError,
+			},
+		},
+		"CompositionPipelineStepsInheritSystemPrompt": {
+			reason: "We should use the input's system prompt for steps that don't specify one, and the input's models for steps that don't specify a model.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, system, prompt, model string) (string, error) {
+						switch {
+						case system == "I'm a system" && prompt == "Plan." && model == "claude-opus-4-1":
+							return "A ConfigMap named configmap.", nil
+						case system == "You generate." && prompt == "Generate: A ConfigMap named configmap." && model == "claude-opus-4-1":
+							return "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  annotations:\n    upbound.io/name: configmap\n", nil
+						}
+						return "", fmt.Errorf("unexpected invocation: system %q, prompt %q, model %q", system, prompt, model)
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"models": ["claude-opus-4-1"],
+						"steps": [
+							{"name": "plan", "userPrompt": "Plan."},
+							{"name": "generate", "systemPrompt": "You generate.", "userPrompt": "Generate: {{ .Steps.plan.Output }}"}
+						]
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"configmap": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1",
+								"kind": "ConfigMap",
+								"metadata": {"annotations": {"upbound.io/name": "configmap"}}
+							}`)},
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "invoked Claude using model claude-opus-4-1",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "invoked Claude using model claude-opus-4-1",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+				},
+			},
+		},
+		"CompositionPipelineStepModelAndModels": {
+			reason: "We should return a fatal result without invoking Claude if a step specifies a model and the input specifies models.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "", errors.New("should not be invoked")
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"models": ["claude-opus-4-1"],
+						"steps": [{"name": "generate", "userPrompt": "I'm a step", "modelName": "claude-haiku-4-5"}]
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_FATAL,
+						Message:  `step "generate": modelName can't be combined with models or modelRoutes`,
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+				},
+				err: cmpopts.AnyError,
+			},
+		},
+		"CompositionPipelineStepsAndPreset": {
+			reason: "We should return a fatal result without invoking Claude if both a preset and steps are specified.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "", errors.New("should not be invoked")
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"preset": "krm-compose/v1",
+						"steps": [{"name": "generate", "userPrompt": "I'm a step"}]
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_FATAL,
+						Message:  "preset and steps are mutually exclusive",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+				},
+				err: cmpopts.AnyError,
+			},
+		},
+		"CompositionPipelineModelFallback": {
+			reason: "We should fall back to the next model if a model is overloaded, and report the model we used.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, model string) (string, error) {
+						if model == "claude-opus-4-1" {
+							return "", errors.New("API returned unexpected status code: 529: Overloaded")
+						}
+						return "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  annotations:\n    upbound.io/name: configmap\n", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user",
+						"models": ["claude-opus-4-1", "claude-sonnet-4-5"]
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_WARNING,
+							Message:  "model claude-opus-4-1 failed (Overloaded), falling back to model claude-sonnet-4-5: API returned unexpected status code: 529: Overloaded",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "invoked Claude using model claude-sonnet-4-5",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"configmap": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1",
+								"kind": "ConfigMap",
+								"metadata": {"annotations": {"upbound.io/name": "configmap"}}
+							}`)},
+						},
+					},
+				},
+			},
+		},
+		"CompositionPipelineModelNoFallback": {
+			reason: "We should not fall back to the next model on errors the input doesn't fall back on.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, model string) (string, error) {
+						if model == "claude-opus-4-1" {
+							return "", errors.New("API returned unexpected status code: 529: Overloaded")
+						}
+						return "", errors.New("should not fall back")
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user",
+						"models": ["claude-opus-4-1", "claude-sonnet-4-5"],
+						"fallbackOn": ["RateLimited"]
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_FATAL,
+						Message:  "failed to run chain: API returned unexpected status code: 529: Overloaded",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+				},
+				err: cmpopts.AnyError,
+			},
+		},
+		"OperationPipelineRequestsEventsByDefault": {
+			reason: "We should require the Events in the watched resource's namespace unless the input opts out of them.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "", errors.New("should not be invoked")
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"userPrompt": "I'm a user"
+					}`),
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"ops.crossplane.io/watched-resource": watchedDeployment,
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired:      &fnv1.State{},
+					Requirements: eventsRequirements,
+				},
+			},
+		},
+		"OperationPipelineEventsDisabled": {
+			reason: "We should not require Events if the input opts out of them.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return `some-response`, nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"userPrompt": "I'm a user",
+						"events": {"enabled": false}
+					}`),
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"ops.crossplane.io/watched-resource": watchedDeployment,
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_WARNING,
+							Message:  "response from Claude did not contain any resources, no changes will be made",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "some-response",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Conditions: []*fnv1.Condition{{
+						Type:   "FunctionSuccess",
+						Status: fnv1.Status_STATUS_CONDITION_TRUE,
+						Reason: "Success",
+						Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+					}},
+				},
+			},
+		},
+		"SimpleOperationPipeline": {
+			reason: "We should go through the operation pipeline without error.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return `some-response`, nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user"
+					}`),
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"claude.fn.upbound.io/events": {},
+						"ops.crossplane.io/watched-resource": {
+							Items: []*fnv1.Resource{
+								{
+									Resource: &structpb.Struct{},
+								},
+							},
+						},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{
+						Tag: "hello",
+						Ttl: &durationpb.Duration{
+							Seconds: 60,
+						},
+					},
+					Requirements: eventsRequirements,
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_WARNING,
+							Message:  "response from Claude did not contain any resources, no changes will be made",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "some-response",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Conditions: []*fnv1.Condition{{
+						Type:   "FunctionSuccess",
+						Status: fnv1.Status_STATUS_CONDITION_TRUE,
+						Reason: "Success",
+						Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+					}},
+					Desired: &fnv1.State{},
+				},
+			},
+		},
+		"StabilizedCompositionReusesObserved": {
+			reason: "We should reuse the observed composed resources without invoking Claude if the XR spec is unchanged.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "", errors.New("should not be invoked")
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta:        &fnv1.RequestMeta{Tag: "hello"},
+					Input:       stableInput,
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: stableObservedXR(now.Add(-1 * time.Hour)),
+						Resources: map[string]*fnv1.Resource{
+							"deployment": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "apps/v1",
+								"kind": "Deployment",
+								"metadata": {
+									"name": "app-abcde",
+									"uid": "some-uid",
+									"resourceVersion": "42",
+									"annotations": {"upbound.io/name": "deployment"}
+								},
+								"spec": {"replicas": 3},
+								"status": {"readyReplicas": 3}
+							}`)},
+						},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(fmt.Sprintf(`{
+							"metadata": {
+								"annotations": {
+									"claude.fn.upbound.io/spec-fingerprint": %q,
+									"claude.fn.upbound.io/composed-at": %q
+								}
+							}
+						}`, stableFingerprint, now.Add(-1*time.Hour).Format(time.RFC3339)))},
+						Resources: map[string]*fnv1.Resource{
+							"deployment": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "apps/v1",
+								"kind": "Deployment",
+								"metadata": {
+									"name": "app-abcde",
+									"annotations": {"upbound.io/name": "deployment"}
+								},
+								"spec": {"replicas": 3}
+							}`)},
+						},
+					},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_NORMAL,
+						Message:  "XR spec unchanged since last composition, reusing observed composed resources",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+				},
+			},
+		},
+		"StabilizedCompositionRecordsContextOutputs": {
+			reason: "We should record Claude's context outputs on the XR, so they can be written again when the composed resources are reused.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations:
+    upbound.io/name: deployment
+spec:
+  replicas: 3
+<context>
+tier: small
+</context>`, nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta:        &fnv1.RequestMeta{Tag: "hello"},
+					Input:       stableContextOutputsInput,
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: stableXR},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{
+						"example.org/claude": {"tier": "small"}
+					}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(fmt.Sprintf(`{
+							"metadata": {
+								"annotations": {
+									"claude.fn.upbound.io/spec-fingerprint": %q,
+									"claude.fn.upbound.io/composed-at": %q,
+									"claude.fn.upbound.io/context-outputs": "{\"tier\":\"small\"}"
+								}
+							}
+						}`, stableContextOutputsFingerprint, now.Format(time.RFC3339)))},
+						Resources: proposed,
+					},
+				},
+			},
+		},
+		"StabilizedCompositionReusesContextOutputs": {
+			reason: "We should write the recorded context outputs again when we reuse the observed composed resources.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "", errors.New("should not be invoked")
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta:        &fnv1.RequestMeta{Tag: "hello"},
+					Input:       stableContextOutputsInput,
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(fmt.Sprintf(`{
+							"metadata": {
+								"annotations": {
+									"claude.fn.upbound.io/spec-fingerprint": %q,
+									"claude.fn.upbound.io/composed-at": %q,
+									"claude.fn.upbound.io/context-outputs": "{\"tier\":\"small\"}"
+								}
+							},
+							"spec": {"replicas": 3}
+						}`, stableContextOutputsFingerprint, now.Add(-1*time.Hour).Format(time.RFC3339)))},
+						Resources: proposed,
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{
+						"example.org/claude": {"tier": "small"}
+					}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(fmt.Sprintf(`{
+							"metadata": {
+								"annotations": {
+									"claude.fn.upbound.io/spec-fingerprint": %q,
+									"claude.fn.upbound.io/composed-at": %q,
+									"claude.fn.upbound.io/context-outputs": "{\"tier\":\"small\"}"
+								}
+							}
+						}`, stableContextOutputsFingerprint, now.Add(-1*time.Hour).Format(time.RFC3339)))},
+						Resources: proposed,
+					},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_NORMAL,
+						Message:  "XR spec unchanged since last composition, reusing observed composed resources",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+				},
+			},
+		},
+		"StabilizedCompositionRefreshIntervalElapsed": {
+			reason: "We should invoke Claude and record a new composition time if the refresh interval has elapsed.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations:
+    upbound.io/name: deployment
+spec:
+  replicas: 3
+`, nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta:        &fnv1.RequestMeta{Tag: "hello"},
+					Input:       stableInput,
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: stableObservedXR(now.Add(-48 * time.Hour)),
+						Resources: map[string]*fnv1.Resource{
+							"deployment": {Resource: resource.MustStructJSON(`{"apiVersion": "apps/v1", "kind": "Deployment"}`)},
+						},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(fmt.Sprintf(`{
+							"metadata": {
+								"annotations": {
+									"claude.fn.upbound.io/spec-fingerprint": %q,
+									"claude.fn.upbound.io/composed-at": %q
+								}
+							}
+						}`, stableFingerprint, now.Format(time.RFC3339)))},
+						Resources: map[string]*fnv1.Resource{
+							"deployment": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "apps/v1",
+								"kind": "Deployment",
+								"metadata": {"annotations": {"upbound.io/name": "deployment"}},
+								"spec": {"replicas": 3}
+							}`)},
+						},
+					},
+				},
+			},
+		},
+		"CompositionPipelineReportsDiff": {
+			reason: "We should report the differences between the desired and observed composed resources.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations:
+    upbound.io/name: deployment
+spec:
+  replicas: 5
+`, nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user",
+						"diff": {
+							"enabled": true,
+							"statusField": "claude.lastDiff"
+						}
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+						Resources: map[string]*fnv1.Resource{
+							"deployment": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "apps/v1",
+								"kind": "Deployment",
+								"metadata": {"name": "app-abcde", "annotations": {"upbound.io/name": "deployment"}},
+								"spec": {"replicas": 3}
+							}`)},
+							"configmap": {Resource: resource.MustStructJSON(`{"apiVersion": "v1", "kind": "ConfigMap"}`)},
+						},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{
+							"status": {
+								"claude": {
+									"lastDiff": [
+										{"name": "configmap", "type": "Removed"},
+										{"name": "deployment", "type": "Modified", "fields": ["spec.replicas"]}
+									]
+								}
+							}
+						}`)},
+						Resources: map[string]*fnv1.Resource{
+							"deployment": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "apps/v1",
+								"kind": "Deployment",
+								"metadata": {"annotations": {"upbound.io/name": "deployment"}},
+								"spec": {"replicas": 5}
+							}`)},
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_WARNING,
+							Message:  "configmap (v1/ConfigMap) will be deleted",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "deployment (apps/v1/Deployment) will be modified: spec.replicas",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+				},
+			},
+		},
+		"ApprovalProposalAwaitingApproval": {
+			reason: "We should cache Claude's proposal on the XR and keep the observed composed resources until it is approved.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations:
+    upbound.io/name: deployment
+spec:
+  replicas: 3
+`, nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta:        &fnv1.RequestMeta{Tag: "hello"},
+					Input:       approvalInput,
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: stableXR},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(fmt.Sprintf(`{
+							"metadata": {
+								"annotations": {
+									"claude.fn.upbound.io/proposal-hash": %q,
+									"claude.fn.upbound.io/proposal-fingerprint": %q,
+									"claude.fn.upbound.io/proposal": %q
+								}
+							}
+						}`, proposalHash, approvalFingerprint, proposalBlob))},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "deployment (apps/v1/Deployment) will be created",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  fmt.Sprintf(`proposal %s is awaiting approval; annotate the XR with claude.fn.upbound.io/approved-hash: %q to apply it`, proposalHash, proposalHash),
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+				},
+			},
+		},
+		"ApprovalAppliesApprovedProposal": {
+			reason: "We should apply the cached proposal without invoking Claude once it is approved.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "", errors.New("should not be invoked")
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta:        &fnv1.RequestMeta{Tag: "hello"},
+					Input:       approvalInput,
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(fmt.Sprintf(`{
+							"metadata": {
+								"annotations": {
+									"claude.fn.upbound.io/proposal-hash": %q,
+									"claude.fn.upbound.io/proposal-fingerprint": %q,
+									"claude.fn.upbound.io/proposal": %q,
+									"claude.fn.upbound.io/approved-hash": %q
+								}
+							},
+							"spec": {"replicas": 3}
+						}`, proposalHash, approvalFingerprint, proposalBlob, proposalHash))},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(fmt.Sprintf(`{
+							"metadata": {
+								"annotations": {
+									"claude.fn.upbound.io/proposal-hash": %q,
+									"claude.fn.upbound.io/proposal-fingerprint": %q,
+									"claude.fn.upbound.io/proposal": %q,
+									"claude.fn.upbound.io/spec-fingerprint": %q
+								}
+							}
+						}`, proposalHash, approvalFingerprint, proposalBlob, approvalFingerprint))},
+						Resources: proposed,
+					},
+				},
+			},
+		},
+		"ApprovalProposalWithholdsContextOutputs": {
+			reason: "We should not write context outputs for a proposal that is awaiting approval, because its resources aren't applied.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations:
+    upbound.io/name: deployment
+spec:
+  replicas: 3
+<context>
+tier: small
+</context>`, nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta:        &fnv1.RequestMeta{Tag: "hello"},
+					Input:       approvalContextOutputsInput,
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: stableXR},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(fmt.Sprintf(`{
+							"metadata": {
+								"annotations": {
+									"claude.fn.upbound.io/proposal-hash": %q,
+									"claude.fn.upbound.io/proposal-fingerprint": %q,
+									"claude.fn.upbound.io/proposal": %q
+								}
+							}
+						}`, contextProposalHash, approvalContextOutputsFingerprint, contextProposalBlob))},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "deployment (apps/v1/Deployment) will be created",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  fmt.Sprintf(`proposal %s is awaiting approval; annotate the XR with claude.fn.upbound.io/approved-hash: %q to apply it`, contextProposalHash, contextProposalHash),
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+				},
+			},
+		},
+		"ApprovalAppliesApprovedContextOutputs": {
+			reason: "We should write the context outputs cached with an approved proposal when we apply it.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "", errors.New("should not be invoked")
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta:        &fnv1.RequestMeta{Tag: "hello"},
+					Input:       approvalContextOutputsInput,
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(fmt.Sprintf(`{
+							"metadata": {
+								"annotations": {
+									"claude.fn.upbound.io/proposal-hash": %q,
+									"claude.fn.upbound.io/proposal-fingerprint": %q,
+									"claude.fn.upbound.io/proposal": %q,
+									"claude.fn.upbound.io/approved-hash": %q
+								}
+							},
+							"spec": {"replicas": 3}
+						}`, contextProposalHash, approvalContextOutputsFingerprint, contextProposalBlob, contextProposalHash))},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{
+						"example.org/claude": {"tier": "small"}
+					}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(fmt.Sprintf(`{
+							"metadata": {
+								"annotations": {
+									"claude.fn.upbound.io/proposal-hash": %q,
+									"claude.fn.upbound.io/proposal-fingerprint": %q,
+									"claude.fn.upbound.io/proposal": %q,
+									"claude.fn.upbound.io/spec-fingerprint": %q,
+									"claude.fn.upbound.io/context-outputs": "{\"tier\":\"small\"}"
+								}
+							}
+						}`, contextProposalHash, approvalContextOutputsFingerprint, contextProposalBlob, approvalContextOutputsFingerprint))},
+						Resources: proposed,
+					},
+				},
+			},
+		},
+		"ApprovalIgnoresTamperedProposal": {
+			reason: "We should ask Claude for a new proposal rather than apply a cached proposal that doesn't match its approved hash.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations:
+    upbound.io/name: deployment
+spec:
+  replicas: 3
+`, nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta:        &fnv1.RequestMeta{Tag: "hello"},
+					Input:       approvalInput,
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(fmt.Sprintf(`{
+							"metadata": {
+								"annotations": {
+									"claude.fn.upbound.io/proposal-hash": %q,
+									"claude.fn.upbound.io/proposal-fingerprint": %q,
+									"claude.fn.upbound.io/proposal": %q,
+									"claude.fn.upbound.io/approved-hash": %q
+								}
+							},
+							"spec": {"replicas": 3}
+						}`, proposalHash, approvalFingerprint, tamperedBlob, proposalHash))},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(fmt.Sprintf(`{
+							"metadata": {
+								"annotations": {
+									"claude.fn.upbound.io/proposal-hash": %q,
+									"claude.fn.upbound.io/proposal-fingerprint": %q,
+									"claude.fn.upbound.io/proposal": %q,
+									"claude.fn.upbound.io/spec-fingerprint": %q
+								}
+							}
+						}`, proposalHash, approvalFingerprint, proposalBlob, approvalFingerprint))},
+						Resources: proposed,
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_WARNING,
+							Message:  fmt.Sprintf("ignoring cached proposal %s: proposal content has hash %s, not %s", proposalHash, tamperedHash, proposalHash),
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "deployment (apps/v1/Deployment) will be created",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+				},
+			},
+		},
+		"CompositionPipelineRationale": {
+			reason: "We should report Claude's rationale and annotate the desired resources with it.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return `---
+apiVersion: v1
+kind: Service
+metadata:
+  annotations:
+    upbound.io/name: service
+<rationale>
+service: Exposes the Deployment on port 8080 as requested.
+configmap: No longer referenced.
+</rationale>`, nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user",
+						"rationale": {
+							"enabled": true,
+							"annotate": true,
+							"maxLength": 20
+						}
+					}`),
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"service": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1",
+								"kind": "Service",
+								"metadata": {
+									"annotations": {
+										"upbound.io/name": "service",
+										"claude.fn.upbound.io/rationale": "Exposes the Deplo..."
+									}
+								}
+							}`)},
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "rationale for configmap: No longer referen...",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "rationale for service: Exposes the Deplo...",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+				},
+			},
+		},
+		"CompositionPipelineContextOutputs": {
+			reason: "We should write the values Claude returns to the pipeline context.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return `---
+apiVersion: v1
+kind: Service
+metadata:
+  annotations:
+    upbound.io/name: service
+<context>
+tier: small
+unrequested: value
+</context>`, nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta:        &fnv1.RequestMeta{Tag: "hello"},
+					Input:       contextOutputsInput,
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Context: resource.MustStructJSON(`{
+						"example.org/claude": {"tier": "small"}
+					}`),
+					Desired: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{
+							"metadata": {
+								"annotations": {"claude.fn.upbound.io/context-outputs": "{\"tier\":\"small\"}"}
+							}
+						}`)},
+						Resources: map[string]*fnv1.Resource{
+							"service": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1",
+								"kind": "Service",
+								"metadata": {"annotations": {"upbound.io/name": "service"}}
+							}`)},
+						},
+					},
+				},
+			},
+		},
+		"CompositionPipelineInvalidContextOutputs": {
+			reason: "We should return a fatal result if a value Claude returns doesn't satisfy its schema.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return `---
+apiVersion: v1
+kind: Service
+metadata:
+  annotations:
+    upbound.io/name: service
+<context>
+tier: medium
+</context>`, nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta:        &fnv1.RequestMeta{Tag: "hello"},
+					Input:       contextOutputsInput,
+					Credentials: mockCredentials(),
+					Observed: &fnv1.State{
+						Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{}`)},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_FATAL,
+						Message:  `did not receive valid context outputs from Claude: invalid value "tier": value must be one of [small large]`,
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+				},
+				err: cmpopts.AnyError,
+			},
+		},
+		"OperationPipelineRequestsRequiredResources": {
+			reason: "We should request the declared required resources before invoking Claude.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "", errors.New("should not be invoked")
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta:        &fnv1.RequestMeta{Tag: "hello"},
+					Input:       requiredInput,
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"claude.fn.upbound.io/events":        {},
+						"ops.crossplane.io/watched-resource": watchedDeployment,
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired:      &fnv1.State{},
+					Requirements: requiredRequirements,
+				},
+			},
+		},
+		"OperationPipelineRequiredResourceMissingField": {
+			reason: "We should return a fatal result if a selector value references a field the watched resource doesn't have.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "", errors.New("should not be invoked")
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"userPrompt": "{{ .Required.pods }}",
+						"requiredResources": [{
+							"name": "pods",
+							"apiVersion": "v1",
+							"kind": "Pod",
+							"matchLabels": {"tier": "{{ .Watched.metadata.labels.tier }}"}
+						}]
+					}`),
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"ops.crossplane.io/watched-resource": {Items: []*fnv1.Resource{{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "apps/v1",
+								"kind": "Deployment",
+								"metadata": {"name": "my-app", "namespace": "default", "labels": {}}
+							}`),
+						}}},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:    &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired: &fnv1.State{},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_FATAL,
+						Message:  `cannot build required resource selectors: cannot render label "tier" of required resource "pods": cannot execute template: template: selector:1:11: executing "selector" at <.Watched.metadata.labels.tier>: map has no entry for key "tier"`,
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+				},
+				err: cmpopts.AnyError,
+			},
+		},
+		"OperationPipelineWithRequiredResources": {
+			reason: "We should expose the required resources to the prompt template by name.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, prompt, _ string) (string, error) {
+						if want := "[\n    {\n        \"kind\": \"Pod\"\n    }\n]"; prompt != want {
+							return "", fmt.Errorf("want prompt %q, got %q", want, prompt)
+						}
+						return "The pods look fine.", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta:        &fnv1.RequestMeta{Tag: "hello"},
+					Input:       requiredInput,
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"claude.fn.upbound.io/events":        {},
+						"ops.crossplane.io/watched-resource": watchedDeployment,
+						"pods": {Items: []*fnv1.Resource{{
+							Resource: resource.MustStructJSON(`{"kind": "Pod"}`),
+						}}},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Desired:      &fnv1.State{},
+					Requirements: requiredRequirements,
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_WARNING,
+							Message:  "response from Claude did not contain any resources, no changes will be made",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "The pods look fine.",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Conditions: []*fnv1.Condition{{
+						Type:   "FunctionSuccess",
+						Status: fnv1.Status_STATUS_CONDITION_TRUE,
+						Reason: "Success",
+						Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+					}},
+				},
+			},
+		},
+		"OperationPipelineMultipleResources": {
+			reason: "We should return every resource in Claude's response as desired.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: my-app\nspec:\n  replicas: 2\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: my-app\n  namespace: default", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user"
+					}`),
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"claude.fn.upbound.io/events":        {},
+						"ops.crossplane.io/watched-resource": watchedDeployment,
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Requirements: eventsRequirements,
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"Deployment.apps/default/my-app": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "apps/v1",
+								"kind": "Deployment",
+								"metadata": {"name": "my-app", "namespace": "default"},
+								"spec": {"replicas": 2}
+							}`)},
+							"ConfigMap/default/my-app": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1",
+								"kind": "ConfigMap",
+								"metadata": {"name": "my-app", "namespace": "default"}
+							}`)},
+						},
+					},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_NORMAL,
+						Message:  "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: my-app\nspec:\n  replicas: 2\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: my-app\n  namespace: default",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+					Conditions: []*fnv1.Condition{{
+						Type:   "FunctionSuccess",
+						Status: fnv1.Status_STATUS_CONDITION_TRUE,
+						Reason: "Success",
+						Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+					}},
+				},
+			},
+		},
+		"OperationPipelineInvalidResource": {
+			reason: "We should return a fatal result if Claude returns a resource that isn't actionable.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "apiVersion: apps/v1\nkind: Deployment\nspec:\n  replicas: 2", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user"
+					}`),
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"claude.fn.upbound.io/events":        {},
+						"ops.crossplane.io/watched-resource": watchedDeployment,
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Requirements: eventsRequirements,
+					Desired:      &fnv1.State{},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_FATAL,
+						Message:  "response from Claude is not actionable: invalid document 0: missing metadata.name",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+				},
+				err: cmpopts.AnyError,
+			},
+		},
+		"OperationPipelinePlaybook": {
+			reason: "We should apply the actions Claude chooses from the playbook as a patch to the watched resource.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "- action: scale\n  parameters:\n    replicas: 3\n- action: annotate\n  parameters:\n    reason: \"high load\\ninjected: true\"\n- action: pause", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta:        &fnv1.RequestMeta{Tag: "hello"},
+					Input:       resource.MustStructJSON(playbookInput),
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"claude.fn.upbound.io/events":        {},
+						"ops.crossplane.io/watched-resource": watchedDeployment,
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Requirements: eventsRequirements,
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"Deployment.apps/default/my-app": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "apps/v1",
+								"kind": "Deployment",
+								"metadata": {
+									"name": "my-app",
+									"namespace": "default",
+									"annotations": {"example.org/remediated": "high load\ninjected: true"}
+								},
+								"spec": {"replicas": 3, "paused": true}
+							}`)},
+						},
+					},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_NORMAL,
+						Message:  `remediation actions: scale {"replicas":3}, annotate {"reason":"high load\ninjected: true"}, pause`,
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+					Conditions: []*fnv1.Condition{{
+						Type:   "FunctionSuccess",
+						Status: fnv1.Status_STATUS_CONDITION_TRUE,
+						Reason: "Success",
+						Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+					}},
+				},
+			},
+		},
+		"OperationPipelinePlaybookRefusesUnknownAction": {
+			reason: "We should refuse actions that aren't in the playbook.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "- action: delete", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta:        &fnv1.RequestMeta{Tag: "hello"},
+					Input:       resource.MustStructJSON(playbookInput),
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"claude.fn.upbound.io/events":        {},
+						"ops.crossplane.io/watched-resource": watchedDeployment,
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Requirements: eventsRequirements,
+					Desired:      &fnv1.State{},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_FATAL,
+						Message:  `refusing remediation from Claude: action 0: "delete" is not in the playbook`,
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+				},
+				err: cmpopts.AnyError,
+			},
+		},
+		"OperationPipelinePlaybookRefusesInvalidParameters": {
+			reason: "We should refuse actions whose parameters don't satisfy their schema.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "- action: scale\n  parameters:\n    replicas: 50", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta:        &fnv1.RequestMeta{Tag: "hello"},
+					Input:       resource.MustStructJSON(playbookInput),
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"claude.fn.upbound.io/events":        {},
+						"ops.crossplane.io/watched-resource": watchedDeployment,
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Requirements: eventsRequirements,
+					Desired:      &fnv1.State{},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_FATAL,
+						Message:  `refusing remediation from Claude: action 0: invalid parameters for "scale": replicas must be at most 10`,
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+				},
+				err: cmpopts.AnyError,
+			},
+		},
+		"OperationPipelineOutputAnnotation": {
+			reason: "We should write Claude's output value to an annotation of the watched resource, truncated, with a timestamp.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "The app is healthy.\n<output>Reviewed all replicas, everything looks fine</output>", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user",
+						"output": {"name": "summary", "annotation": "example.org/last-review", "maxLength": 20}
+					}`),
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"claude.fn.upbound.io/events":        {},
+						"ops.crossplane.io/watched-resource": watchedDeployment,
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Requirements: eventsRequirements,
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"Deployment.apps/default/my-app": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "apps/v1",
+								"kind": "Deployment",
+								"metadata": {
+									"name": "my-app",
+									"namespace": "default",
+									"annotations": {
+										"example.org/last-review": "Reviewed all repl...",
+										"claude.fn.upbound.io/output-updated-at": "2025-10-01T12:00:00Z"
+									}
+								}
+							}`)},
+						},
+					},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_WARNING,
+							Message:  "response from Claude did not contain any resources, no changes will be made",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "The app is healthy.",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Conditions: []*fnv1.Condition{{
+						Type:   "FunctionSuccess",
+						Status: fnv1.Status_STATUS_CONDITION_TRUE,
+						Reason: "Success",
+						Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+					}},
+				},
+			},
+		},
+		"OperationPipelineOutputUnchanged": {
+			reason: "We should not touch the watched resource, including the timestamp, if it already has Claude's output value.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "The app is healthy.\n<output>Reviewed all replicas, everything looks fine</output>", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user",
+						"output": {"name": "summary", "annotation": "example.org/last-review", "maxLength": 20}
+					}`),
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"claude.fn.upbound.io/events": {},
+						"ops.crossplane.io/watched-resource": {Items: []*fnv1.Resource{{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "apps/v1",
+								"kind": "Deployment",
+								"metadata": {
+									"name": "my-app",
+									"namespace": "default",
+									"annotations": {
+										"example.org/last-review": "Reviewed all repl...",
+										"claude.fn.upbound.io/output-updated-at": "2025-09-30T12:00:00Z"
+									}
+								}
+							}`),
+						}}},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Requirements: eventsRequirements,
+					Desired:      &fnv1.State{},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_WARNING,
+							Message:  "response from Claude did not contain any resources, no changes will be made",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "The app is healthy.",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Conditions: []*fnv1.Condition{{
+						Type:   "FunctionSuccess",
+						Status: fnv1.Status_STATUS_CONDITION_TRUE,
+						Reason: "Success",
+						Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+					}},
+				},
+			},
+		},
+		"OperationPipelineOutputStatusPath": {
+			reason: "We should write Claude's output value to a status field of the watched resource in report mode.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "[]\n<output>87</output>", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user",
+						"report": {"enabled": true},
+						"output": {"name": "healthScore", "statusPath": "status.health.score"}
+					}`),
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"claude.fn.upbound.io/events":        {},
+						"ops.crossplane.io/watched-resource": watchedDeployment,
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Requirements: eventsRequirements,
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"Deployment.apps/default/my-app": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "apps/v1",
+								"kind": "Deployment",
+								"metadata": {
+									"name": "my-app",
+									"namespace": "default",
+									"annotations": {"claude.fn.upbound.io/output-updated-at": "2025-10-01T12:00:00Z"}
+								},
+								"status": {"health": {"score": 87}}
+							}`)},
+						},
+					},
+					Output: resource.MustStructJSON(`{"findings": []}`),
+					Conditions: []*fnv1.Condition{{
+						Type:   "FunctionSuccess",
+						Status: fnv1.Status_STATUS_CONDITION_TRUE,
+						Reason: "Success",
+						Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+					}},
+				},
+			},
+		},
+		"OperationPipelineReport": {
+			reason: "We should report Claude's findings as results and output, without desired resources.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "```yaml\n- severity: warning\n  title: Single replica\n  detail: The Deployment has no redundancy.\n  path: spec.replicas\n- severity: info\n  title: Image is pinned\n```", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user",
+						"report": {"enabled": true}
+					}`),
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"claude.fn.upbound.io/events":        {},
+						"ops.crossplane.io/watched-resource": watchedDeployment,
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Requirements: eventsRequirements,
+					Desired:      &fnv1.State{},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_WARNING,
+							Message:  "Single replica: The Deployment has no redundancy. (field spec.replicas)",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "Image is pinned",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Output: resource.MustStructJSON(`{
+						"findings": [
+							{"severity": "warning", "title": "Single replica", "detail": "The Deployment has no redundancy.", "path": "spec.replicas"},
+							{"severity": "info", "title": "Image is pinned"}
+						]
+					}`),
+					Conditions: []*fnv1.Condition{{
+						Type:   "FunctionSuccess",
+						Status: fnv1.Status_STATUS_CONDITION_TRUE,
+						Reason: "Success",
+						Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+					}},
+				},
+			},
+		},
+		"OperationPipelineDryRun": {
+			reason: "We should report the changes Claude would make without returning desired resources when dry run is set in the context.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: my-app\nspec:\n  replicas: 2", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user"
+					}`),
+					Context:     resource.MustStructJSON(`{"claude.fn.upbound.io/dry-run": true}`),
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"claude.fn.upbound.io/events":        {},
+						"ops.crossplane.io/watched-resource": watchedDeployment,
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Requirements: eventsRequirements,
+					Context:      resource.MustStructJSON(`{"claude.fn.upbound.io/dry-run": true}`),
+					Desired:      &fnv1.State{},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_NORMAL,
+						Message:  "dry run: Deployment.apps/default/my-app (apps/v1/Deployment) will be modified: spec",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+					Conditions: []*fnv1.Condition{{
+						Type:   "FunctionSuccess",
+						Status: fnv1.Status_STATUS_CONDITION_TRUE,
+						Reason: "Success",
+						Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+					}},
+				},
+			},
+		},
+		"OperationPipelineWithEvents": {
+			reason: "We should require Events in the watched resource's namespace and supply them to the prompt deduplicated, most recent first.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, prompt, _ string) (string, error) {
+						want := "2025-10-01T11:59:00Z Warning BackOff (x5): Back-off restarting failed container\n" +
+							"2025-10-01T11:00:00Z Normal Scheduled (x1): Scheduled\n"
+						if prompt != want {
+							return "", fmt.Errorf("want prompt %q, got %q", want, prompt)
+						}
+						return "The container is crash looping.", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "{{ .Events }}",
+						"events": {"enabled": true, "limit": 2}
+					}`),
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"ops.crossplane.io/watched-resource": {Items: []*fnv1.Resource{{
+							Resource: resource.MustStructJSON(`{
+								"apiVersion": "apps/v1",
+								"kind": "Deployment",
+								"metadata": {"name": "my-app", "namespace": "default", "uid": "app-uid"}
+							}`),
+						}}},
+						"claude.fn.upbound.io/events": {Items: []*fnv1.Resource{
+							{Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1", "kind": "Event",
+								"involvedObject": {"uid": "app-uid"},
+								"type": "Warning", "reason": "BackOff", "message": "Back-off restarting failed container",
+								"count": 3, "lastTimestamp": "2025-10-01T11:30:00Z"
+							}`)},
+							{Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1", "kind": "Event",
+								"involvedObject": {"uid": "app-uid"},
+								"type": "Warning", "reason": "BackOff", "message": "Back-off restarting failed container",
+								"count": 2, "lastTimestamp": "2025-10-01T11:59:00Z"
+							}`)},
+							{Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1", "kind": "Event",
+								"involvedObject": {"uid": "app-uid"},
+								"type": "Normal", "reason": "Scheduled", "message": "Scheduled",
+								"lastTimestamp": "2025-10-01T11:00:00Z"
+							}`)},
+							{Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1", "kind": "Event",
+								"involvedObject": {"uid": "app-uid"},
+								"type": "Normal", "reason": "Pulled", "message": "Pulled image",
+								"lastTimestamp": "2025-10-01T10:00:00Z"
+							}`)},
+							{Resource: resource.MustStructJSON(`{
+								"apiVersion": "v1", "kind": "Event",
+								"involvedObject": {"uid": "other-uid"},
+								"type": "Warning", "reason": "Failed", "message": "Not about my-app",
+								"lastTimestamp": "2025-10-01T12:00:00Z"
+							}`)},
+						}},
+					},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta: &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Requirements: &fnv1.Requirements{Resources: map[string]*fnv1.ResourceSelector{
+						"claude.fn.upbound.io/events": {
+							ApiVersion: "v1",
+							Kind:       "Event",
+							Namespace:  ptr("default"),
+							Match:      &fnv1.ResourceSelector_MatchLabels{MatchLabels: &fnv1.MatchLabels{}},
+						},
+					}},
+					Results: []*fnv1.Result{
+						{
+							Severity: fnv1.Severity_SEVERITY_WARNING,
+							Message:  "response from Claude did not contain any resources, no changes will be made",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+						{
+							Severity: fnv1.Severity_SEVERITY_NORMAL,
+							Message:  "The container is crash looping.",
+							Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+						},
+					},
+					Conditions: []*fnv1.Condition{{
+						Type:   "FunctionSuccess",
+						Status: fnv1.Status_STATUS_CONDITION_TRUE,
+						Reason: "Success",
+						Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+					}},
+				},
+			},
+		},
+		"OperationPipelineCoolingDown": {
+			reason: "We should skip invoking Claude if the watched resource was invoked for within the cooldown.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "", errors.New("should not be invoked")
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user",
+						"rateLimit": {"cooldown": "5m"}
+					}`),
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"claude.fn.upbound.io/events": {},
+						"ops.crossplane.io/watched-resource": {Items: []*fnv1.Resource{{
+							Resource: resource.MustStructJSON(fmt.Sprintf(`{
+								"apiVersion": "apps/v1",
+								"kind": "Deployment",
+								"metadata": {
+									"name": "my-app",
+									"namespace": "default",
+									"uid": "cool-uid",
+									"annotations": {"claude.fn.upbound.io/last-invoked": %q}
+								}
+							}`, now.Add(-1*time.Minute).Format(time.RFC3339))),
+						}}},
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Requirements: eventsRequirements,
+					Desired:      &fnv1.State{},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_NORMAL,
+						Message:  "skipping, watched resource is cooling down for another 4m0s",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+					Conditions: []*fnv1.Condition{{
+						Type:   "FunctionSuccess",
+						Status: fnv1.Status_STATUS_CONDITION_TRUE,
+						Reason: "Success",
+						Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+					}},
+				},
+			},
+		},
+		"OperationPipelinePersistCooldown": {
+			reason: "We should record when Claude was invoked on the watched resource if asked to persist the cooldown.",
+			args: args{
+				ai: &mockAgentInvoker{
+					InvokeFn: func(_ context.Context, _, _, _, _ string) (string, error) {
+						return "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: my-app\nspec:\n  replicas: 2", nil
+					},
+				},
+				req: &fnv1.RunFunctionRequest{
+					Meta: &fnv1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructJSON(`{
+						"apiVersion": "claude.fn.upbound.io/v1alpha1",
+						"kind": "Prompt",
+						"systemPrompt": "I'm a system",
+						"userPrompt": "I'm a user",
+						"rateLimit": {"cooldown": "5m", "persistCooldown": true}
+					}`),
+					Credentials: mockCredentials(),
+					RequiredResources: map[string]*fnv1.Resources{
+						"claude.fn.upbound.io/events":        {},
+						"ops.crossplane.io/watched-resource": watchedDeployment,
+					},
+					Desired: &fnv1.State{},
+				},
+			},
+			want: want{
+				rsp: &fnv1.RunFunctionResponse{
+					Meta:         &fnv1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Requirements: eventsRequirements,
+					Desired: &fnv1.State{
+						Resources: map[string]*fnv1.Resource{
+							"Deployment.apps/default/my-app": {Resource: resource.MustStructJSON(`{
+								"apiVersion": "apps/v1",
+								"kind": "Deployment",
+								"metadata": {
+									"name": "my-app",
+									"namespace": "default",
+									"annotations": {"claude.fn.upbound.io/last-invoked": "2025-10-01T12:00:00Z"}
+								},
+								"spec": {"replicas": 2}
+							}`)},
+						},
+					},
+					Results: []*fnv1.Result{{
+						Severity: fnv1.Severity_SEVERITY_NORMAL,
+						Message:  "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: my-app\nspec:\n  replicas: 2",
+						Target:   fnv1.Target_TARGET_COMPOSITE.Enum(),
+					}},
+					Conditions: []*fnv1.Condition{{
+						Type:   "FunctionSuccess",
+						Status: fnv1.Status_STATUS_CONDITION_TRUE,
+						Reason: "Success",
+						Target: fnv1.Target_TARGET_COMPOSITE_AND_CLAIM.Enum(),
+					}},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger(), ai: tc.args.ai, now: func() time.Time { return now }}
+			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+
+			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func mockCredentials() map[string]*fnv1.Credentials {
+	return map[string]*fnv1.Credentials{
+		credName: {
+			Source: &fnv1.Credentials_CredentialData{
+				CredentialData: &fnv1.CredentialData{
+					Data: map[string][]byte{
+						credKey: []byte("data"),
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestResourcesFrom(t *testing.T) {
+	type args struct {
+		resp     string
+		existing map[string][]resource.Required
+	}
+	type want struct {
+		resource map[string]*fnv1.Resource
+		cleaned  string
+		err      error
+	}
+
+	configMap := func(name string) *fnv1.Resource {
+		return &fnv1.Resource{Resource: resource.MustStructJSON(fmt.Sprintf(`{
+			"apiVersion": "v1",
+			"kind": "ConfigMap",
+			"metadata": {"name": %q}
+		}`, name))}
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"String": {
+			reason: "We should return errNoResources if we received prose rather than resources",
+			args: args{
+				resp: "some-response",
+			},
+			want: want{
+				err: errNoResources,
+			},
+		},
+		"Prose": {
+			reason: "We should return errNoResources if we received prose that isn't valid YAML",
+			args: args{
+				resp: "The resource looks healthy: it has 3 replicas.\n- none are failing",
+			},
+			want: want{
+				err: errNoResources,
+			},
+		},
+		"Empty": {
+			reason: "We should return errNoResources if we received an empty response",
+			args: args{
+				resp: ``,
+			},
+			want: want{
+				err: errNoResources,
+			},
+		},
+		"InvalidJSON": {
+			reason: "We should return errNoResources if we attempt to process invalid JSON",
+			args: args{
+				resp: `{a: `,
+			},
+			want: want{
+				err: errNoResources,
+			},
+		},
+		"MissingKind": {
+			reason: "We should return an error if a document doesn't identify its kind",
+			args: args{
+				resp: `{"apiVersion": "v1", "metadata": {"name": "test"}}`,
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+		"MissingName": {
+			reason: "We should return an error if a document doesn't identify its name",
+			args: args{
+				resp: "apiVersion: v1\nkind: ConfigMap",
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+		"Duplicate": {
+			reason: "We should return an error if a resource appears more than once",
+			args: args{
+				resp: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: test\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: test",
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+		"ValidJSON": {
+			reason: "We should not return an error if we processed valid JSON",
+			args: args{
+				resp: `{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "test"}}`,
+			},
+			want: want{
+				resource: map[string]*fnv1.Resource{"ConfigMap/test": configMap("test")},
+			},
+		},
+		"JSONArray": {
+			reason: "We should process each item of a JSON array",
+			args: args{
+				resp: `[{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "a"}}, {"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "b"}}]`,
+			},
+			want: want{
+				resource: map[string]*fnv1.Resource{"ConfigMap/a": configMap("a"), "ConfigMap/b": configMap("b")},
+			},
+		},
+		"List": {
+			reason: "We should process each item of a v1 List",
+			args: args{
+				resp: "apiVersion: v1\nkind: List\nitems:\n- apiVersion: v1\n  kind: ConfigMap\n  metadata:\n    name: a",
+			},
+			want: want{
+				resource: map[string]*fnv1.Resource{"ConfigMap/a": configMap("a")},
+			},
+		},
+		"YAMLStream": {
+			reason: "We should process each document of a YAML stream, even if they share a name",
+			args: args{
+				resp: "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: test\n---\napiVersion: v1\nkind: Secret\nmetadata:\n  name: test\n",
+			},
+			want: want{
+				resource: map[string]*fnv1.Resource{
+					"ConfigMap/test": configMap("test"),
+					"Secret/test": {Resource: resource.MustStructJSON(`{
+						"apiVersion": "v1",
+						"kind": "Secret",
+						"metadata": {"name": "test"}
+					}`)},
+				},
+			},
+		},
+		"PatchExisting": {
+			reason: "We should fill in the namespace of a patch from the resource it targets, and strip server managed metadata",
+			args: args{
+				resp: "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: app\n  resourceVersion: \"42\"\nspec:\n  replicas: 3",
+				existing: map[string][]resource.Required{
+					"ops.crossplane.io/watched-resource": {{Resource: &unstructured.Unstructured{Object: map[string]any{
+						"apiVersion": "apps/v1",
+						"kind":       "Deployment",
+						"metadata":   map[string]any{"name": "app", "namespace": "default"},
+					}}}},
+				},
+			},
+			want: want{
+				resource: map[string]*fnv1.Resource{
+					"Deployment.apps/default/app": {Resource: resource.MustStructJSON(`{
+						"apiVersion": "apps/v1",
+						"kind": "Deployment",
+						"metadata": {"name": "app", "namespace": "default"},
+						"spec": {"replicas": 3}
+					}`)},
+				},
+			},
+		},
+		"SameKindDifferentGroups": {
+			reason: "We should not confuse resources of the same kind in different API groups",
+			args: args{
+				resp: "---\napiVersion: example.org/v1\nkind: Bucket\nmetadata:\n  name: data\n---\napiVersion: example.com/v1\nkind: Bucket\nmetadata:\n  name: data",
+			},
+			want: want{
+				resource: map[string]*fnv1.Resource{
+					"Bucket.example.org/data": {Resource: resource.MustStructJSON(`{
+						"apiVersion": "example.org/v1",
+						"kind": "Bucket",
+						"metadata": {"name": "data"}
+					}`)},
+					"Bucket.example.com/data": {Resource: resource.MustStructJSON(`{
+						"apiVersion": "example.com/v1",
+						"kind": "Bucket",
+						"metadata": {"name": "data"}
+					}`)},
+				},
+				cleaned: "---\napiVersion: example.org/v1\nkind: Bucket\nmetadata:\n  name: data\n---\napiVersion: example.com/v1\nkind: Bucket\nmetadata:\n  name: data",
+			},
+		},
+		"JSONWithMarkdownCodeBlock": {
+			reason: "We should strip markdown code blocks and process the JSON",
+			args: args{
+				resp: "```json\n{\"apiVersion\": \"v1\", \"kind\": \"ConfigMap\", \"metadata\": {\"name\": \"test\"}}\n```",
+			},
+			want: want{
+				resource: map[string]*fnv1.Resource{"ConfigMap/test": configMap("test")},
+				cleaned:  "{\"apiVersion\": \"v1\", \"kind\": \"ConfigMap\", \"metadata\": {\"name\": \"test\"}}",
+			},
+		},
+		"YAMLWithMarkdownCodeBlock": {
+			reason: "We should strip markdown code blocks and process the YAML",
+			args: args{
+				resp: "```yaml\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: test\n```",
+			},
+			want: want{
+				resource: map[string]*fnv1.Resource{"ConfigMap/test": configMap("test")},
+				cleaned:  "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: test",
+			},
+		},
+		"MarkdownWithWhitespace": {
+			reason: "We should strip markdown and trim whitespace",
+			args: args{
+				resp: "  \n```\n{\"apiVersion\": \"v1\", \"kind\": \"ConfigMap\", \"metadata\": {\"name\": \"test\"}}\n```\n  ",
+			},
+			want: want{
+				resource: map[string]*fnv1.Resource{"ConfigMap/test": configMap("test")},
+				cleaned:  "{\"apiVersion\": \"v1\", \"kind\": \"ConfigMap\", \"metadata\": {\"name\": \"test\"}}",
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			got, cleaned, err := f.resourcesFrom(tc.args.resp, tc.args.existing)
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.resourcesFrom(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.resource, got, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.resourcesFrom(...): -want resource, +got resource:\n%s", tc.reason, diff)
+			}
+
+			// Only check cleaned string if test case specifies an expected value
+			if tc.want.cleaned != "" {
+				if cleaned != tc.want.cleaned {
+					t.Errorf("%s\nf.resourcesFrom(...): -want cleaned, +got cleaned:\nwant: %q\ngot:  %q", tc.reason, tc.want.cleaned, cleaned)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractJSONFromAgentError(t *testing.T) {
+	type args struct {
+		err error
+	}
+	type want struct {
+		extracted string
+		ok        bool
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"NilError": {
+			reason: "Should return false for nil error",
+			args: args{
+				err: nil,
+			},
+			want: want{
+				extracted: "",
+				ok:        false,
+			},
+		},
+		"UnrelatedError": {
+			reason: "Should return false for unrelated errors",
+			args: args{
+				err: errors.New("some other error"),
+			},
+			want: want{
+				extracted: "",
+				ok:        false,
+			},
+		},
+		"AgentErrorWithJSON": {
+			reason: "Should extract clean JSON from agent parsing error",
+			args: args{
+				err: errors.New("unable to parse agent output: {\"apiVersion\": \"v1\", \"kind\": \"Test\"}"),
+			},
+			want: want{
+				extracted: "{\"apiVersion\": \"v1\", \"kind\": \"Test\"}",
+				ok:        true,
+			},
+		},
+		"AgentErrorWithMarkdownJSON": {
+			reason: "Should extract and strip markdown from agent error",
+			args: args{
+				err: errors.New("unable to parse agent output: ```json\n{\"apiVersion\": \"v1\"}\n```"),
+			},
+			want: want{
+				extracted: "{\"apiVersion\": \"v1\"}",
+				ok:        true,
+			},
+		},
+		"AgentErrorWithMarkdownYAML": {
+			reason: "Should extract and strip markdown YAML blocks",
+			args: args{
+				err: errors.New("unable to parse agent output: ```yaml\napiVersion: v1\n```"),
+			},
+			want: want{
+				extracted: "apiVersion: v1",
+				ok:        true,
+			},
+		},
+		"AgentErrorWithGenericMarkdown": {
+			reason: "Should extract and strip generic markdown blocks",
+			args: args{
+				err: errors.New("unable to parse agent output: ```\n{\"test\": true}\n```"),
+			},
+			want: want{
+				extracted: "{\"test\": true}",
+				ok:        true,
+			},
+		},
+		"AgentErrorWithWhitespace": {
+			reason: "Should trim whitespace from extracted content",
+			args: args{
+				err: errors.New("unable to parse agent output:   \n{\"test\": true}\n  "),
+			},
+			want: want{
+				extracted: "{\"test\": true}",
+				ok:        true,
+			},
+		},
+		"WrappedAgentError": {
+			reason: "Should extract even if error message is wrapped (makes it more robust)",
+			args: args{
+				err: errors.New("failed to run: unable to parse agent output: {\"test\": true}"),
+			},
+			want: want{
+				extracted: "{\"test\": true}",
+				ok:        true,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			extracted, ok := extractJSONFromAgentError(tc.args.err)
+
+			if ok != tc.want.ok {
+				t.Errorf("%s\nextractJSONFromAgentError(...): got ok=%v, want ok=%v", tc.reason, ok, tc.want.ok)
+			}
+
+			if extracted != tc.want.extracted {
+				t.Errorf("%s\nextractJSONFromAgentError(...): got extracted=%q, want extracted=%q", tc.reason, extracted, tc.want.extracted)
+			}
+		})
+	}
+}
+
+func TestSplitRationale(t *testing.T) {
+	type args struct {
+		resp string
+	}
+	type want struct {
+		manifests string
+		rationale map[string]string
+		err       error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"NoRationale": {
+			reason: "A response without a rationale should be returned unchanged.",
+			args: args{
+				resp: "---\nkind: Service",
+			},
+			want: want{
+				manifests: "---\nkind: Service",
+			},
+		},
+		"Rationale": {
+			reason: "The rationale should be split from the YAML stream.",
+			args: args{
+				resp: "---\nkind: Service\n<rationale>\nservice: Because.\n</rationale>\n",
+			},
+			want: want{
+				manifests: "---\nkind: Service\n\n",
+				rationale: map[string]string{"service": "Because."},
+			},
+		},
+		"UnclosedRationale": {
+			reason: "An unclosed rationale should return an error.",
+			args: args{
+				resp: "---\nkind: Service\n<rationale>\nservice: Because.",
+			},
+			want: want{
+				manifests: "---\nkind: Service\n<rationale>\nservice: Because.",
+				err:       cmpopts.AnyError,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			manifests, rationale, err := splitRationale(tc.args.resp)
+
+			if diff := cmp.Diff(tc.want.manifests, manifests); diff != "" {
+				t.Errorf("%s\nsplitRationale(...): -want manifests, +got manifests:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.rationale, rationale); diff != "" {
+				t.Errorf("%s\nsplitRationale(...): -want rationale, +got rationale:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nsplitRationale(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+type mockAgentInvoker struct {
+	InvokeFn func(ctx context.Context, key, system, prompt, modelName string) (string, error)
+
+	// InvokeWithOptionsFn is called instead of InvokeFn if set.
+	InvokeWithOptionsFn func(ctx context.Context, key, system, prompt, modelName string, o invokeOptions) (string, error)
+}
+
+func (m *mockAgentInvoker) Invoke(ctx context.Context, key, system, prompt, modelName string, opts ...invokeOption) (string, error) {
+	if m.InvokeWithOptionsFn != nil {
+		return m.InvokeWithOptionsFn(ctx, key, system, prompt, modelName, newInvokeOptions(opts...))
+	}
+	return m.InvokeFn(ctx, key, system, prompt, modelName)
+}
+
+func TestParseTemplate(t *testing.T) {
+	type want struct {
+		err string
+	}
+
+	cases := map[string]struct {
+		reason string
+		text   string
+		want   want
+	}{
+		"Valid": {
+			reason: "A valid template should parse.",
+			text:   "Region: {{ .Composite.Object.spec.region | default \"us-east-1\" }}",
+		},
+		"UndefinedFunction": {
+			reason: "Parse errors should include the line and column of the action that caused them.",
+			text:   "Composite:\n{{ .Composite }} and {{ nope .Composite }}",
+			want:   want{err: `line 2, column 22: function "nope" not defined`},
+		},
+		"UnexpectedEnd": {
+			reason: "Parse errors should point at an unexpected end action.",
+			text:   "{{ .Composite }}\n  {{ end }}",
+			want:   want{err: "line 2, column 3: unexpected {{end}}"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseTemplate("prompt", tc.text, templateFuncs())
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if diff := cmp.Diff(tc.want.err, got); diff != "" {
+				t.Errorf("%s\nparseTemplate(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	req := &fnv1.RunFunctionRequest{
+		Observed: &fnv1.State{
+			Composite: &fnv1.Resource{Resource: resource.MustStructJSON(`{
+				"metadata": {"name": "my-xr", "managedFields": [{"manager": "crossplane"}]},
+				"spec": {"parameters": {"region": "eu-west-1"}}
+			}`)},
+			Resources: map[string]*fnv1.Resource{
+				"b": {Resource: resource.MustStructJSON(`{"kind": "Bucket", "metadata": {"name": "b"}}`)},
+				"a": {Resource: resource.MustStructJSON(`{"kind": "Bucket", "metadata": {"name": "a"}}`)},
+				"q": {Resource: resource.MustStructJSON(`{"kind": "Queue", "metadata": {"name": "q"}}`)},
+			},
+		},
+	}
+	vars, err := compositionVariables(req, "", nil, resourceFilters{})
+	if err != nil {
+		t.Fatalf("compositionVariables(...): %v", err)
+	}
+
+	cases := map[string]struct {
+		reason string
+		text   string
+		want   string
+	}{
+		"Gjson": {
+			reason: "gjson should look up a path of a resource.",
+			text:   `{{ .Composite | gjson "spec.parameters.region" }}`,
+			want:   "eu-west-1",
+		},
+		"StripManagedFields": {
+			reason: "stripManagedFields should remove metadata.managedFields.",
+			text:   `{{ .Composite | stripManagedFields | toYaml }}`,
+			want:   "metadata:\n  name: my-xr\nspec:\n  parameters:\n    region: eu-west-1",
+		},
+		"ComposedByKind": {
+			reason: "composedByKind should return composed resources of a kind, sorted by name.",
+			text:   `{{ range (composedByKind "Bucket" .Composed).Object }}{{ .metadata.name }} {{ end }}`,
+			want:   "a b ",
+		},
+		"GetResource": {
+			reason: "getResource should return a composed resource by name.",
+			text:   `{{ (getResource .Composed "q").Object.kind }}`,
+			want:   "Queue",
+		},
+		"GetResourceOfMissingResource": {
+			reason: "getResource should return nothing rather than panic when passed a missing resource.",
+			text:   `{{ getResource (getResource .Composed "missing") "q" }}`,
+			want:   "",
+		},
+		"TruncateTokens": {
+			reason: "truncateTokens should truncate text to approximately a number of tokens.",
+			text:   `{{ "The quick brown fox jumps" | truncateTokens 3 }}`,
+			want:   "The quick...",
+		},
+		"Sprig": {
+			reason: "Sprig functions should be available.",
+			text:   `{{ .Composite.Object.spec.missing | default "none" | upper | indent 2 }}`,
+			want:   "  NONE",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			tmpl, err := parseTemplate("prompt", tc.text, templateFuncs())
+			if err != nil {
+				t.Fatalf("%s\nparseTemplate(...): %v", tc.reason, err)
+			}
+			b := &strings.Builder{}
+			if err := tmpl.Execute(b, vars); err != nil {
+				t.Fatalf("%s\nExecute(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, b.String()); diff != "" {
+				t.Errorf("%s\nExecute(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestSanitizer(t *testing.T) {
+	type want struct {
+		obj map[string]any
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		cfg    *v1alpha1.Sanitize
+		obj    map[string]any
+		want   want
+	}{
+		"DefaultNoise": {
+			reason: "We should remove status, API server managed metadata, and the last applied configuration by default.",
+			cfg:    &v1alpha1.Sanitize{Enabled: true},
+			obj: map[string]any{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata": map[string]any{
+					"name":            "cool",
+					"resourceVersion": "42",
+					"annotations": map[string]any{
+						"kubectl.kubernetes.io/last-applied-configuration": "{}",
+						"example.org/keep": "yes",
+					},
+				},
+				"data":   map[string]any{"a": "b"},
+				"status": map[string]any{"ready": true},
+			},
+			want: want{
+				obj: map[string]any{
+					"apiVersion": "v1",
+					"kind":       "ConfigMap",
+					"metadata": map[string]any{
+						"name":        "cool",
+						"annotations": map[string]any{"example.org/keep": "yes"},
+					},
+					"data": map[string]any{"a": "b"},
+				},
+			},
+		},
+		"KeepStatus": {
+			reason: "We should keep status if asked to.",
+			cfg:    &v1alpha1.Sanitize{Enabled: true, KeepStatus: true},
+			obj: map[string]any{
+				"kind":   "ConfigMap",
+				"status": map[string]any{"ready": true},
+			},
+			want: want{
+				obj: map[string]any{
+					"kind":   "ConfigMap",
+					"status": map[string]any{"ready": true},
+				},
+			},
+		},
+		"Include": {
+			reason: "We should keep only included paths and the resource's identity for matching kinds.",
+			cfg: &v1alpha1.Sanitize{Enabled: true, Rules: []v1alpha1.SanitizeRule{
+				{Kind: "Bucket", Include: []string{"spec.forProvider.region"}},
+				{Kind: "Table", Include: []string{"spec"}},
+			}},
+			obj: map[string]any{
+				"apiVersion": "s3.aws.upbound.io/v1beta1",
+				"kind":       "Bucket",
+				"metadata":   map[string]any{"name": "cool", "labels": map[string]any{"a": "b"}},
+				"spec": map[string]any{
+					"forProvider":       map[string]any{"region": "us-east-1", "tags": map[string]any{"a": "b"}},
+					"providerConfigRef": map[string]any{"name": "default"},
+				},
+			},
+			want: want{
+				obj: map[string]any{
+					"apiVersion": "s3.aws.upbound.io/v1beta1",
+					"kind":       "Bucket",
+					"metadata":   map[string]any{"name": "cool"},
+					"spec": map[string]any{
+						"forProvider": map[string]any{"region": "us-east-1"},
+					},
+				},
+			},
+		},
+		"Exclude": {
+			reason: "We should remove excluded paths, including escaped annotation keys.",
+			cfg: &v1alpha1.Sanitize{Enabled: true, Rules: []v1alpha1.SanitizeRule{
+				{APIVersion: "v1", Exclude: []string{"data.big", `metadata.annotations.example\.org/note`}},
+			}},
+			obj: map[string]any{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"metadata":   map[string]any{"annotations": map[string]any{"example.org/note": "hi"}},
+				"data":       map[string]any{"big": "lots", "small": "little"},
+			},
+			want: want{
+				obj: map[string]any{
+					"apiVersion": "v1",
+					"kind":       "ConfigMap",
+					"metadata":   map[string]any{"annotations": map[string]any{}},
+					"data":       map[string]any{"small": "little"},
+				},
+			},
+		},
+		"MaxSize": {
+			reason: "We should remove the largest top level fields from resources that are too large, and say which.",
+			cfg:    &v1alpha1.Sanitize{Enabled: true, MaxSize: ptr(80)},
+			obj: map[string]any{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"data":       map[string]any{"big": strings.Repeat("x", 100)},
+				"binaryData": map[string]any{"small": "eA=="},
+			},
+			want: want{
+				obj: map[string]any{
+					"apiVersion": "v1",
+					"kind":       "ConfigMap",
+					"metadata":   map[string]any{"annotations": map[string]any{"claude.fn.upbound.io/omitted-fields": "data"}},
+					"binaryData": map[string]any{"small": "eA=="},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			s := newSanitizer(&v1alpha1.Prompt{Sanitize: tc.cfg})
+			got, err := s.Object(tc.obj)
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\ns.Object(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.obj, got); diff != "" {
+				t.Errorf("%s\ns.Object(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	type want struct {
+		obj      map[string]any
+		redacted int
+	}
+
+	cases := map[string]struct {
+		reason string
+		cfg    *v1alpha1.Redact
+		obj    map[string]any
+		want   want
+	}{
+		"Disabled": {
+			reason: "We should leave resources untouched if redaction is disabled.",
+			cfg:    &v1alpha1.Redact{Disabled: true},
+			obj:    map[string]any{"password": "hunter2"},
+			want:   want{obj: map[string]any{"password": "hunter2"}},
+		},
+		"SecretData": {
+			reason: "We should redact all Secret data.",
+			obj: map[string]any{
+				"apiVersion": "v1",
+				"kind":       "Secret",
+				"data":       map[string]any{"config": "Zm9v"},
+				"stringData": map[string]any{"other": "bar"},
+			},
+			want: want{
+				obj: map[string]any{
+					"apiVersion": "v1",
+					"kind":       "Secret",
+					"data":       map[string]any{"config": "<redacted>"},
+					"stringData": map[string]any{"other": "<redacted>"},
+				},
+				redacted: 2,
+			},
+		},
+		"SensitiveKeys": {
+			reason: "We should redact string values with sensitive keys, and environment variables with sensitive names.",
+			obj: map[string]any{
+				"spec": map[string]any{
+					"adminPassword": "hunter2",
+					"replicas":      float64(3),
+					"env": []any{
+						map[string]any{"name": "GITHUB_TOKEN", "value": "ghp_abc"},
+						map[string]any{"name": "LOG_LEVEL", "value": "debug"},
+					},
+				},
+			},
+			want: want{
+				obj: map[string]any{
+					"spec": map[string]any{
+						"adminPassword": "<redacted>",
+						"replicas":      float64(3),
+						"env": []any{
+							map[string]any{"name": "GITHUB_TOKEN", "value": "<redacted>"},
+							map[string]any{"name": "LOG_LEVEL", "value": "debug"},
+						},
+					},
+				},
+				redacted: 2,
+			},
+		},
+		"ReferencesToSecrets": {
+			reason: "We should not redact values whose keys name or reference secrets rather than hold them.",
+			obj: map[string]any{
+				"spec": map[string]any{
+					"secretName":      "db-conn",
+					"keyName":         "primary",
+					"tokenTTL":        "1h",
+					"secretKey":       "password",
+					"credentialsFile": "/etc/creds",
+				},
+			},
+			want: want{
+				obj: map[string]any{
+					"spec": map[string]any{
+						"secretName":      "db-conn",
+						"keyName":         "primary",
+						"tokenTTL":        "1h",
+						"secretKey":       "password",
+						"credentialsFile": "/etc/creds",
+					},
+				},
+			},
+		},
+		"PathsAndPatterns": {
+			reason: "We should redact values at configured paths and with keys matching configured patterns.",
+			cfg: &v1alpha1.Redact{
+				KeyPatterns: []string{"^dsn$"},
+				Paths:       []string{"spec.connection"},
+			},
+			obj: map[string]any{
+				"spec": map[string]any{
+					"dsn":        "postgres://u:p@db",
+					"connection": map[string]any{"host": "db", "port": float64(5432)},
+				},
+			},
+			want: want{
+				obj: map[string]any{
+					"spec": map[string]any{
+						"dsn":        "<redacted>",
+						"connection": map[string]any{"host": "<redacted>", "port": float64(5432)},
+					},
+				},
+				redacted: 2,
+			},
+		},
+	}
+
+	placeholders := cmp.Transformer("Placeholders", func(s string) string {
+		if strings.HasPrefix(s, placeholderPrefix) {
+			return "<redacted>"
+		}
+		return s
+	})
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r, err := newRedactor(&v1alpha1.Prompt{Redact: tc.cfg})
+			if err != nil {
+				t.Fatalf("newRedactor(...): %v", err)
+			}
+			got, err := r.Object(tc.obj)
+			if err != nil {
+				t.Fatalf("r.Object(...): %v", err)
+			}
+			if diff := cmp.Diff(tc.want.obj, got, placeholders); diff != "" {
+				t.Errorf("%s\nr.Object(...): -want, +got:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.redacted, r.Redacted()); diff != "" {
+				t.Errorf("%s\nr.Redacted(): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRedactorContext(t *testing.T) {
+	r, err := newRedactor(&v1alpha1.Prompt{})
+	if err != nil {
+		t.Fatalf("newRedactor(...): %v", err)
+	}
+	got := r.Context(map[string]any{
+		"env":      "prod",
+		"database": map[string]any{"host": "db", "adminPassword": "hunter2"},
+	})
+	want := map[string]any{
+		"env":      "prod",
+		"database": map[string]any{"host": "db", "adminPassword": "<redacted>"},
+	}
+	placeholders := cmp.Transformer("Placeholders", func(s string) string {
+		if strings.HasPrefix(s, placeholderPrefix) {
+			return "<redacted>"
+		}
+		return s
+	})
+	if diff := cmp.Diff(want, got, placeholders); diff != "" {
+		t.Errorf("r.Context(...): -want, +got:\n%s", diff)
+	}
+}
+
+func TestRedactorRestore(t *testing.T) {
+	secret := func() map[string]any {
+		return map[string]any{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata":   map[string]any{"name": "db", "namespace": "default"},
+			"data":       map[string]any{"password": "aHVudGVyMg=="},
+		}
+	}
+
+	type want struct {
+		obj map[string]any
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		obj    func(ph string) map[string]any
+		want   want
+	}{
+		"SameResourceAndPath": {
+			reason: "We should restore a placeholder at the path of the resource it was redacted from.",
+			obj: func(ph string) map[string]any {
+				return map[string]any{
+					"apiVersion": "v1",
+					"kind":       "Secret",
+					"metadata":   map[string]any{"name": "db", "namespace": "default"},
+					"data":       map[string]any{"password": ph},
+				}
+			},
+			want: want{obj: secret()},
+		},
+		"UnnamedResource": {
+			reason: "We should restore a placeholder in a resource that doesn't specify its name, like a composed resource.",
+			obj: func(ph string) map[string]any {
+				return map[string]any{
+					"apiVersion": "v1",
+					"kind":       "Secret",
+					"data":       map[string]any{"password": ph},
+				}
+			},
+			want: want{obj: map[string]any{
+				"apiVersion": "v1",
+				"kind":       "Secret",
+				"data":       map[string]any{"password": "aHVudGVyMg=="},
+			}},
+		},
+		"DifferentPath": {
+			reason: "We should not restore a placeholder that was moved to a different path.",
+			obj: func(ph string) map[string]any {
+				return map[string]any{
+					"apiVersion": "v1",
+					"kind":       "Secret",
+					"metadata":   map[string]any{"name": "db", "namespace": "default", "annotations": map[string]any{"leak": ph}},
+				}
+			},
+			want: want{err: cmpopts.AnyError},
+		},
+		"DifferentResource": {
+			reason: "We should not restore a placeholder that was moved to a different resource.",
+			obj: func(ph string) map[string]any {
+				return map[string]any{
+					"apiVersion": "v1",
+					"kind":       "ConfigMap",
+					"metadata":   map[string]any{"name": "db", "namespace": "default"},
+					"data":       map[string]any{"password": ph},
+				}
+			},
+			want: want{err: cmpopts.AnyError},
+		},
 	}
 
 	for name, tc := range cases {
 		t.Run(name, func(t *testing.T) {
-			f := &Function{log: logging.NewNopLogger()}
-			got, cleaned, err := f.resourceFrom(tc.args.resp)
+			r, err := newRedactor(&v1alpha1.Prompt{})
+			if err != nil {
+				t.Fatalf("newRedactor(...): %v", err)
+			}
+			redacted, err := r.Object(secret())
+			if err != nil {
+				t.Fatalf("r.Object(...): %v", err)
+			}
+			ph := redacted["data"].(map[string]any)["password"].(string)
 
+			obj, err := structpb.NewStruct(tc.obj(ph))
+			if err != nil {
+				t.Fatalf("structpb.NewStruct(...): %v", err)
+			}
+			rs := map[string]*fnv1.Resource{"db": {Resource: obj}}
+			err = r.Restore(rs)
 			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
-				t.Errorf("%s\nf.resourceFrom(...): -want err, +got err:\n%s", tc.reason, diff)
+				t.Errorf("%s\nr.Restore(...): -want error, +got error:\n%s", tc.reason, diff)
 			}
-
-			if diff := cmp.Diff(tc.want.resource, got, protocmp.Transform()); diff != "" {
-				t.Errorf("%s\nf.resourceFrom(...): -want resource, +got resource:\n%s", tc.reason, diff)
+			if tc.want.err != nil {
+				return
 			}
-
-			// Only check cleaned string if test case specifies an expected value
-			if tc.want.cleaned != "" {
-				if cleaned != tc.want.cleaned {
-					t.Errorf("%s\nf.resourceFrom(...): -want cleaned, +got cleaned:\nwant: %q\ngot:  %q", tc.reason, tc.want.cleaned, cleaned)
-				}
+			if diff := cmp.Diff(tc.want.obj, rs["db"].GetResource().AsMap()); diff != "" {
+				t.Errorf("%s\nr.Restore(...): -want, +got:\n%s", tc.reason, diff)
 			}
 		})
 	}
 }
 
-func TestExtractJSONFromAgentError(t *testing.T) {
+func TestRouteModel(t *testing.T) {
 	type args struct {
-		err error
-	}
-	type want struct {
-		extracted string
-		ok        bool
+		in        *v1alpha1.Prompt
+		tokens    int
+		unchanged bool
 	}
 
 	cases := map[string]struct {
 		reason string
 		args   args
-		want   want
+		want   []string
 	}{
-		"NilError": {
-			reason: "Should return false for nil error",
-			args: args{
-				err: nil,
-			},
-			want: want{
-				extracted: "",
-				ok:        false,
-			},
+		"ModelName": {
+			reason: "We should use the model name if no models or routes are configured.",
+			args:   args{in: &v1alpha1.Prompt{ModelName: "claude-sonnet-4-5"}},
+			want:   []string{"claude-sonnet-4-5"},
 		},
-		"UnrelatedError": {
-			reason: "Should return false for unrelated errors",
+		"DefaultModel": {
+			reason: "We should use the default model if nothing is configured.",
+			args:   args{in: &v1alpha1.Prompt{}},
+			want:   []string{""},
+		},
+		"SmallPrompt": {
+			reason: "We should try the routed model first if the prompt is small enough.",
 			args: args{
-				err: errors.New("some other error"),
-			},
-			want: want{
-				extracted: "",
-				ok:        false,
+				in: &v1alpha1.Prompt{
+					Models:      []string{"claude-opus-4-1", "claude-haiku-4-5"},
+					ModelRoutes: []v1alpha1.ModelRoute{{Model: "claude-haiku-4-5", MaxPromptTokens: ptr(1000)}},
+				},
+				tokens: 500,
 			},
+			want: []string{"claude-haiku-4-5", "claude-opus-4-1"},
 		},
-		"AgentErrorWithJSON": {
-			reason: "Should extract clean JSON from agent parsing error",
+		"LargePrompt": {
+			reason: "We should not use a route if the prompt is too large.",
 			args: args{
-				err: errors.New("unable to parse agent output: {\"apiVersion\": \"v1\", \"kind\": \"Test\"}"),
-			},
-			want: want{
-				extracted: "{\"apiVersion\": \"v1\", \"kind\": \"Test\"}",
-				ok:        true,
+				in: &v1alpha1.Prompt{
+					Models:      []string{"claude-opus-4-1"},
+					ModelRoutes: []v1alpha1.ModelRoute{{Model: "claude-haiku-4-5", MaxPromptTokens: ptr(1000)}},
+				},
+				tokens: 5000,
 			},
+			want: []string{"claude-opus-4-1"},
 		},
-		"AgentErrorWithMarkdownJSON": {
-			reason: "Should extract and strip markdown from agent error",
+		"SpecChanged": {
+			reason: "We should not use a route that requires the spec to be unchanged if it changed.",
 			args: args{
-				err: errors.New("unable to parse agent output: ```json\n{\"apiVersion\": \"v1\"}\n```"),
-			},
-			want: want{
-				extracted: "{\"apiVersion\": \"v1\"}",
-				ok:        true,
+				in: &v1alpha1.Prompt{
+					ModelName:   "claude-opus-4-1",
+					ModelRoutes: []v1alpha1.ModelRoute{{Model: "claude-haiku-4-5", SpecUnchanged: true}},
+				},
 			},
+			want: []string{"claude-opus-4-1"},
 		},
-		"AgentErrorWithMarkdownYAML": {
-			reason: "Should extract and strip markdown YAML blocks",
+		"SpecUnchanged": {
+			reason: "We should use a route that requires the spec to be unchanged if it's unchanged.",
 			args: args{
-				err: errors.New("unable to parse agent output: ```yaml\napiVersion: v1\n```"),
-			},
-			want: want{
-				extracted: "apiVersion: v1",
-				ok:        true,
+				in: &v1alpha1.Prompt{
+					ModelName:   "claude-opus-4-1",
+					ModelRoutes: []v1alpha1.ModelRoute{{Model: "claude-haiku-4-5", SpecUnchanged: true}},
+				},
+				unchanged: true,
 			},
+			want: []string{"claude-haiku-4-5", "claude-opus-4-1"},
 		},
-		"AgentErrorWithGenericMarkdown": {
-			reason: "Should extract and strip generic markdown blocks",
-			args: args{
-				err: errors.New("unable to parse agent output: ```\n{\"test\": true}\n```"),
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := modelChain(tc.args.in, routeModel(tc.args.in.ModelRoutes, tc.args.tokens, tc.args.unchanged))
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nmodelChain(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestFallbackCondition(t *testing.T) {
+	type want struct {
+		c  v1alpha1.FallbackCondition
+		ok bool
+	}
+
+	cases := map[string]struct {
+		reason string
+		err    error
+		want   want
+	}{
+		"Overloaded": {
+			reason: "We should identify overloaded errors.",
+			err:    errors.New("API returned unexpected status code: 529: Overloaded"),
+			want:   want{c: v1alpha1.FallbackOnOverloaded, ok: true},
+		},
+		"RateLimited": {
+			reason: "We should identify rate limit errors.",
+			err:    errors.New("API returned unexpected status code: 429: Number of request tokens has exceeded your per-minute rate limit"),
+			want:   want{c: v1alpha1.FallbackOnRateLimited, ok: true},
+		},
+		"ContextTooLong": {
+			reason: "We should identify errors caused by prompts that exceed the context window.",
+			err:    errors.New("API returned unexpected status code: 400: prompt is too long: 215000 tokens > 200000 maximum"),
+			want:   want{c: v1alpha1.FallbackOnContextTooLong, ok: true},
+		},
+		"Other": {
+			reason: "We should not identify other errors.",
+			err:    errors.New("API returned unexpected status code: 401: invalid x-api-key"),
+			want:   want{},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			c, ok := fallbackCondition(tc.err)
+			if diff := cmp.Diff(tc.want, want{c: c, ok: ok}, cmp.AllowUnexported(want{})); diff != "" {
+				t.Errorf("%s\nfallbackCondition(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestPresetSystemPrompt(t *testing.T) {
+	lib, err := loadPromptLibrary(nil, nil)
+	if err != nil {
+		t.Fatalf("loadPromptLibrary(...): %v", err)
+	}
+	operator := strings.TrimRight(lib["krm-operator-v1"], "\n")
+	patches := strings.TrimRight(lib["krm-patches-v1"], "\n")
+
+	cases := map[string]struct {
+		reason string
+		in     *v1alpha1.Prompt
+		want   string
+	}{
+		"Compose": {
+			reason: "We should build the krm-compose system prompt from the krm-system-v1 fragment.",
+			in:     &v1alpha1.Prompt{Preset: "krm-compose/v1"},
+			want:   strings.TrimRight(lib["krm-system-v1"], "\n"),
+		},
+		"Operate": {
+			reason: "We should ask for server-side apply patches when the operation returns manifests.",
+			in:     &v1alpha1.Prompt{Preset: "krm-operate/v1"},
+			want:   operator + "\n\n" + patches,
+		},
+		"OperateReport": {
+			reason: "We should not ask for manifests in report mode, which asks for findings instead.",
+			in:     &v1alpha1.Prompt{Preset: "krm-operate/v1", Report: &v1alpha1.Report{Enabled: true}},
+			want:   operator,
+		},
+		"OperatePlaybook": {
+			reason: "We should not ask for manifests when a playbook asks for actions instead.",
+			in:     &v1alpha1.Prompt{Preset: "krm-operate/v1", Playbook: &v1alpha1.Playbook{Actions: []v1alpha1.Action{{Name: "restart"}}}},
+			want:   operator,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got, err := lib.systemPrompt(tc.in)
+			if err != nil {
+				t.Fatalf("%s\nlib.systemPrompt(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nlib.systemPrompt(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestSpecFingerprint(t *testing.T) {
+	xr := &fnv1.Resource{Resource: resource.MustStructJSON(`{"spec":{"replicas":3}}`)}
+	in := func() *v1alpha1.Prompt {
+		return &v1alpha1.Prompt{
+			SystemPromptRef: &v1alpha1.PromptRef{Name: "rules"},
+			UserPrompt:      "I'm a user",
+		}
+	}
+	lib := func() promptLibrary { return promptLibrary{"rules": "Be concise."} }
+	temperature := "0.5"
+
+	base, err := specFingerprint(xr, in(), lib())
+	if err != nil {
+		t.Fatalf("specFingerprint(...): %v", err)
+	}
+
+	cases := map[string]struct {
+		reason string
+		xr     *fnv1.Resource
+		in     func(in *v1alpha1.Prompt)
+		lib    func(lib promptLibrary)
+		same   bool
+	}{
+		"Unchanged": {
+			reason: "The fingerprint should be stable when nothing changes.",
+			same:   true,
+		},
+		"Spec": {
+			reason: "Changing the XR's spec should change the fingerprint.",
+			xr:     &fnv1.Resource{Resource: resource.MustStructJSON(`{"spec":{"replicas":4}}`)},
+		},
+		"GenerationParameters": {
+			reason: "Changing generation parameters should change the fingerprint.",
+			in:     func(in *v1alpha1.Prompt) { in.Temperature = &temperature },
+		},
+		"Models": {
+			reason: "Changing the models should change the fingerprint.",
+			in:     func(in *v1alpha1.Prompt) { in.Models = []string{"claude-opus-4-1"} },
+		},
+		"Redaction": {
+			reason: "Changing redaction should change the fingerprint.",
+			in:     func(in *v1alpha1.Prompt) { in.Redact = &v1alpha1.Redact{Disabled: true} },
+		},
+		"SystemPromptFragment": {
+			reason: "Changing the content of the system prompt's fragment should change the fingerprint.",
+			lib:    func(lib promptLibrary) { lib["rules"] = "Be verbose." },
+		},
+		"IncludedFragment": {
+			reason: "Changing the content of a fragment the user prompt could include should change the fingerprint.",
+			lib:    func(lib promptLibrary) { lib["naming"] = "Name things well." },
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			x, i, l := xr, in(), lib()
+			if tc.xr != nil {
+				x = tc.xr
+			}
+			if tc.in != nil {
+				tc.in(i)
+			}
+			if tc.lib != nil {
+				tc.lib(l)
+			}
+			got, err := specFingerprint(x, i, l)
+			if err != nil {
+				t.Fatalf("%s\nspecFingerprint(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.same, got == base); diff != "" {
+				t.Errorf("%s\nspecFingerprint(...) unchanged: -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestProposalAnnotations(t *testing.T) {
+	outputs := structpb.NewStructValue(&structpb.Struct{Fields: map[string]*structpb.Value{"tier": structpb.NewStringValue("large")}})
+
+	cases := map[string]struct {
+		reason   string
+		observed map[string]string
+		p        proposal
+		approved bool
+		want     map[string]string
+	}{
+		"AwaitingApproval": {
+			reason: "We should keep the spec fingerprint and context outputs recorded with the observed composed resources until the proposal is approved.",
+			observed: map[string]string{
+				annotationSpecFingerprint: "old",
+				annotationContextOutputs:  `{"tier":"small"}`,
 			},
-			want: want{
-				extracted: "{\"test\": true}",
-				ok:        true,
+			p: proposal{ContextOutputs: outputs},
+			want: map[string]string{
+				annotationProposalHash:        "hash",
+				annotationProposalFingerprint: "new",
+				annotationProposal:            "blob",
+				annotationSpecFingerprint:     "old",
+				annotationContextOutputs:      `{"tier":"small"}`,
 			},
 		},
-		"AgentErrorWithWhitespace": {
-			reason: "Should trim whitespace from extracted content",
-			args: args{
-				err: errors.New("unable to parse agent output:   \n{\"test\": true}\n  "),
-			},
-			want: want{
-				extracted: "{\"test\": true}",
-				ok:        true,
+		"NeverComposed": {
+			reason: "We should not record a spec fingerprint or context outputs before any proposal is approved.",
+			p:      proposal{ContextOutputs: outputs},
+			want: map[string]string{
+				annotationProposalHash:        "hash",
+				annotationProposalFingerprint: "new",
+				annotationProposal:            "blob",
 			},
 		},
-		"WrappedAgentError": {
-			reason: "Should extract even if error message is wrapped (makes it more robust)",
-			args: args{
-				err: errors.New("failed to run: unable to parse agent output: {\"test\": true}"),
+		"Approved": {
+			reason: "We should record the proposal's fingerprint and context outputs once the proposal is approved.",
+			observed: map[string]string{
+				annotationSpecFingerprint: "old",
+				annotationContextOutputs:  `{"tier":"small"}`,
 			},
-			want: want{
-				extracted: "{\"test\": true}",
-				ok:        true,
+			p:        proposal{ContextOutputs: outputs},
+			approved: true,
+			want: map[string]string{
+				annotationProposalHash:        "hash",
+				annotationProposalFingerprint: "new",
+				annotationProposal:            "blob",
+				annotationSpecFingerprint:     "new",
+				annotationContextOutputs:      `{"tier":"large"}`,
 			},
 		},
 	}
 
 	for name, tc := range cases {
 		t.Run(name, func(t *testing.T) {
-			extracted, ok := extractJSONFromAgentError(tc.args.err)
+			got, err := proposalAnnotations(tc.observed, tc.p, "hash", "new", "blob", tc.approved)
+			if err != nil {
+				t.Fatalf("%s\nproposalAnnotations(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nproposalAnnotations(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
 
-			if ok != tc.want.ok {
-				t.Errorf("%s\nextractJSONFromAgentError(...): got ok=%v, want ok=%v", tc.reason, ok, tc.want.ok)
+func TestEncodeProposal(t *testing.T) {
+	// Hashes are incompressible enough to defeat gzip.
+	random := func(size int) string {
+		b := &strings.Builder{}
+		sum := sha256.Sum256(nil)
+		for b.Len() < size {
+			sum = sha256.Sum256(sum[:])
+			b.WriteString(hex.EncodeToString(sum[:]))
+		}
+		return b.String()
+	}
+	cm := func(data string) proposal {
+		return proposal{Resources: map[string]*fnv1.Resource{
+			"configmap": {Resource: resource.MustStructObject(&unstructured.Unstructured{Object: map[string]any{
+				"apiVersion": "v1",
+				"kind":       "ConfigMap",
+				"data":       map[string]any{"data": data},
+			}})},
+		}}
+	}
+
+	cases := map[string]struct {
+		reason  string
+		p       proposal
+		wantErr bool
+	}{
+		"Small": {
+			reason: "We should encode a proposal that fits in an annotation.",
+			p:      cm("small"),
+		},
+		"TooLarge": {
+			reason:  "We should return an error if the encoded proposal doesn't fit in an annotation.",
+			p:       cm(random(2 * maxProposalSize)),
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			hash, blob, err := encodeProposal(tc.p)
+			if diff := cmp.Diff(tc.wantErr, err != nil); diff != "" {
+				t.Fatalf("%s\nencodeProposal(...): -want error, +got error:\n%s\n%v", tc.reason, diff, err)
 			}
+			if tc.wantErr {
+				return
+			}
+			got, err := decodeProposal(hash, blob)
+			if err != nil {
+				t.Fatalf("%s\ndecodeProposal(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.p, got, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\ndecodeProposal(encodeProposal(...)): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
 
-			if extracted != tc.want.extracted {
-				t.Errorf("%s\nextractJSONFromAgentError(...): got extracted=%q, want extracted=%q", tc.reason, extracted, tc.want.extracted)
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)
+	cooldown := &v1alpha1.RateLimit{Cooldown: &metav1.Duration{Duration: 5 * time.Minute}}
+	one := 1
+	perMinute := &v1alpha1.RateLimit{MaxCallsPerMinute: &one}
+
+	type call struct {
+		key     string
+		rl      *v1alpha1.RateLimit
+		uid     string
+		at      time.Time
+		release bool
+	}
+	type want struct {
+		ok     bool
+		reason string
+	}
+
+	cases := map[string]struct {
+		reason string
+		calls  []call
+		check  call
+		want   want
+	}{
+		"NoRateLimit": {
+			reason: "We should allow every invocation without a rate limit.",
+			calls:  []call{{key: "p", uid: "a", at: now}},
+			check:  call{key: "p", uid: "a", at: now},
+			want:   want{ok: true},
+		},
+		"CoolingDown": {
+			reason: "We should not allow an invocation for a watched resource that is cooling down.",
+			calls:  []call{{key: "p", rl: cooldown, uid: "a", at: now}},
+			check:  call{key: "p", rl: cooldown, uid: "a", at: now.Add(time.Minute)},
+			want:   want{reason: "watched resource is cooling down for another 4m0s"},
+		},
+		"CooledDown": {
+			reason: "We should allow an invocation for a watched resource once its cooldown has passed.",
+			calls:  []call{{key: "p", rl: cooldown, uid: "a", at: now}},
+			check:  call{key: "p", rl: cooldown, uid: "a", at: now.Add(5 * time.Minute)},
+			want:   want{ok: true},
+		},
+		"FailedInvocation": {
+			reason: "We should not start a cooldown for an invocation whose reservation was released because it failed.",
+			calls:  []call{{key: "p", rl: cooldown, uid: "a", at: now, release: true}},
+			check:  call{key: "p", rl: cooldown, uid: "a", at: now.Add(time.Minute)},
+			want:   want{ok: true},
+		},
+		"OtherWatchedResource": {
+			reason: "We should allow an invocation for a watched resource other than the one cooling down.",
+			calls:  []call{{key: "p", rl: cooldown, uid: "a", at: now}},
+			check:  call{key: "p", rl: cooldown, uid: "b", at: now.Add(time.Minute)},
+			want:   want{ok: true},
+		},
+		"CallsPerMinuteReached": {
+			reason: "We should not allow more invocations per minute than the limit, counting reservations that weren't released.",
+			calls:  []call{{key: "p", rl: perMinute, at: now}},
+			check:  call{key: "p", rl: perMinute, at: now.Add(30 * time.Second)},
+			want:   want{reason: "limit of 1 calls per minute reached"},
+		},
+		"CallsPerMinuteReleased": {
+			reason: "We should not count invocations whose reservation was released towards the limit.",
+			calls:  []call{{key: "p", rl: perMinute, at: now, release: true}},
+			check:  call{key: "p", rl: perMinute, at: now.Add(30 * time.Second)},
+			want:   want{ok: true},
+		},
+		"CallsPerMinuteOtherPrompt": {
+			reason: "We should not count another Prompt's invocations towards the limit.",
+			calls:  []call{{key: "other", rl: perMinute, at: now}},
+			check:  call{key: "p", rl: perMinute, at: now.Add(30 * time.Second)},
+			want:   want{ok: true},
+		},
+		"CallsPerMinuteElapsed": {
+			reason: "We should forget invocations that are more than a minute old.",
+			calls:  []call{{key: "p", rl: perMinute, at: now}},
+			check:  call{key: "p", rl: perMinute, at: now.Add(time.Minute)},
+			want:   want{ok: true},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			l := &rateLimiter{}
+			for _, c := range tc.calls {
+				if release, ok, _ := l.Reserve(c.key, c.rl, c.uid, time.Time{}, c.at); ok && c.release {
+					release()
+				}
+			}
+			_, ok, reason := l.Reserve(tc.check.key, tc.check.rl, tc.check.uid, time.Time{}, tc.check.at)
+			if diff := cmp.Diff(tc.want, want{ok: ok, reason: reason}, cmp.AllowUnexported(want{})); diff != "" {
+				t.Errorf("%s\nl.Reserve(...): -want, +got:\n%s", tc.reason, diff)
 			}
 		})
 	}
 }
 
-type mockAgentInvoker struct {
-	InvokeFn func(ctx context.Context, key, system, prompt, modelName string) (string, error)
+func TestRateLimiterPrune(t *testing.T) {
+	now := time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)
+	ten := 10
+	long := &v1alpha1.RateLimit{Cooldown: &metav1.Duration{Duration: 10 * time.Minute}, MaxCallsPerMinute: &ten}
+	short := &v1alpha1.RateLimit{Cooldown: &metav1.Duration{Duration: time.Minute}}
+
+	l := &rateLimiter{}
+	l.Reserve("long", long, "a", time.Time{}, now)
+	l.Reserve("short", short, "b", time.Time{}, now)
+
+	// A Prompt without a cooldown must not prune other Prompts' cooldowns.
+	l.Reserve("none", &v1alpha1.RateLimit{}, "c", time.Time{}, now.Add(2*time.Minute))
+
+	if diff := cmp.Diff(map[string]time.Time{"long/a": now.Add(10 * time.Minute)}, l.cooling); diff != "" {
+		t.Errorf("l.cooling: -want, +got:\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string][]time.Time{"none": {now.Add(2 * time.Minute)}}, l.calls); diff != "" {
+		t.Errorf("l.calls: -want, +got:\n%s", diff)
+	}
 }
 
-func (m *mockAgentInvoker) Invoke(ctx context.Context, key, system, prompt, modelName string) (string, error) {
-	return m.InvokeFn(ctx, key, system, prompt, modelName)
+func TestRecentEvents(t *testing.T) {
+	event := func(name, last string) resource.Required {
+		return resource.Required{Resource: &unstructured.Unstructured{Object: map[string]any{
+			"metadata":      map[string]any{"name": name},
+			"lastTimestamp": last,
+		}}}
+	}
+	names := func(events []resource.Required) []string {
+		out := make([]string, 0, len(events))
+		for _, e := range events {
+			out = append(out, e.Resource.GetName())
+		}
+		return out
+	}
+
+	cases := map[string]struct {
+		reason string
+		events []resource.Required
+		limit  int
+		want   []string
+	}{
+		"UnderLimit": {
+			reason: "We should return every event, in order, if there are no more than the limit.",
+			events: []resource.Required{event("a", "2025-10-01T11:00:00Z"), event("b", "2025-10-01T12:00:00Z")},
+			limit:  2,
+			want:   []string{"a", "b"},
+		},
+		"OverLimit": {
+			reason: "We should return only the most recent events if there are more than the limit.",
+			events: []resource.Required{
+				event("a", "2025-10-01T11:00:00Z"),
+				event("b", "2025-10-01T12:00:00Z"),
+				event("c", "2025-10-01T10:00:00Z"),
+				event("d", "2025-10-01T11:30:00Z"),
+			},
+			limit: 2,
+			want:  []string{"b", "d"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := names(recentEvents(tc.events, tc.limit))
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\nrecentEvents(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestCacheBreakpoints(t *testing.T) {
+	ephemeral := &llms.CacheControl{Type: "ephemeral"}
+
+	cases := map[string]struct {
+		reason   string
+		parts    []llms.ContentPart
+		prefixes []string
+		want     []llms.ContentPart
+	}{
+		"NoPrefixes": {
+			reason: "We should return the parts unchanged if nothing is cacheable.",
+			parts:  []llms.ContentPart{llms.TextContent{Text: "system user"}},
+			want:   []llms.ContentPart{llms.TextContent{Text: "system user"}},
+		},
+		"Prefixes": {
+			reason:   "We should split the text after each cacheable prefix, and mark each prefix as cacheable.",
+			parts:    []llms.ContentPart{llms.TextContent{Text: "system static dynamic"}},
+			prefixes: []string{"system", " static"},
+			want: []llms.ContentPart{
+				llms.WithCacheControl(llms.TextContent{Text: "system"}, ephemeral),
+				llms.WithCacheControl(llms.TextContent{Text: " static"}, ephemeral),
+				llms.TextContent{Text: " dynamic"},
+			},
+		},
+		"MissingPrefix": {
+			reason:   "We should stop at the first prefix that doesn't follow the previous one.",
+			parts:    []llms.ContentPart{llms.TextContent{Text: "system user"}},
+			prefixes: []string{"system", "missing"},
+			want: []llms.ContentPart{
+				llms.WithCacheControl(llms.TextContent{Text: "system"}, ephemeral),
+				llms.TextContent{Text: " user"},
+			},
+		},
+		"TooManyPrefixes": {
+			reason:   "We should place at most four cache breakpoints.",
+			parts:    []llms.ContentPart{llms.TextContent{Text: "abcdef"}},
+			prefixes: []string{"a", "b", "c", "d", "e"},
+			want: []llms.ContentPart{
+				llms.WithCacheControl(llms.TextContent{Text: "a"}, ephemeral),
+				llms.WithCacheControl(llms.TextContent{Text: "b"}, ephemeral),
+				llms.WithCacheControl(llms.TextContent{Text: "c"}, ephemeral),
+				llms.WithCacheControl(llms.TextContent{Text: "d"}, ephemeral),
+				llms.TextContent{Text: "ef"},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := cacheBreakpoints(tc.parts, tc.prefixes)
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\ncacheBreakpoints(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
 }
@@ -0,0 +1,135 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/crossplane/function-sdk-go/errors"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+)
+
+// Generation parameter defaults and bounds. The bounds repeat the validation
+// markers of v1alpha1.Prompt, which aren't enforced on function input.
+const (
+	defaultTemperature   = 0.0
+	defaultMaxTokens     = 8192
+	defaultMaxIterations = 20
+
+	maxMaxTokens     = 64000
+	maxMaxIterations = 50
+	maxStopSequences = 8
+
+	minThinkingBudget = 1024
+)
+
+// withGeneration sets the supplied generation parameters.
+func withGeneration(temperature float64, maxTokens, maxIterations int, stop []string) invokeOption {
+	return func(o *invokeOptions) {
+		o.temperature = temperature
+		o.maxTokens = maxTokens
+		o.maxIterations = maxIterations
+		o.stopSequences = stop
+	}
+}
+
+// generationOption returns an invocation option that sets the generation
+// parameters, including extended thinking, of the supplied input. It returns
+// an error if a parameter is out of bounds.
+func generationOption(in *v1alpha1.Prompt) (invokeOption, error) {
+	temperature, err := generationTemperature(in.Temperature)
+	if err != nil {
+		return nil, err
+	}
+	maxTokens, err := boundedInt("maxTokens", in.MaxTokens, defaultMaxTokens, maxMaxTokens)
+	if err != nil {
+		return nil, err
+	}
+	maxIterations, err := boundedInt("maxIterations", in.MaxIterations, defaultMaxIterations, maxMaxIterations)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateStopSequences(in.StopSequences); err != nil {
+		return nil, err
+	}
+	thinkingBudget, err := thinkingBudgetTokens(in.Thinking, maxTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	gen := withGeneration(temperature, maxTokens, maxIterations, in.StopSequences)
+	return func(o *invokeOptions) {
+		gen(o)
+		o.thinkingBudget = thinkingBudget
+	}, nil
+}
+
+// generationTemperature returns the supplied temperature, or the default
+// temperature if it's nil.
+func generationTemperature(temperature *string) (float64, error) {
+	if temperature == nil {
+		return defaultTemperature, nil
+	}
+	t, err := strconv.ParseFloat(*temperature, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid temperature %q", *temperature)
+	}
+	if t < 0 || t > 1 {
+		return 0, errors.Errorf("temperature must be between 0 and 1, got %s", *temperature)
+	}
+	return t, nil
+}
+
+// boundedInt returns the supplied named parameter, or the supplied default if
+// it's nil. It returns an error if the parameter isn't between 1 and limit.
+func boundedInt(name string, v *int, def, limit int) (int, error) {
+	if v == nil {
+		return def, nil
+	}
+	if *v < 1 || *v > limit {
+		return 0, errors.Errorf("%s must be between 1 and %d, got %d", name, limit, *v)
+	}
+	return *v, nil
+}
+
+// validateStopSequences returns an error if there are too many stop
+// sequences, or any are empty.
+func validateStopSequences(stop []string) error {
+	if len(stop) > maxStopSequences {
+		return errors.Errorf("at most %d stopSequences are supported, got %d", maxStopSequences, len(stop))
+	}
+	for _, s := range stop {
+		if s == "" {
+			return errors.New("stopSequences must not be empty")
+		}
+	}
+	return nil
+}
+
+// thinkingBudgetTokens returns the budget of the supplied extended thinking
+// configuration, or zero if it's nil. The budget must be less than the
+// supplied maxTokens.
+func thinkingBudgetTokens(t *v1alpha1.Thinking, maxTokens int) (int, error) {
+	if t == nil {
+		return 0, nil
+	}
+	if t.BudgetTokens < minThinkingBudget || t.BudgetTokens >= maxTokens {
+		return 0, errors.Errorf("thinking budgetTokens must be at least %d and less than maxTokens (%d), got %d", minThinkingBudget, maxTokens, t.BudgetTokens)
+	}
+	return t.BudgetTokens, nil
+}
@@ -22,6 +22,7 @@ package v1alpha1
 
 import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // Prompt can be used to provide input to this Function.
@@ -32,13 +33,688 @@ type Prompt struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	// SytemPrompt to send to Claude.
-	SystemPrompt string `json:"systemPrompt"`
-	// UserPrompt to send to Claude.
+	// SytemPrompt to send to Claude. If SystemPromptRef is also specified
+	// this is appended to the referenced prompt fragment.
+	// +optional
+	SystemPrompt string `json:"systemPrompt,omitempty"`
+
+	// Preset is a built in, versioned prompt, e.g. krm-compose/v1 for
+	// composition pipelines or krm-operate/v1 for operation pipelines. A
+	// preset's system prompt describes the response the function expects.
+	// Its user prompt supplies the observed resources, and the UserPrompt
+	// is appended to it as the task to complete. Any SystemPromptRef and
+	// SystemPrompt are appended to the preset's system prompt.
+	// +optional
+	Preset string `json:"preset,omitempty"`
+
+	// SystemPromptRef references a prompt fragment to use as the system
+	// prompt. Fragments are loaded from PromptLibraries, or from the
+	// fragments built into the function.
+	// +optional
+	SystemPromptRef *PromptRef `json:"systemPromptRef,omitempty"`
+
+	// PromptLibraries are ConfigMaps of prompt fragments. Each key of a
+	// ConfigMap's data is a fragment name, and its value the fragment.
+	// Fragments can be referenced by SystemPromptRef, or included in the
+	// user prompt using {{ include "name" . }}. Fragments in later
+	// libraries override fragments of the same name in earlier libraries,
+	// and fragments built into the function.
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	PromptLibraries []PromptLibrary `json:"promptLibraries,omitempty"`
+
+	// UserPrompt to send to Claude. Required unless Steps is specified.
+	// +optional
 	UserPrompt string `json:"userPrompt"`
+
+	// Steps is an ordered chain of prompts, used instead of SystemPrompt and
+	// UserPrompt. Each step's templates can use the output of earlier steps,
+	// e.g. {{ .Steps.plan.Output }}. Only the final step's output is parsed
+	// as the function's response.
+	// +listType=map
+	// +listMapKey=name
+	// +kubebuilder:validation:MaxItems=5
+	// +optional
+	Steps []PromptStep `json:"steps,omitempty"`
+
 	// ModelName is the optional Anthropic model name to use (e.g., "claude-sonnet-4-5-20250929").
 	// If not specified, the default model will be used.
 	// See https://docs.claude.com/en/docs/about-claude/models/overview for available models.
 	// +optional
 	ModelName string `json:"modelName,omitempty"`
+
+	// Models to use, in order of preference. If invoking Claude with a model
+	// fails with an error listed in fallbackOn, the next model is used.
+	// Takes precedence over modelName.
+	// +kubebuilder:validation:MaxItems=5
+	// +optional
+	Models []string `json:"models,omitempty"`
+
+	// FallbackOn lists the errors that cause the next model to be used.
+	// Defaults to Overloaded, RateLimited, and ContextTooLong.
+	// +optional
+	FallbackOn []FallbackCondition `json:"fallbackOn,omitempty"`
+
+	// ModelRoutes choose a model for each invocation. The model of the first
+	// matching route is used first, followed by models. Routes are matched
+	// before any fallback.
+	// +optional
+	ModelRoutes []ModelRoute `json:"modelRoutes,omitempty"`
+
+	// Temperature controls the randomness of Claude's responses, from 0 to
+	// 1. It's a string because CRDs don't support floating point numbers.
+	// Defaults to "0".
+	// +kubebuilder:validation:Pattern=`^(0(\.[0-9]+)?|1(\.0+)?)$`
+	// +optional
+	Temperature *string `json:"temperature,omitempty"`
+
+	// MaxTokens is the maximum number of tokens Claude may generate in each
+	// response. Defaults to 8192.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=64000
+	// +optional
+	MaxTokens *int `json:"maxTokens,omitempty"`
+
+	// MaxIterations is the maximum number of times the agent may call Claude,
+	// e.g. to use tools, before it must answer. Defaults to 20.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=50
+	// +optional
+	MaxIterations *int `json:"maxIterations,omitempty"`
+
+	// StopSequences cause Claude to stop generating a response when it
+	// generates one of them.
+	// +kubebuilder:validation:MaxItems=8
+	// +optional
+	StopSequences []string `json:"stopSequences,omitempty"`
+
+	// PromptCaching caches the system prompt, and any part of the user
+	// prompt before a {{ cacheBreakpoint }}, between invocations.
+	// +optional
+	PromptCaching *PromptCaching `json:"promptCaching,omitempty"`
+
+	// Thinking enables extended thinking.
+	// +optional
+	Thinking *Thinking `json:"thinking,omitempty"`
+
+	// Stabilization configures drift-minimizing behaviour for composition
+	// pipelines. When enabled, Claude is only invoked when the composite
+	// resource's spec has changed since the last successful composition.
+	// +optional
+	Stabilization *Stabilization `json:"stabilization,omitempty"`
+
+	// Diff configures reporting of the changes Claude makes to composed
+	// resources in composition pipelines.
+	// +optional
+	Diff *Diff `json:"diff,omitempty"`
+
+	// Approval holds the composed resources Claude proposes until a human
+	// approves them. Approval implies stabilization; Claude is only asked
+	// for a new proposal when the composite resource's spec changes.
+	// +optional
+	Approval *Approval `json:"approval,omitempty"`
+
+	// Rationale asks Claude to explain why it composed each resource the way
+	// it did.
+	// +optional
+	Rationale *Rationale `json:"rationale,omitempty"`
+
+	// ContextOutputs asks Claude for named values, which are written to the
+	// pipeline context for subsequent functions in the pipeline to use.
+	// +optional
+	ContextOutputs *ContextOutputs `json:"contextOutputs,omitempty"`
+
+	// RequiredResources the function asks Crossplane for, in addition to
+	// the watched resource of an operation pipeline. Each is exposed to the
+	// prompt template by name, e.g. {{ .Required.pods }}. Selector values
+	// may reference the watched resource as {{ .Watched }} in operation
+	// pipelines, or the observed XR as {{ .Composite }} in composition
+	// pipelines.
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	RequiredResources []RequiredResource `json:"requiredResources,omitempty"`
+
+	// Report asks Claude to analyze the resources supplied to an operation
+	// pipeline and return structured findings, rather than desired
+	// resources.
+	// +optional
+	Report *Report `json:"report,omitempty"`
+
+	// DryRun asks Claude for desired resources in operation pipelines, but
+	// only reports how they differ from the watched and required resources
+	// rather than applying them. Dry run is also enabled when the
+	// claude.fn.upbound.io/dry-run pipeline context key is true.
+	// +optional
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// RateLimit limits how often operation pipelines invoke Claude.
+	// +optional
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+
+	// Skip configures rules that skip invoking Claude. The function also
+	// skips any XR or watched resource annotated with
+	// claude.fn.upbound.io/paused: "true".
+	// +optional
+	Skip *Skip `json:"skip,omitempty"`
+
+	// Events configures the Kubernetes Events about the watched resource
+	// that operation pipelines supply to the prompt template as
+	// {{ .Events }}. Events are supplied by default.
+	// +optional
+	Events *Events `json:"events,omitempty"`
+
+	// Playbook constrains operation pipelines to a catalog of remediation
+	// actions. Claude picks actions and their parameters, and the function
+	// applies them as patches to the watched resource. Claude can't return
+	// arbitrary resources when a playbook is configured.
+	// +optional
+	Playbook *Playbook `json:"playbook,omitempty"`
+
+	// Output writes a value from Claude's response to the watched resource
+	// of an operation pipeline, along with when it was written.
+	// +optional
+	Output *Output `json:"output,omitempty"`
+
+	// Sanitize removes noise from the resources supplied to the prompt
+	// template, to save tokens.
+	// +optional
+	Sanitize *Sanitize `json:"sanitize,omitempty"`
+
+	// Redact configures how sensitive values are redacted from the resources
+	// supplied to the prompt template. Redaction is enabled by default.
+	// +optional
+	Redact *Redact `json:"redact,omitempty"`
+
+	// Budget limits the estimated size of the prompt.
+	// +optional
+	Budget *Budget `json:"budget,omitempty"`
+}
+
+// Stabilization configures how the function avoids re-composing resources
+// whose inputs have not changed.
+type Stabilization struct {
+	// Enabled turns on stabilization. The function fingerprints the
+	// composite resource's spec and, while the fingerprint is unchanged,
+	// re-emits the observed composed resources as desired instead of asking
+	// Claude to compose them again.
+	Enabled bool `json:"enabled"`
+
+	// RefreshInterval forces a fresh composition once this much time has
+	// passed since the last successful composition, even if the composite
+	// resource's spec is unchanged. Stabilized output never expires if this
+	// is not specified.
+	// +optional
+	RefreshInterval *metav1.Duration `json:"refreshInterval,omitempty"`
+}
+
+// Diff configures how the function reports the differences between the
+// composed resources Claude desires and the observed composed resources.
+type Diff struct {
+	// Enabled turns on diff reporting. Each added, removed, or modified
+	// composed resource is reported as a result, and the changed fields are
+	// logged at debug level.
+	Enabled bool `json:"enabled"`
+
+	// StatusField is an optional path within the composite resource's
+	// status at which to write a summary of the changes, e.g.
+	// "claude.lastDiff". The composite resource's schema must allow this
+	// field.
+	// +optional
+	StatusField string `json:"statusField,omitempty"`
+}
+
+// Approval configures how the function gates changes to composed resources
+// behind human approval.
+type Approval struct {
+	// Enabled turns on the approval gate. Claude's proposed composed
+	// resources are only applied once the composite resource is annotated
+	// with claude.fn.upbound.io/approved-hash set to the proposal's hash.
+	// Until then the observed composed resources are re-emitted as desired.
+	Enabled bool `json:"enabled"`
+
+	// StatusField is an optional path within the composite resource's
+	// status at which to write the pending proposal's hash and a summary of
+	// its changes, e.g. "claude.proposal". The composite resource's schema
+	// must allow this field.
+	// +optional
+	StatusField string `json:"statusField,omitempty"`
+}
+
+// Rationale configures how the function asks Claude to justify its
+// composition decisions, and how it surfaces them.
+type Rationale struct {
+	// Enabled asks Claude to return a rationale for each composed resource
+	// it creates, updates, or deletes alongside its YAML stream. Each
+	// rationale is reported as a result.
+	Enabled bool `json:"enabled"`
+
+	// Annotate adds each resource's rationale to the desired resource as the
+	// claude.fn.upbound.io/rationale annotation.
+	// +optional
+	Annotate bool `json:"annotate,omitempty"`
+
+	// MaxLength is the maximum length, in characters, of each rationale.
+	// Longer rationales are truncated. Defaults to 256.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxLength *int `json:"maxLength,omitempty"`
+}
+
+// ContextOutputs configures the values Claude returns for subsequent
+// functions in the pipeline.
+type ContextOutputs struct {
+	// Key of the pipeline context under which the values are written, as an
+	// object keyed by value name. Defaults to
+	// "claude.fn.upbound.io/outputs".
+	// +optional
+	Key string `json:"key,omitempty"`
+
+	// Values to ask Claude for.
+	// +listType=map
+	// +listMapKey=name
+	Values []ContextOutput `json:"values"`
+}
+
+// A ContextOutput is a named value Claude returns for subsequent functions in
+// the pipeline.
+type ContextOutput struct {
+	// Name of the value, e.g. "tier" or "cidr".
+	Name string `json:"name"`
+
+	// Description of the value, telling Claude what to return.
+	// +optional
+	Description string `json:"description,omitempty"`
+
+	// Schema the value must satisfy, as JSON schema. Only the type, enum,
+	// properties, required, items, minimum, maximum, minLength, maxLength,
+	// and pattern keywords are supported.
+	// +optional
+	Schema *runtime.RawExtension `json:"schema,omitempty"`
+}
+
+// A RequiredResource selects resources the function asks Crossplane for. The
+// namespace, matchName, and matchLabels values may be Go templates, which are
+// rendered with the watched resource available as {{ .Watched }} in operation
+// pipelines, e.g. {{ .Watched.metadata.namespace }}, or the observed XR as
+// {{ .Composite }} in composition pipelines. Referencing a missing field is an
+// error.
+type RequiredResource struct {
+	// Name under which the selected resources are exposed to the prompt
+	// template, e.g. "pods" for {{ .Required.pods }}.
+	Name string `json:"name"`
+
+	// APIVersion of the resources to select.
+	APIVersion string `json:"apiVersion"`
+
+	// Kind of the resources to select.
+	Kind string `json:"kind"`
+
+	// Namespace to select resources from. Cluster scoped resources, and
+	// resources in any namespace, are selected if this is not specified.
+	// +optional
+	Namespace *string `json:"namespace,omitempty"`
+
+	// MatchName selects a single resource by name. Exactly one of
+	// matchName and matchLabels must be specified.
+	// +optional
+	MatchName *string `json:"matchName,omitempty"`
+
+	// MatchLabels selects resources by label. Exactly one of matchName and
+	// matchLabels must be specified.
+	// +optional
+	MatchLabels map[string]string `json:"matchLabels,omitempty"`
+}
+
+// Report configures report-only operations. In report mode Claude's findings
+// are reported as results and written to the operation's output. No desired
+// resources are produced.
+type Report struct {
+	// Enabled turns on report mode.
+	Enabled bool `json:"enabled"`
+
+	// OutputField is the field of the operation's output that findings are
+	// written to. Defaults to "findings".
+	// +optional
+	OutputField string `json:"outputField,omitempty"`
+}
+
+// RateLimit configures how often operation pipelines may invoke Claude. Runs
+// that exceed a limit are skipped. Limits are tracked per function process.
+type RateLimit struct {
+	// Cooldown is the minimum interval between invocations of Claude for
+	// the same watched resource, identified by its UID.
+	// +optional
+	Cooldown *metav1.Duration `json:"cooldown,omitempty"`
+
+	// MaxCallsPerMinute is the maximum number of runs per minute that may
+	// invoke Claude, across all watched resources. A run counts once,
+	// however many times its steps or model fallbacks call Claude.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxCallsPerMinute *int `json:"maxCallsPerMinute,omitempty"`
+
+	// PersistCooldown records the time Claude was last invoked for a
+	// watched resource as the claude.fn.upbound.io/last-invoked annotation
+	// on that resource, so that cooldowns survive function restarts.
+	// +optional
+	PersistCooldown bool `json:"persistCooldown,omitempty"`
+}
+
+// Skip configures when the function skips invoking Claude.
+type Skip struct {
+	// Rules that skip invoking Claude. The function skips if any rule
+	// matches.
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	Rules []SkipRule `json:"rules,omitempty"`
+}
+
+// A SkipRule matches the XR in a composition pipeline, or the watched resource
+// in an operation pipeline. A rule matches if all of its conditions match.
+type SkipRule struct {
+	// Name of the rule, reported when it matches.
+	Name string `json:"name"`
+
+	// Selector matches the labels of the resource.
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+
+	// MatchAnnotations matches the annotations of the resource.
+	// +optional
+	MatchAnnotations map[string]string `json:"matchAnnotations,omitempty"`
+
+	// Namespaces matches the namespace of the resource.
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// Expression is a CEL expression that must evaluate to a bool. The
+	// resource is available as 'object', and the observed composed
+	// resources, by name, as 'resources'.
+	// +optional
+	Expression string `json:"expression,omitempty"`
+}
+
+// Events configures how Kubernetes Events about the watched resource are
+// supplied to operation prompts. Repeated events are deduplicated, and the most
+// recent are supplied first.
+type Events struct {
+	// Enabled requests the Events whose involvedObject is the watched
+	// resource. Defaults to true. Set it to false to stop the function
+	// requiring every Event in the watched resource's namespace.
+	// +optional
+	Enabled *bool `json:"enabled,omitempty"`
+
+	// Limit is the maximum number of deduplicated events to supply.
+	// Defaults to 20.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Limit *int `json:"limit,omitempty"`
+}
+
+// A Playbook is a catalog of remediation actions.
+type Playbook struct {
+	// Actions Claude may choose from.
+	// +listType=map
+	// +listMapKey=name
+	// +kubebuilder:validation:MinItems=1
+	Actions []Action `json:"actions"`
+}
+
+// An Action is a remediation that patches the watched resource.
+type Action struct {
+	// Name of the action.
+	Name string `json:"name"`
+
+	// Description of the action, and when Claude should choose it.
+	// +optional
+	Description string `json:"description,omitempty"`
+
+	// Parameters the action takes, as JSON schema. Only the type, enum,
+	// properties, required, items, minimum, maximum, minLength, maxLength,
+	// and pattern keywords are supported. Actions without a schema take no
+	// parameters.
+	// +optional
+	Parameters *runtime.RawExtension `json:"parameters,omitempty"`
+
+	// Patch is a YAML Go template of the patch applied to the watched
+	// resource. Parameters are available as {{ .Params.name }}, rendered as
+	// JSON literals. The patch's apiVersion, kind, name, and namespace are
+	// always those of the watched resource.
+	Patch string `json:"patch"`
+}
+
+// An Output is a value Claude returns that is written to the watched resource.
+// Exactly one of Annotation, Label, and StatusPath must be set.
+type Output struct {
+	// Name of the value, e.g. healthScore.
+	Name string `json:"name"`
+
+	// Description of the value, used to ask Claude for it.
+	// +optional
+	Description string `json:"description,omitempty"`
+
+	// Annotation to write the value to.
+	// +optional
+	Annotation string `json:"annotation,omitempty"`
+
+	// Label to write the value to. Characters that aren't valid in a label
+	// value are replaced.
+	// +optional
+	Label string `json:"label,omitempty"`
+
+	// StatusPath is the dotted path of the status field to write the value
+	// to, e.g. status.review.summary.
+	// +optional
+	StatusPath string `json:"statusPath,omitempty"`
+
+	// MaxLength is the maximum length of the value, in characters. Longer
+	// values are truncated. Defaults to 256, and is at most 63 for labels.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxLength *int `json:"maxLength,omitempty"`
+}
+
+// A PromptRef references a prompt fragment by name. Fragment names should
+// include a version, e.g. krm-rules-v1, so that changing a fragment doesn't
+// change the behaviour of existing Compositions.
+type PromptRef struct {
+	// Name of the prompt fragment.
+	Name string `json:"name"`
+}
+
+// A PromptLibrary is a ConfigMap of prompt fragments.
+type PromptLibrary struct {
+	// Name of the ConfigMap.
+	Name string `json:"name"`
+
+	// Namespace of the ConfigMap. Defaults to crossplane-system.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Sanitize configures how resources are sanitized before they're supplied to
+// the prompt template. Sanitization applies to the observed XR and composed
+// resources in composition pipelines, and to the watched and required
+// resources in operation pipelines.
+type Sanitize struct {
+	// Enabled turns on sanitization. Metadata managed by the API server,
+	// such as managedFields, uid, and resourceVersion, and the
+	// kubectl.kubernetes.io/last-applied-configuration annotation are
+	// removed from every resource.
+	Enabled bool `json:"enabled"`
+
+	// KeepStatus keeps the status of resources. Status is removed by
+	// default.
+	// +optional
+	KeepStatus bool `json:"keepStatus,omitempty"`
+
+	// Rules remove or keep fields of resources of a particular type. Every
+	// rule that matches a resource is applied, in order.
+	// +optional
+	Rules []SanitizeRule `json:"rules,omitempty"`
+
+	// MaxSize is the maximum size of each resource, in bytes of JSON. The
+	// largest top level fields other than apiVersion, kind, and metadata
+	// are removed from larger resources, and listed in the
+	// claude.fn.upbound.io/omitted-fields annotation.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxSize *int `json:"maxSize,omitempty"`
+}
+
+// A SanitizeRule removes or keeps fields of resources of a particular type.
+// Paths use gjson syntax, e.g. spec.forProvider.tags or
+// metadata.annotations.example\.org/note.
+type SanitizeRule struct {
+	// APIVersion of resources the rule applies to. Applies to all API
+	// versions if not specified.
+	// +optional
+	APIVersion string `json:"apiVersion,omitempty"`
+
+	// Kind of resources the rule applies to. Applies to all kinds if not
+	// specified.
+	// +optional
+	Kind string `json:"kind,omitempty"`
+
+	// Include keeps only the supplied paths, as well as the resource's
+	// apiVersion, kind, name, and namespace.
+	// +optional
+	Include []string `json:"include,omitempty"`
+
+	// Exclude removes the supplied paths.
+	// +optional
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Redact configures how sensitive values are redacted from the resources
+// supplied to the prompt template. Redacted values are replaced with stable
+// placeholders, which are restored in the resources produced from Claude's
+// response. The data of Secrets is always redacted, as are string values whose
+// key ends with password, token, privateKey, or kubeconfig.
+type Redact struct {
+	// Disabled turns off redaction.
+	// +optional
+	Disabled bool `json:"disabled,omitempty"`
+
+	// KeyPatterns are additional regular expressions. String values whose key
+	// matches any of them are redacted, as are the values of environment
+	// variables whose name matches.
+	// +optional
+	KeyPatterns []string `json:"keyPatterns,omitempty"`
+
+	// Paths of values to redact, using gjson syntax. All string values
+	// within an object or array are redacted.
+	// +optional
+	Paths []string `json:"paths,omitempty"`
+}
+
+// A BudgetStrategy determines what happens when a prompt exceeds its budget.
+type BudgetStrategy string
+
+// Budget strategies.
+const (
+	// BudgetStrategyFail fails without invoking Claude.
+	BudgetStrategyFail BudgetStrategy = "Fail"
+
+	// BudgetStrategySummarize replaces composed resources with stubs,
+	// starting with the largest ready resources, until the prompt is within
+	// budget. Summarized resources are kept as they are.
+	BudgetStrategySummarize BudgetStrategy = "Summarize"
+
+	// BudgetStrategyRetrieve replaces all composed resources with stubs, and
+	// lets Claude retrieve the resources it needs using a tool.
+	BudgetStrategyRetrieve BudgetStrategy = "Retrieve"
+)
+
+// Budget limits the estimated size of the prompt. Sizes are estimated at four
+// characters per token.
+type Budget struct {
+	// MaxTokens is the maximum estimated size of the system and user
+	// prompts combined.
+	// +kubebuilder:validation:Minimum=1
+	MaxTokens int `json:"maxTokens"`
+
+	// Strategy determines what happens when the prompt exceeds MaxTokens.
+	// Summarize and Retrieve only apply to composition pipelines, and fail
+	// if the prompt still exceeds MaxTokens. Defaults to Fail.
+	// +kubebuilder:validation:Enum=Fail;Summarize;Retrieve
+	// +optional
+	Strategy BudgetStrategy `json:"strategy,omitempty"`
+}
+
+// A FallbackCondition is an error that causes the next model to be used.
+// +kubebuilder:validation:Enum=Overloaded;RateLimited;ContextTooLong
+type FallbackCondition string
+
+// Fallback conditions.
+const (
+	// FallbackOnOverloaded falls back when the model is overloaded.
+	FallbackOnOverloaded FallbackCondition = "Overloaded"
+
+	// FallbackOnRateLimited falls back when requests are rate limited.
+	FallbackOnRateLimited FallbackCondition = "RateLimited"
+
+	// FallbackOnContextTooLong falls back when the prompt exceeds the
+	// model's context window.
+	FallbackOnContextTooLong FallbackCondition = "ContextTooLong"
+)
+
+// A ModelRoute chooses a model when all of its conditions match. A route
+// without conditions always matches.
+type ModelRoute struct {
+	// Model to use.
+	Model string `json:"model"`
+
+	// MaxPromptTokens matches prompts estimated to be no larger than the
+	// supplied number of tokens.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxPromptTokens *int `json:"maxPromptTokens,omitempty"`
+
+	// SpecUnchanged matches when the XR's spec and the prompt haven't
+	// changed since the last composition. Never matches in operation
+	// pipelines.
+	// +optional
+	SpecUnchanged bool `json:"specUnchanged,omitempty"`
+}
+
+// PromptCaching configures Anthropic prompt caching.
+type PromptCaching struct {
+	// Enabled turns on prompt caching.
+	Enabled bool `json:"enabled"`
+}
+
+// Thinking configures extended thinking. Claude always uses a temperature of
+// 1 when thinking.
+type Thinking struct {
+	// BudgetTokens is the maximum number of tokens Claude may use to think.
+	// It must be less than maxTokens.
+	// +kubebuilder:validation:Minimum=1024
+	BudgetTokens int `json:"budgetTokens"`
+}
+
+// A PromptStep is one step of a prompt chain.
+type PromptStep struct {
+	// Name of the step. Later steps reference its output by name, e.g.
+	// {{ .Steps.plan.Output }}.
+	// +kubebuilder:validation:Pattern=`^[a-zA-Z_][a-zA-Z0-9_]*$`
+	Name string `json:"name"`
+
+	// SystemPrompt template of the step. Takes the place of the input's
+	// SystemPrompt, which is used if the step doesn't specify one. The
+	// input's SystemPromptRef is used by every step.
+	// +optional
+	SystemPrompt string `json:"systemPrompt,omitempty"`
+
+	// UserPrompt template of the step.
+	UserPrompt string `json:"userPrompt"`
+
+	// ModelName is the Anthropic model to use for the step. If specified it
+	// overrides the input's modelName. It can't be specified if the input
+	// specifies models or modelRoutes.
+	// +optional
+	ModelName string `json:"modelName,omitempty"`
 }
@@ -21,14 +21,348 @@ limitations under the License.
 package v1alpha1
 
 import (
-	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Action) DeepCopyInto(out *Action) {
+	*out = *in
+	if in.Parameters != nil {
+		in, out := &in.Parameters, &out.Parameters
+		*out = new(runtime.RawExtension)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Action.
+func (in *Action) DeepCopy() *Action {
+	if in == nil {
+		return nil
+	}
+	out := new(Action)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Approval) DeepCopyInto(out *Approval) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Approval.
+func (in *Approval) DeepCopy() *Approval {
+	if in == nil {
+		return nil
+	}
+	out := new(Approval)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Budget) DeepCopyInto(out *Budget) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Budget.
+func (in *Budget) DeepCopy() *Budget {
+	if in == nil {
+		return nil
+	}
+	out := new(Budget)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ContextOutput) DeepCopyInto(out *ContextOutput) {
+	*out = *in
+	if in.Schema != nil {
+		in, out := &in.Schema, &out.Schema
+		*out = new(runtime.RawExtension)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ContextOutput.
+func (in *ContextOutput) DeepCopy() *ContextOutput {
+	if in == nil {
+		return nil
+	}
+	out := new(ContextOutput)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ContextOutputs) DeepCopyInto(out *ContextOutputs) {
+	*out = *in
+	if in.Values != nil {
+		in, out := &in.Values, &out.Values
+		*out = make([]ContextOutput, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ContextOutputs.
+func (in *ContextOutputs) DeepCopy() *ContextOutputs {
+	if in == nil {
+		return nil
+	}
+	out := new(ContextOutputs)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Diff) DeepCopyInto(out *Diff) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Diff.
+func (in *Diff) DeepCopy() *Diff {
+	if in == nil {
+		return nil
+	}
+	out := new(Diff)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Events) DeepCopyInto(out *Events) {
+	*out = *in
+	if in.Enabled != nil {
+		in, out := &in.Enabled, &out.Enabled
+		*out = new(bool)
+		**out = **in
+	}
+	if in.Limit != nil {
+		in, out := &in.Limit, &out.Limit
+		*out = new(int)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Events.
+func (in *Events) DeepCopy() *Events {
+	if in == nil {
+		return nil
+	}
+	out := new(Events)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ModelRoute) DeepCopyInto(out *ModelRoute) {
+	*out = *in
+	if in.MaxPromptTokens != nil {
+		in, out := &in.MaxPromptTokens, &out.MaxPromptTokens
+		*out = new(int)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ModelRoute.
+func (in *ModelRoute) DeepCopy() *ModelRoute {
+	if in == nil {
+		return nil
+	}
+	out := new(ModelRoute)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Output) DeepCopyInto(out *Output) {
+	*out = *in
+	if in.MaxLength != nil {
+		in, out := &in.MaxLength, &out.MaxLength
+		*out = new(int)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Output.
+func (in *Output) DeepCopy() *Output {
+	if in == nil {
+		return nil
+	}
+	out := new(Output)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Playbook) DeepCopyInto(out *Playbook) {
+	*out = *in
+	if in.Actions != nil {
+		in, out := &in.Actions, &out.Actions
+		*out = make([]Action, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Playbook.
+func (in *Playbook) DeepCopy() *Playbook {
+	if in == nil {
+		return nil
+	}
+	out := new(Playbook)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Prompt) DeepCopyInto(out *Prompt) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	if in.SystemPromptRef != nil {
+		in, out := &in.SystemPromptRef, &out.SystemPromptRef
+		*out = new(PromptRef)
+		**out = **in
+	}
+	if in.PromptLibraries != nil {
+		in, out := &in.PromptLibraries, &out.PromptLibraries
+		*out = make([]PromptLibrary, len(*in))
+		copy(*out, *in)
+	}
+	if in.Steps != nil {
+		in, out := &in.Steps, &out.Steps
+		*out = make([]PromptStep, len(*in))
+		copy(*out, *in)
+	}
+	if in.Models != nil {
+		in, out := &in.Models, &out.Models
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.FallbackOn != nil {
+		in, out := &in.FallbackOn, &out.FallbackOn
+		*out = make([]FallbackCondition, len(*in))
+		copy(*out, *in)
+	}
+	if in.ModelRoutes != nil {
+		in, out := &in.ModelRoutes, &out.ModelRoutes
+		*out = make([]ModelRoute, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Temperature != nil {
+		in, out := &in.Temperature, &out.Temperature
+		*out = new(string)
+		**out = **in
+	}
+	if in.MaxTokens != nil {
+		in, out := &in.MaxTokens, &out.MaxTokens
+		*out = new(int)
+		**out = **in
+	}
+	if in.MaxIterations != nil {
+		in, out := &in.MaxIterations, &out.MaxIterations
+		*out = new(int)
+		**out = **in
+	}
+	if in.StopSequences != nil {
+		in, out := &in.StopSequences, &out.StopSequences
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.PromptCaching != nil {
+		in, out := &in.PromptCaching, &out.PromptCaching
+		*out = new(PromptCaching)
+		**out = **in
+	}
+	if in.Thinking != nil {
+		in, out := &in.Thinking, &out.Thinking
+		*out = new(Thinking)
+		**out = **in
+	}
+	if in.Stabilization != nil {
+		in, out := &in.Stabilization, &out.Stabilization
+		*out = new(Stabilization)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Diff != nil {
+		in, out := &in.Diff, &out.Diff
+		*out = new(Diff)
+		**out = **in
+	}
+	if in.Approval != nil {
+		in, out := &in.Approval, &out.Approval
+		*out = new(Approval)
+		**out = **in
+	}
+	if in.Rationale != nil {
+		in, out := &in.Rationale, &out.Rationale
+		*out = new(Rationale)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ContextOutputs != nil {
+		in, out := &in.ContextOutputs, &out.ContextOutputs
+		*out = new(ContextOutputs)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.RequiredResources != nil {
+		in, out := &in.RequiredResources, &out.RequiredResources
+		*out = make([]RequiredResource, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Report != nil {
+		in, out := &in.Report, &out.Report
+		*out = new(Report)
+		**out = **in
+	}
+	if in.RateLimit != nil {
+		in, out := &in.RateLimit, &out.RateLimit
+		*out = new(RateLimit)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Skip != nil {
+		in, out := &in.Skip, &out.Skip
+		*out = new(Skip)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Events != nil {
+		in, out := &in.Events, &out.Events
+		*out = new(Events)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Playbook != nil {
+		in, out := &in.Playbook, &out.Playbook
+		*out = new(Playbook)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Output != nil {
+		in, out := &in.Output, &out.Output
+		*out = new(Output)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Sanitize != nil {
+		in, out := &in.Sanitize, &out.Sanitize
+		*out = new(Sanitize)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Redact != nil {
+		in, out := &in.Redact, &out.Redact
+		*out = new(Redact)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Budget != nil {
+		in, out := &in.Budget, &out.Budget
+		*out = new(Budget)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Prompt.
@@ -48,3 +382,321 @@ func (in *Prompt) DeepCopyObject() runtime.Object {
 	}
 	return nil
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PromptCaching) DeepCopyInto(out *PromptCaching) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PromptCaching.
+func (in *PromptCaching) DeepCopy() *PromptCaching {
+	if in == nil {
+		return nil
+	}
+	out := new(PromptCaching)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PromptLibrary) DeepCopyInto(out *PromptLibrary) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PromptLibrary.
+func (in *PromptLibrary) DeepCopy() *PromptLibrary {
+	if in == nil {
+		return nil
+	}
+	out := new(PromptLibrary)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PromptRef) DeepCopyInto(out *PromptRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PromptRef.
+func (in *PromptRef) DeepCopy() *PromptRef {
+	if in == nil {
+		return nil
+	}
+	out := new(PromptRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PromptStep) DeepCopyInto(out *PromptStep) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PromptStep.
+func (in *PromptStep) DeepCopy() *PromptStep {
+	if in == nil {
+		return nil
+	}
+	out := new(PromptStep)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RateLimit) DeepCopyInto(out *RateLimit) {
+	*out = *in
+	if in.Cooldown != nil {
+		in, out := &in.Cooldown, &out.Cooldown
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.MaxCallsPerMinute != nil {
+		in, out := &in.MaxCallsPerMinute, &out.MaxCallsPerMinute
+		*out = new(int)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RateLimit.
+func (in *RateLimit) DeepCopy() *RateLimit {
+	if in == nil {
+		return nil
+	}
+	out := new(RateLimit)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Rationale) DeepCopyInto(out *Rationale) {
+	*out = *in
+	if in.MaxLength != nil {
+		in, out := &in.MaxLength, &out.MaxLength
+		*out = new(int)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Rationale.
+func (in *Rationale) DeepCopy() *Rationale {
+	if in == nil {
+		return nil
+	}
+	out := new(Rationale)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Redact) DeepCopyInto(out *Redact) {
+	*out = *in
+	if in.KeyPatterns != nil {
+		in, out := &in.KeyPatterns, &out.KeyPatterns
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Paths != nil {
+		in, out := &in.Paths, &out.Paths
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Redact.
+func (in *Redact) DeepCopy() *Redact {
+	if in == nil {
+		return nil
+	}
+	out := new(Redact)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Report) DeepCopyInto(out *Report) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Report.
+func (in *Report) DeepCopy() *Report {
+	if in == nil {
+		return nil
+	}
+	out := new(Report)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RequiredResource) DeepCopyInto(out *RequiredResource) {
+	*out = *in
+	if in.Namespace != nil {
+		in, out := &in.Namespace, &out.Namespace
+		*out = new(string)
+		**out = **in
+	}
+	if in.MatchName != nil {
+		in, out := &in.MatchName, &out.MatchName
+		*out = new(string)
+		**out = **in
+	}
+	if in.MatchLabels != nil {
+		in, out := &in.MatchLabels, &out.MatchLabels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RequiredResource.
+func (in *RequiredResource) DeepCopy() *RequiredResource {
+	if in == nil {
+		return nil
+	}
+	out := new(RequiredResource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Sanitize) DeepCopyInto(out *Sanitize) {
+	*out = *in
+	if in.Rules != nil {
+		in, out := &in.Rules, &out.Rules
+		*out = make([]SanitizeRule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.MaxSize != nil {
+		in, out := &in.MaxSize, &out.MaxSize
+		*out = new(int)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Sanitize.
+func (in *Sanitize) DeepCopy() *Sanitize {
+	if in == nil {
+		return nil
+	}
+	out := new(Sanitize)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SanitizeRule) DeepCopyInto(out *SanitizeRule) {
+	*out = *in
+	if in.Include != nil {
+		in, out := &in.Include, &out.Include
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Exclude != nil {
+		in, out := &in.Exclude, &out.Exclude
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SanitizeRule.
+func (in *SanitizeRule) DeepCopy() *SanitizeRule {
+	if in == nil {
+		return nil
+	}
+	out := new(SanitizeRule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Skip) DeepCopyInto(out *Skip) {
+	*out = *in
+	if in.Rules != nil {
+		in, out := &in.Rules, &out.Rules
+		*out = make([]SkipRule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Skip.
+func (in *Skip) DeepCopy() *Skip {
+	if in == nil {
+		return nil
+	}
+	out := new(Skip)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SkipRule) DeepCopyInto(out *SkipRule) {
+	*out = *in
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.MatchAnnotations != nil {
+		in, out := &in.MatchAnnotations, &out.MatchAnnotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Namespaces != nil {
+		in, out := &in.Namespaces, &out.Namespaces
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SkipRule.
+func (in *SkipRule) DeepCopy() *SkipRule {
+	if in == nil {
+		return nil
+	}
+	out := new(SkipRule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Stabilization) DeepCopyInto(out *Stabilization) {
+	*out = *in
+	if in.RefreshInterval != nil {
+		in, out := &in.RefreshInterval, &out.RefreshInterval
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Stabilization.
+func (in *Stabilization) DeepCopy() *Stabilization {
+	if in == nil {
+		return nil
+	}
+	out := new(Stabilization)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Thinking) DeepCopyInto(out *Thinking) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Thinking.
+func (in *Thinking) DeepCopy() *Thinking {
+	if in == nil {
+		return nil
+	}
+	out := new(Thinking)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,231 @@
+// /*
+// Copyright 2025 The Upbound Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// */
+
+package diff
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Type of a change.
+type Type string
+
+// Types of change.
+const (
+	// Added indicates something exists in the desired state but not in the
+	// observed state.
+	Added Type = "Added"
+	// Removed indicates something exists in the observed state but not in
+	// the desired state.
+	Removed Type = "Removed"
+	// Modified indicates something exists in both states with different
+	// values.
+	Modified Type = "Modified"
+)
+
+// A Field that differs between the observed and desired state of a resource.
+type Field struct {
+	// Path to the field, e.g. spec.containers[0].image.
+	Path string `json:"path"`
+	// Type of change.
+	Type Type `json:"type"`
+	// Observed value of the field, if any.
+	Observed any `json:"observed,omitempty"`
+	// Desired value of the field, if any.
+	Desired any `json:"desired,omitempty"`
+}
+
+// A Resource that differs between the observed and desired state.
+type Resource struct {
+	// Name of the resource, e.g. its upbound.io/name annotation.
+	Name string `json:"name"`
+	// APIVersion of the resource.
+	APIVersion string `json:"apiVersion,omitempty"`
+	// Kind of the resource.
+	Kind string `json:"kind,omitempty"`
+	// Type of change.
+	Type Type `json:"type"`
+	// Fields that changed. Only set for modified resources.
+	Fields []Field `json:"fields,omitempty"`
+}
+
+// ignored fields are managed by the API server or controllers rather than
+// the caller, and are never reported.
+var ignored = map[string]bool{
+	"status": true,
+}
+
+// Resources returns the differences between the supplied observed and desired
+// resources, keyed by name. Fields that only exist in the observed state are
+// not reported, since they are typically defaulted by the API server or set by
+// controllers rather than removed by the caller. Unchanged resources are
+// omitted. The result is sorted by resource name.
+func Resources(observed, desired map[string]map[string]any) []Resource {
+	names := make([]string, 0, len(observed)+len(desired))
+	for name := range observed {
+		names = append(names, name)
+	}
+	for name := range desired {
+		if _, ok := observed[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	out := make([]Resource, 0, len(names))
+	for _, name := range names {
+		o, inObserved := observed[name]
+		d, inDesired := desired[name]
+
+		r := Resource{Name: name}
+		switch {
+		case !inObserved:
+			r.Type = Added
+			r.APIVersion, r.Kind = gvk(d)
+		case !inDesired:
+			r.Type = Removed
+			r.APIVersion, r.Kind = gvk(o)
+		default:
+			r.Type = Modified
+			r.APIVersion, r.Kind = gvk(d)
+			r.Fields = fields("", o, d, true)
+			if len(r.Fields) == 0 {
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// Paths returns the paths of the supplied fields.
+func Paths(fs []Field) []string {
+	out := make([]string, len(fs))
+	for i, f := range fs {
+		out[i] = f.Path
+	}
+	return out
+}
+
+// Summary returns a concise, human readable summary of the supplied resource
+// difference. At most limit field paths are included.
+func Summary(r Resource, limit int) string {
+	id := r.Name
+	if r.Kind != "" {
+		id = fmt.Sprintf("%s (%s/%s)", r.Name, r.APIVersion, r.Kind)
+	}
+	switch r.Type {
+	case Added:
+		return fmt.Sprintf("%s will be created", id)
+	case Removed:
+		return fmt.Sprintf("%s will be deleted", id)
+	}
+
+	paths := Paths(r.Fields)
+	more := ""
+	if len(paths) > limit {
+		more = fmt.Sprintf(" and %d more", len(paths)-limit)
+		paths = paths[:limit]
+	}
+	return fmt.Sprintf("%s will be modified: %s%s", id, strings.Join(paths, ", "), more)
+}
+
+func gvk(o map[string]any) (string, string) {
+	av, _ := o["apiVersion"].(string)
+	k, _ := o["kind"].(string)
+	return av, k
+}
+
+// fields returns the differences between the observed and desired values at
+// the supplied path. Only fields present in the desired value are compared,
+// except within arrays which are treated as atomic.
+func fields(path string, observed, desired any, root bool) []Field {
+	switch d := desired.(type) {
+	case map[string]any:
+		if o, ok := observed.(map[string]any); ok {
+			return objectFields(path, o, d, root)
+		}
+	case []any:
+		if o, ok := observed.([]any); ok {
+			return arrayFields(path, o, d)
+		}
+	}
+
+	if reflect.DeepEqual(observed, desired) {
+		return nil
+	}
+	return []Field{{Path: path, Type: Modified, Observed: observed, Desired: desired}}
+}
+
+// objectFields returns the differences between the observed and desired
+// objects at the supplied path.
+func objectFields(path string, o, d map[string]any, root bool) []Field {
+	keys := make([]string, 0, len(d))
+	for k := range d {
+		if root && ignored[k] {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	out := make([]Field, 0)
+	for _, k := range keys {
+		p := join(path, k)
+		ov, ok := o[k]
+		if !ok {
+			out = append(out, Field{Path: p, Type: Added, Desired: d[k]})
+			continue
+		}
+		out = append(out, fields(p, ov, d[k], false)...)
+	}
+	return out
+}
+
+// arrayFields returns the differences between the observed and desired arrays
+// at the supplied path, element by element.
+func arrayFields(path string, o, d []any) []Field {
+	out := make([]Field, 0)
+	for i := range max(len(o), len(d)) {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		switch {
+		case i >= len(o):
+			out = append(out, Field{Path: p, Type: Added, Desired: d[i]})
+		case i >= len(d):
+			out = append(out, Field{Path: p, Type: Removed, Observed: o[i]})
+		default:
+			out = append(out, fields(p, o[i], d[i], false)...)
+		}
+	}
+	return out
+}
+
+// join appends the supplied key to the supplied path, quoting it if it
+// contains characters that would make the path ambiguous.
+func join(path, key string) string {
+	if strings.ContainsAny(key, ".[]") {
+		key = "[" + strconv.Quote(key) + "]"
+		return path + key
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,205 @@
+// /*
+// Copyright 2025 The Upbound Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// */
+
+package diff
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResources(t *testing.T) {
+	type args struct {
+		observed map[string]map[string]any
+		desired  map[string]map[string]any
+	}
+	type want struct {
+		res []Resource
+	}
+
+	deployment := func(replicas float64, image string) map[string]any {
+		return map[string]any{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"spec": map[string]any{
+				"replicas": replicas,
+				"template": map[string]any{
+					"spec": map[string]any{
+						"containers": []any{
+							map[string]any{"name": "app", "image": image},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"Unchanged": {
+			reason: "Unchanged resources should not be reported.",
+			args: args{
+				observed: map[string]map[string]any{"deployment": deployment(3, "nginx")},
+				desired:  map[string]map[string]any{"deployment": deployment(3, "nginx")},
+			},
+			want: want{
+				res: []Resource{},
+			},
+		},
+		"AddedAndRemoved": {
+			reason: "Resources only in the desired state are added, and only in the observed state are removed.",
+			args: args{
+				observed: map[string]map[string]any{"old": {"apiVersion": "v1", "kind": "ConfigMap"}},
+				desired:  map[string]map[string]any{"new": {"apiVersion": "v1", "kind": "Service"}},
+			},
+			want: want{
+				res: []Resource{
+					{Name: "new", APIVersion: "v1", Kind: "Service", Type: Added},
+					{Name: "old", APIVersion: "v1", Kind: "ConfigMap", Type: Removed},
+				},
+			},
+		},
+		"Modified": {
+			reason: "Fields that differ should be reported by path, including array elements.",
+			args: args{
+				observed: map[string]map[string]any{"deployment": deployment(3, "nginx")},
+				desired:  map[string]map[string]any{"deployment": deployment(5, "nginx:1.27")},
+			},
+			want: want{
+				res: []Resource{{
+					Name:       "deployment",
+					APIVersion: "apps/v1",
+					Kind:       "Deployment",
+					Type:       Modified,
+					Fields: []Field{
+						{Path: "spec.replicas", Type: Modified, Observed: float64(3), Desired: float64(5)},
+						{Path: "spec.template.spec.containers[0].image", Type: Modified, Observed: "nginx", Desired: "nginx:1.27"},
+					},
+				}},
+			},
+		},
+		"IgnoreObservedOnlyFields": {
+			reason: "Fields that only exist in the observed state, and status, should not be reported.",
+			args: args{
+				observed: map[string]map[string]any{"cm": {
+					"metadata": map[string]any{"name": "cm-abcde", "uid": "some-uid"},
+					"data":     map[string]any{"a": "b"},
+					"status":   map[string]any{"ready": true},
+				}},
+				desired: map[string]map[string]any{"cm": {
+					"data":   map[string]any{"a": "b", "c": "d"},
+					"status": map[string]any{"ready": false},
+				}},
+			},
+			want: want{
+				res: []Resource{{
+					Name: "cm",
+					Type: Modified,
+					Fields: []Field{
+						{Path: "data.c", Type: Added, Desired: "d"},
+					},
+				}},
+			},
+		},
+		"QuotedKeys": {
+			reason: "Keys containing dots should be quoted in paths.",
+			args: args{
+				observed: map[string]map[string]any{"cm": {"metadata": map[string]any{"annotations": map[string]any{}}}},
+				desired:  map[string]map[string]any{"cm": {"metadata": map[string]any{"annotations": map[string]any{"upbound.io/name": "cm"}}}},
+			},
+			want: want{
+				res: []Resource{{
+					Name: "cm",
+					Type: Modified,
+					Fields: []Field{
+						{Path: `metadata.annotations["upbound.io/name"]`, Type: Added, Desired: "cm"},
+					},
+				}},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := Resources(tc.args.observed, tc.args.desired)
+
+			if diff := cmp.Diff(tc.want.res, got); diff != "" {
+				t.Errorf("\n%s\nResources(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestSummary(t *testing.T) {
+	type args struct {
+		r     Resource
+		limit int
+	}
+	type want struct {
+		summary string
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"Added": {
+			reason: "Added resources should be summarized as created.",
+			args: args{
+				r: Resource{Name: "svc", APIVersion: "v1", Kind: "Service", Type: Added},
+			},
+			want: want{
+				summary: "svc (v1/Service) will be created",
+			},
+		},
+		"Removed": {
+			reason: "Removed resources should be summarized as deleted.",
+			args: args{
+				r: Resource{Name: "svc", Type: Removed},
+			},
+			want: want{
+				summary: "svc will be deleted",
+			},
+		},
+		"ModifiedTruncated": {
+			reason: "Modified resources should list at most limit fields.",
+			args: args{
+				r: Resource{Name: "cm", APIVersion: "v1", Kind: "ConfigMap", Type: Modified, Fields: []Field{
+					{Path: "data.a"}, {Path: "data.b"}, {Path: "data.c"},
+				}},
+				limit: 2,
+			},
+			want: want{
+				summary: "cm (v1/ConfigMap) will be modified: data.a, data.b and 1 more",
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := Summary(tc.args.r, tc.args.limit)
+
+			if diff := cmp.Diff(tc.want.summary, got); diff != "" {
+				t.Errorf("\n%s\nSummary(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+// /*
+// Copyright 2025 The Upbound Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// */
+
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+
+	"github.com/crossplane/function-sdk-go/errors"
+)
+
+// Types supported by a Schema.
+const (
+	TypeString  = "string"
+	TypeNumber  = "number"
+	TypeInteger = "integer"
+	TypeBoolean = "boolean"
+	TypeObject  = "object"
+	TypeArray   = "array"
+)
+
+// A Schema is a small subset of JSON schema.
+type Schema struct {
+	Description string             `json:"description,omitempty"`
+	Type        string             `json:"type,omitempty"`
+	Enum        []any              `json:"enum,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	Minimum     *float64           `json:"minimum,omitempty"`
+	Maximum     *float64           `json:"maximum,omitempty"`
+	MinLength   *int               `json:"minLength,omitempty"`
+	MaxLength   *int               `json:"maxLength,omitempty"`
+	Pattern     string             `json:"pattern,omitempty"`
+}
+
+// Parse the supplied JSON as a Schema. Keywords that aren't supported return
+// an error, rather than being silently ignored.
+func Parse(j []byte) (*Schema, error) {
+	s := &Schema{}
+	if len(bytes.TrimSpace(j)) == 0 {
+		return s, nil
+	}
+	d := json.NewDecoder(bytes.NewReader(j))
+	d.DisallowUnknownFields()
+	if err := d.Decode(s); err != nil {
+		return nil, errors.Wrap(err, "cannot parse schema")
+	}
+	return s, nil
+}
+
+// Validate the supplied value against the Schema. The value must be of the
+// kind produced by unmarshalling JSON, e.g. float64 rather than int.
+func (s *Schema) Validate(v any) error {
+	return s.validate("", v)
+}
+
+func (s *Schema) validate(path string, v any) error {
+	if s == nil {
+		return nil
+	}
+	if s.Type != "" && !hasType(v, s.Type) {
+		return errorf(path, "must be of type %s", s.Type)
+	}
+	if len(s.Enum) > 0 && !inEnum(v, s.Enum) {
+		return errorf(path, "must be one of %v", s.Enum)
+	}
+
+	switch tv := v.(type) {
+	case float64:
+		return s.validateNumber(path, tv)
+	case string:
+		return s.validateString(path, tv)
+	case map[string]any:
+		return s.validateObject(path, tv)
+	case []any:
+		return s.validateArray(path, tv)
+	}
+	return nil
+}
+
+func (s *Schema) validateNumber(path string, v float64) error {
+	if s.Minimum != nil && v < *s.Minimum {
+		return errorf(path, "must be at least %v", *s.Minimum)
+	}
+	if s.Maximum != nil && v > *s.Maximum {
+		return errorf(path, "must be at most %v", *s.Maximum)
+	}
+	return nil
+}
+
+func (s *Schema) validateString(path, v string) error {
+	if s.MinLength != nil && len(v) < *s.MinLength {
+		return errorf(path, "must be at least %d characters", *s.MinLength)
+	}
+	if s.MaxLength != nil && len(v) > *s.MaxLength {
+		return errorf(path, "must be at most %d characters", *s.MaxLength)
+	}
+	if s.Pattern == "" {
+		return nil
+	}
+	re, err := regexp.Compile(s.Pattern)
+	if err != nil {
+		return errors.Wrapf(err, "invalid pattern %q", s.Pattern)
+	}
+	if !re.MatchString(v) {
+		return errorf(path, "must match pattern %q", s.Pattern)
+	}
+	return nil
+}
+
+func (s *Schema) validateArray(path string, v []any) error {
+	for i, iv := range v {
+		if err := s.Items.validate(fmt.Sprintf("%s[%d]", path, i), iv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateObject(path string, v map[string]any) error {
+	for _, r := range s.Required {
+		if _, ok := v[r]; !ok {
+			return errorf(join(path, r), "is required")
+		}
+	}
+	keys := make([]string, 0, len(s.Properties))
+	for k := range s.Properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		pv, ok := v[k]
+		if !ok {
+			continue
+		}
+		if err := s.Properties[k].validate(join(path, k), pv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasType(v any, t string) bool {
+	switch t {
+	case TypeString:
+		_, ok := v.(string)
+		return ok
+	case TypeNumber:
+		_, ok := v.(float64)
+		return ok
+	case TypeInteger:
+		f, ok := v.(float64)
+		return ok && f == float64(int64(f))
+	case TypeBoolean:
+		_, ok := v.(bool)
+		return ok
+	case TypeObject:
+		_, ok := v.(map[string]any)
+		return ok
+	case TypeArray:
+		_, ok := v.([]any)
+		return ok
+	}
+	return false
+}
+
+func inEnum(v any, enum []any) bool {
+	for _, e := range enum {
+		if reflect.DeepEqual(v, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func errorf(path, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	if path == "" {
+		return errors.New("value " + msg)
+	}
+	return errors.Errorf("%s %s", path, msg)
+}
@@ -0,0 +1,180 @@
+// /*
+// Copyright 2025 The Upbound Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+// */
+
+package schema
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestParse(t *testing.T) {
+	type args struct {
+		j string
+	}
+	type want struct {
+		err error
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"Empty": {
+			reason: "An empty schema should be valid.",
+			args: args{
+				j: "",
+			},
+		},
+		"Supported": {
+			reason: "A schema using supported keywords should be valid.",
+			args: args{
+				j: `{"type": "object", "properties": {"tier": {"type": "string", "enum": ["small", "large"]}}, "required": ["tier"]}`,
+			},
+		},
+		"Unsupported": {
+			reason: "A schema using unsupported keywords should return an error.",
+			args: args{
+				j: `{"type": "object", "additionalProperties": false}`,
+			},
+			want: want{
+				err: cmpopts.AnyError,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse([]byte(tc.args.j))
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("\n%s\nParse(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	minimum := float64(1)
+	maxLength := 3
+
+	type args struct {
+		s *Schema
+		v any
+	}
+	type want struct {
+		err string
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"NilSchema": {
+			reason: "A nil schema should accept any value.",
+			args: args{
+				v: "anything",
+			},
+		},
+		"WrongType": {
+			reason: "A value of the wrong type should be rejected.",
+			args: args{
+				s: &Schema{Type: TypeString},
+				v: float64(1),
+			},
+			want: want{
+				err: "value must be of type string",
+			},
+		},
+		"Integer": {
+			reason: "A whole number should satisfy the integer type.",
+			args: args{
+				s: &Schema{Type: TypeInteger},
+				v: float64(3),
+			},
+		},
+		"NotInEnum": {
+			reason: "A value that isn't in the enum should be rejected.",
+			args: args{
+				s: &Schema{Enum: []any{"small", "large"}},
+				v: "medium",
+			},
+			want: want{
+				err: "value must be one of [small large]",
+			},
+		},
+		"BelowMinimum": {
+			reason: "A number below the minimum should be rejected.",
+			args: args{
+				s: &Schema{Minimum: &minimum},
+				v: float64(0),
+			},
+			want: want{
+				err: "value must be at least 1",
+			},
+		},
+		"MissingRequired": {
+			reason: "An object missing a required property should be rejected.",
+			args: args{
+				s: &Schema{Type: TypeObject, Required: []string{"cidr"}},
+				v: map[string]any{},
+			},
+			want: want{
+				err: "cidr is required",
+			},
+		},
+		"NestedProperty": {
+			reason: "Nested properties and array items should be validated with their path.",
+			args: args{
+				s: &Schema{Type: TypeObject, Properties: map[string]*Schema{
+					"zones": {Type: TypeArray, Items: &Schema{Type: TypeString, MaxLength: &maxLength}},
+				}},
+				v: map[string]any{"zones": []any{"a", "abcd"}},
+			},
+			want: want{
+				err: "zones[1] must be at most 3 characters",
+			},
+		},
+		"Pattern": {
+			reason: "A string that doesn't match the pattern should be rejected.",
+			args: args{
+				s: &Schema{Pattern: `^10\.`},
+				v: "192.168.0.0/16",
+			},
+			want: want{
+				err: `value must match pattern "^10\\."`,
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.args.s.Validate(tc.args.v)
+
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if diff := cmp.Diff(tc.want.err, got); diff != "" {
+				t.Errorf("\n%s\nValidate(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
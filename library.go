@@ -0,0 +1,173 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"path"
+	"strings"
+	"text/template"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/crossplane/function-sdk-go/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+)
+
+// builtinFragments are the prompt fragments built into the function. Each
+// file's name, without its extension, is the fragment's name.
+//
+//go:embed prompts/*.md
+var builtinFragments embed.FS
+
+// defaultLibraryNamespace is the namespace prompt library ConfigMaps are
+// loaded from if none is specified.
+const defaultLibraryNamespace = "crossplane-system"
+
+// libraryRequirementPrefix prefixes the names under which the function
+// requires prompt library ConfigMaps.
+const libraryRequirementPrefix = requirementPrefix + "prompt-library/"
+
+// maxIncludeDepth limits how deeply fragments may include other fragments.
+const maxIncludeDepth = 10
+
+// A promptLibrary maps prompt fragment names to their content.
+type promptLibrary map[string]string
+
+// libraryRequirements adds selectors for the ConfigMaps of the supplied prompt
+// libraries to the supplied requirements.
+func libraryRequirements(rq *fnv1.Requirements, libs []v1alpha1.PromptLibrary) *fnv1.Requirements {
+	if len(libs) == 0 {
+		return rq
+	}
+	if rq == nil {
+		rq = &fnv1.Requirements{}
+	}
+	if rq.Resources == nil {
+		rq.Resources = map[string]*fnv1.ResourceSelector{}
+	}
+	for _, l := range libs {
+		ns := l.Namespace
+		if ns == "" {
+			ns = defaultLibraryNamespace
+		}
+		rq.Resources[libraryRequirementPrefix+l.Name] = &fnv1.ResourceSelector{
+			ApiVersion: "v1",
+			Kind:       "ConfigMap",
+			Namespace:  &ns,
+			Match:      &fnv1.ResourceSelector_MatchName{MatchName: l.Name},
+		}
+	}
+	return rq
+}
+
+// loadPromptLibrary returns the built in prompt fragments, overridden by the
+// fragments of the supplied libraries' ConfigMaps.
+func loadPromptLibrary(libs []v1alpha1.PromptLibrary, rr map[string][]resource.Required) (promptLibrary, error) {
+	lib := promptLibrary{}
+	err := fs.WalkDir(builtinFragments, "prompts", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := builtinFragments.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		lib[strings.TrimSuffix(path.Base(p), path.Ext(p))] = string(b)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot load built in prompt fragments")
+	}
+
+	for _, l := range libs {
+		rs := rr[libraryRequirementPrefix+l.Name]
+		if len(rs) != 1 {
+			return nil, errors.Errorf("cannot find prompt library ConfigMap %q", l.Name)
+		}
+		data, _, err := unstructured.NestedStringMap(rs[0].Resource.Object, "data")
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read data of prompt library ConfigMap %q", l.Name)
+		}
+		for name, fragment := range data {
+			lib[name] = fragment
+		}
+	}
+	return lib, nil
+}
+
+// systemPrompt returns the system prompt for the supplied input; the system
+// prompt of its preset and the fragment it references, if any, followed by the
+// input's system prompt.
+func (l promptLibrary) systemPrompt(in *v1alpha1.Prompt) (string, error) {
+	parts := make([]string, 0, 3)
+	if in.Preset != "" {
+		p, err := l.presetSystemPrompt(in)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, p)
+	}
+	if in.SystemPromptRef != nil {
+		f, ok := l[in.SystemPromptRef.Name]
+		if !ok {
+			return "", errors.Errorf("unknown prompt fragment %q", in.SystemPromptRef.Name)
+		}
+		parts = append(parts, f)
+	}
+	if in.SystemPrompt != "" {
+		parts = append(parts, in.SystemPrompt)
+	}
+	for i := range parts {
+		parts[i] = strings.TrimRight(parts[i], "\n")
+	}
+	return strings.Join(parts, "\n\n"), nil
+}
+
+// funcs returns the functions available to prompt templates, including an
+// include function that renders the library's fragments, e.g.
+// {{ include "krm-rules-v1" . }}.
+func (l promptLibrary) funcs() template.FuncMap {
+	fns := templateFuncs()
+	depth := 0
+	fns["include"] = func(name string, data any) (string, error) {
+		f, ok := l[name]
+		if !ok {
+			return "", errors.Errorf("unknown prompt fragment %q", name)
+		}
+		if depth >= maxIncludeDepth {
+			return "", errors.Errorf("cannot include prompt fragment %q: fragments are nested more than %d deep", name, maxIncludeDepth)
+		}
+		depth++
+		defer func() { depth-- }()
+
+		t, err := template.New(name).Funcs(fns).Parse(f)
+		if err != nil {
+			return "", errors.Wrapf(err, "cannot parse prompt fragment %q", name)
+		}
+		b := &strings.Builder{}
+		if err := t.Execute(b, data); err != nil {
+			return "", errors.Wrapf(err, "cannot render prompt fragment %q", name)
+		}
+		return b.String(), nil
+	}
+	return fns
+}
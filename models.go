@@ -0,0 +1,191 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+
+	"github.com/crossplane/function-sdk-go/errors"
+	"github.com/crossplane/function-sdk-go/logging"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/response"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+)
+
+// defaultFallbackOn are the errors that cause the next model to be used if
+// none are configured.
+var defaultFallbackOn = []v1alpha1.FallbackCondition{
+	v1alpha1.FallbackOnOverloaded,
+	v1alpha1.FallbackOnRateLimited,
+	v1alpha1.FallbackOnContextTooLong,
+}
+
+// fallbackPatterns identify errors by their lower case message. The Anthropic
+// API returns 529 when overloaded, 429 when rate limited, and "prompt is too
+// long" when the prompt exceeds the context window.
+var fallbackPatterns = map[v1alpha1.FallbackCondition][]string{
+	v1alpha1.FallbackOnOverloaded:     {"status code: 529", "status code: 503", "overloaded"},
+	v1alpha1.FallbackOnRateLimited:    {"status code: 429", "rate limit"},
+	v1alpha1.FallbackOnContextTooLong: {"prompt is too long", "context window", "context length"},
+}
+
+// choosesModel returns true if the function chooses among models, rather than
+// using the single modelName.
+func choosesModel(in *v1alpha1.Prompt) bool {
+	return len(in.Models) > 0 || len(in.ModelRoutes) > 0
+}
+
+// routesBySpec returns true if any of the supplied input's model routes match
+// on whether the XR's spec is unchanged.
+func routesBySpec(in *v1alpha1.Prompt) bool {
+	for _, r := range in.ModelRoutes {
+		if r.SpecUnchanged {
+			return true
+		}
+	}
+	return false
+}
+
+// specUnchanged returns true if there are observed composed resources, and the
+// observed XR's spec and the prompt are unchanged since they were composed.
+// It's always false outside composition pipelines.
+func specUnchanged(req *fnv1.RunFunctionRequest, in *v1alpha1.Prompt, lib promptLibrary) bool {
+	xr := req.GetObserved().GetComposite()
+	if xr == nil || len(req.GetObserved().GetResources()) == 0 {
+		return false
+	}
+	fp, err := specFingerprint(xr, in, lib)
+	return err == nil && annotations(xr)[annotationSpecFingerprint] == fp
+}
+
+// routeModel returns the model of the first route that matches the supplied
+// estimated prompt size and whether the XR's spec is unchanged, or an empty
+// string if no route matches.
+func routeModel(routes []v1alpha1.ModelRoute, tokens int, unchanged bool) string {
+	for _, r := range routes {
+		if r.MaxPromptTokens != nil && tokens > *r.MaxPromptTokens {
+			continue
+		}
+		if r.SpecUnchanged && !unchanged {
+			continue
+		}
+		return r.Model
+	}
+	return ""
+}
+
+// modelChain returns the models to try, in order. The routed model, if any,
+// is tried first. An empty model name means the default model.
+func modelChain(in *v1alpha1.Prompt, routed string) []string {
+	models := in.Models
+	if len(models) == 0 {
+		models = []string{in.ModelName}
+	}
+	chain := make([]string, 0, len(models)+1)
+	if routed != "" {
+		chain = append(chain, routed)
+	}
+	for _, m := range models {
+		if !slices.Contains(chain, m) {
+			chain = append(chain, m)
+		}
+	}
+	return chain
+}
+
+// fallbackCondition returns the condition the supplied error represents, if
+// any.
+func fallbackCondition(err error) (v1alpha1.FallbackCondition, bool) {
+	if llms.IsRateLimitError(err) {
+		return v1alpha1.FallbackOnRateLimited, true
+	}
+	if llms.IsTokenLimitError(err) {
+		return v1alpha1.FallbackOnContextTooLong, true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, c := range defaultFallbackOn {
+		for _, p := range fallbackPatterns[c] {
+			if strings.Contains(msg, p) {
+				return c, true
+			}
+		}
+	}
+	return "", false
+}
+
+// fallsBackOn returns true if the supplied input falls back to the next model
+// on the supplied condition.
+func fallsBackOn(in *v1alpha1.Prompt, c v1alpha1.FallbackCondition) bool {
+	if len(in.FallbackOn) == 0 {
+		return slices.Contains(defaultFallbackOn, c)
+	}
+	return slices.Contains(in.FallbackOn, c)
+}
+
+// modelName returns the supplied model name, or the default model if it's
+// empty.
+func modelName(m string) string {
+	if m == "" {
+		return defaultModel
+	}
+	return m
+}
+
+// invoke invokes Claude with each model in the chain in turn, until one
+// succeeds or fails with an error the input doesn't fall back on. The
+// unchanged argument is true if the XR's spec is unchanged since the last
+// composition. If the function chooses among models it reports the model it
+// used, and if prompt caching is enabled it reports cache usage. Thinking is
+// stripped from the response.
+func (f *Function) invoke(ctx context.Context, log logging.Logger, d pipelineDetails, system, prompt string, unchanged bool, opts ...invokeOption) (string, error) {
+	prompt, cacheable := cacheablePrefixes(d.in, system, prompt)
+	u := &usage{}
+	opts = append(opts, withCaching(cacheable, u))
+
+	routed := routeModel(d.in.ModelRoutes, estimateTokens(system, prompt), unchanged)
+	chain := modelChain(d.in, routed)
+
+	var err error
+	for i, m := range chain {
+		var resp string
+		resp, err = f.ai.Invoke(ctx, d.cred, system, prompt, m, opts...)
+		if err == nil {
+			log.Debug("Invoked Claude", "model", modelName(m), "routed", routed != "" && m == routed, "usage", u)
+			if choosesModel(d.in) {
+				response.Normalf(d.rsp, "invoked Claude using model %s", modelName(m))
+			}
+			if promptCachingEnabled(d.in) {
+				reportUsage(d.rsp, u)
+			}
+			return stripThinking(resp), nil
+		}
+
+		c, ok := fallbackCondition(err)
+		if !ok || !fallsBackOn(d.in, c) || i == len(chain)-1 {
+			return "", err
+		}
+		next := modelName(chain[i+1])
+		log.Debug("Falling back to the next model", "model", modelName(m), "next", next, "condition", c, "error", err)
+		response.Warning(d.rsp, errors.Wrapf(err, "model %s failed (%s), falling back to model %s", modelName(m), c, next))
+	}
+	return "", err
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+
+	"github.com/crossplane/function-sdk-go/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+)
+
+const (
+	// outputTag delimits the output value in Claude's response.
+	outputTag = "output"
+
+	// annotationOutputUpdatedAt records when the output value was last
+	// written to the watched resource, in RFC 3339 format.
+	annotationOutputUpdatedAt = "claude.fn.upbound.io/output-updated-at"
+
+	// defaultOutputMaxLength is the default maximum length of an output
+	// value.
+	defaultOutputMaxLength = 256
+
+	// labelValueMaxLength is the maximum length of a label value.
+	labelValueMaxLength = 63
+)
+
+// outputEnabled returns true if the supplied input asks for an output value.
+func outputEnabled(in *v1alpha1.Prompt) bool {
+	return in.Output != nil
+}
+
+// outputInstructions returns instructions asking Claude for the supplied
+// output value.
+func outputInstructions(o *v1alpha1.Output) string {
+	s := fmt.Sprintf(`
+After your response, return the value %q inside <output></output> tags.`, o.Name)
+	if o.Description != "" {
+		s += fmt.Sprintf(" %s", o.Description)
+	}
+	return s + `
+The content of the tags must be a single YAML scalar, list, or map.`
+}
+
+// validateOutput returns an error if the supplied output doesn't set exactly
+// one target.
+func validateOutput(o *v1alpha1.Output) error {
+	set := 0
+	for _, t := range []string{o.Annotation, o.Label, o.StatusPath} {
+		if t != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.Errorf("output %q must specify exactly one of annotation, label, and statusPath", o.Name)
+	}
+	return nil
+}
+
+// validateOperationOutput returns an error if the supplied output is invalid,
+// or if there's no watched resource to write it to.
+func validateOperationOutput(o *v1alpha1.Output, watched map[string]any) error {
+	if err := validateOutput(o); err != nil {
+		return err
+	}
+	if watched == nil {
+		return errors.New("outputs require a watched resource")
+	}
+	return nil
+}
+
+// operationOutput splits the supplied response into the rest of the response
+// and the output value, if the input asks for one.
+func operationOutput(in *v1alpha1.Prompt, resp string) (string, any, error) {
+	if !outputEnabled(in) {
+		return resp, nil, nil
+	}
+	return splitOutput(resp)
+}
+
+// splitOutput splits the supplied response into the rest of the response and
+// the output value.
+func splitOutput(resp string) (string, any, error) {
+	rest, body, found, err := splitSection(resp, outputTag)
+	if err != nil {
+		return rest, nil, err
+	}
+	if !found {
+		return rest, nil, errors.Errorf("missing <%s> section", outputTag)
+	}
+	var v any
+	if err := yaml.Unmarshal([]byte(body), &v); err != nil {
+		return rest, nil, errors.Wrap(err, "cannot parse output value as YAML")
+	}
+	return rest, v, nil
+}
+
+// writeOutput adds the supplied output value, and the time it was written, to
+// the desired state of the watched resource. The desired state is unchanged if
+// the watched resource already has the value. Writing to the watched resource
+// may trigger the operation again, so unchanged values aren't rewritten.
+func writeOutput(desired map[string]*fnv1.Resource, watched map[string]any, o *v1alpha1.Output, v any, now time.Time) (map[string]*fnv1.Resource, error) {
+	path := outputPath(o)
+	sv, err := outputValue(o, v)
+	if err != nil {
+		return nil, err
+	}
+	if current, ok, _ := unstructured.NestedFieldNoCopy(watched, path...); ok {
+		if cv, err := structpb.NewValue(current); err == nil && proto.Equal(cv, sv) {
+			return desired, nil
+		}
+	}
+
+	desired, p, err := watchedPatch(desired, watched)
+	if err != nil {
+		return nil, err
+	}
+	s := p
+	for _, part := range path[:len(path)-1] {
+		s = subStruct(s, part)
+	}
+	s.Fields[path[len(path)-1]] = sv
+
+	subStruct(subStruct(p, "metadata"), "annotations").Fields[annotationOutputUpdatedAt] = structpb.NewStringValue(now.UTC().Format(time.RFC3339))
+	return desired, nil
+}
+
+// outputPath returns the path of the field of the watched resource the
+// supplied output is written to.
+func outputPath(o *v1alpha1.Output) []string {
+	switch {
+	case o.Annotation != "":
+		return []string{"metadata", "annotations", o.Annotation}
+	case o.Label != "":
+		return []string{"metadata", "labels", o.Label}
+	}
+	return append([]string{"status"}, strings.Split(strings.TrimPrefix(o.StatusPath, "status."), ".")...)
+}
+
+// outputValue returns the supplied output value as it's written to the watched
+// resource. Annotations and labels are strings. Strings are truncated. Other
+// values are written as is.
+func outputValue(o *v1alpha1.Output, v any) (*structpb.Value, error) {
+	limit := defaultOutputMaxLength
+	if o.MaxLength != nil {
+		limit = *o.MaxLength
+	}
+
+	switch {
+	case o.Annotation != "":
+		return structpb.NewStringValue(truncate(outputString(v), limit)), nil
+	case o.Label != "":
+		return structpb.NewStringValue(labelValue(outputString(v), min(limit, labelValueMaxLength))), nil
+	}
+	if s, ok := v.(string); ok {
+		v = truncate(s, limit)
+	}
+	sv, err := structpb.NewValue(v)
+	return sv, errors.Wrap(err, "cannot convert output value")
+}
+
+// outputString returns the supplied output value as a string. Values that
+// aren't strings are encoded as JSON.
+func outputString(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	j, _ := json.Marshal(v)
+	return string(j)
+}
+
+// labelValue returns the supplied string as a valid label value of at most
+// limit characters. Invalid characters are replaced with '-', and leading and
+// trailing characters that aren't alphanumeric are removed.
+func labelValue(s string, limit int) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			b[i] = '-'
+		}
+	}
+	if len(b) > limit {
+		b = b[:limit]
+	}
+	return strings.Trim(string(b), "-_.")
+}
+
+// watchedPatch returns the desired state of the supplied watched resource,
+// adding a minimal patch that identifies it to the desired resources if they
+// don't already include it.
+func watchedPatch(desired map[string]*fnv1.Resource, watched map[string]any) (map[string]*fnv1.Resource, *structpb.Struct, error) {
+	if desired == nil {
+		desired = map[string]*fnv1.Resource{}
+	}
+	w := &unstructured.Unstructured{Object: watched}
+	key := resourceKey(w)
+
+	if dw, ok := desired[key]; ok {
+		if dw.GetResource() == nil {
+			dw.Resource = &structpb.Struct{}
+		}
+		return desired, dw.GetResource(), nil
+	}
+
+	p := &unstructured.Unstructured{}
+	p.SetAPIVersion(w.GetAPIVersion())
+	p.SetKind(w.GetKind())
+	p.SetNamespace(w.GetNamespace())
+	p.SetName(w.GetName())
+	s, err := structpb.NewStruct(p.Object)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot convert watched resource patch")
+	}
+	desired[key] = &fnv1.Resource{Resource: s}
+	return desired, s, nil
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"google.golang.org/protobuf/types/known/structpb"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+
+	"github.com/crossplane/function-sdk-go/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+	"github.com/upbound/function-claude/internal/schema"
+)
+
+// playbookEnabled returns true if the supplied input configures a playbook.
+func playbookEnabled(in *v1alpha1.Prompt) bool {
+	return in.Playbook != nil && len(in.Playbook.Actions) > 0
+}
+
+// playbookInstructions returns instructions asking Claude to choose from the
+// supplied playbook's actions, answering with the list actionsFrom parses.
+func playbookInstructions(pb *v1alpha1.Playbook) string {
+	b := &strings.Builder{}
+	b.WriteString(`
+Do not return any Kubernetes manifests. You may only remediate the resource
+using the actions below. Respond only with a YAML list of the actions to take,
+in order. Each item must have the following fields:
+- action: The name of the action.
+- parameters: A YAML map of the action's parameters. Omit this field if the
+  action takes no parameters.
+Respond with an empty list if no action is needed. The actions are:
+`)
+	for _, a := range pb.Actions {
+		fmt.Fprintf(b, "- %s:", a.Name)
+		if a.Description != "" {
+			fmt.Fprintf(b, " %s", a.Description)
+		}
+		if a.Parameters != nil && len(a.Parameters.Raw) > 0 {
+			s := &bytes.Buffer{}
+			if err := json.Compact(s, a.Parameters.Raw); err == nil {
+				fmt.Fprintf(b, " Its parameters must satisfy the JSON schema %s.", s.String())
+			}
+		} else {
+			b.WriteString(" It takes no parameters.")
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// A chosenAction is an action Claude chose to take.
+type chosenAction struct {
+	Action     string         `json:"action"`
+	Parameters map[string]any `json:"parameters,omitempty"`
+}
+
+// String returns a concise, human readable representation of the action.
+func (c chosenAction) String() string {
+	if len(c.Parameters) == 0 {
+		return c.Action
+	}
+	j, _ := json.Marshal(c.Parameters)
+	return fmt.Sprintf("%s %s", c.Action, j)
+}
+
+// actionsFrom parses the supplied response as a list of actions. Every action
+// must be in the supplied playbook, and its parameters must satisfy the
+// action's schema.
+func actionsFrom(resp string, pb *v1alpha1.Playbook) ([]chosenAction, error) {
+	cs := make([]chosenAction, 0)
+	if err := yaml.Unmarshal([]byte(stripMarkdownCodeBlocks(resp)), &cs); err != nil {
+		return nil, errors.Wrap(err, "cannot parse actions as a YAML list")
+	}
+
+	for i, c := range cs {
+		a, ok := playbookAction(pb, c.Action)
+		if !ok {
+			return nil, errors.Errorf("action %d: %q is not in the playbook", i, c.Action)
+		}
+		if a.Parameters == nil || len(a.Parameters.Raw) == 0 {
+			if len(c.Parameters) > 0 {
+				return nil, errors.Errorf("action %d: %q takes no parameters", i, c.Action)
+			}
+			continue
+		}
+		s, err := schema.Parse(a.Parameters.Raw)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid parameters schema for action %q", a.Name)
+		}
+		var params any = map[string]any{}
+		if c.Parameters != nil {
+			params = c.Parameters
+		}
+		if err := s.Validate(params); err != nil {
+			return nil, errors.Wrapf(err, "action %d: invalid parameters for %q", i, c.Action)
+		}
+	}
+	return cs, nil
+}
+
+// remediate parses the supplied response as a list of actions from the
+// supplied playbook, and returns the patch of the watched resource they
+// produce, and a summary of the actions.
+func remediate(pb *v1alpha1.Playbook, resp string, watched map[string]any) (map[string]*fnv1.Resource, string, error) {
+	cs, err := actionsFrom(resp, pb)
+	if err != nil {
+		return nil, "", err
+	}
+	desired, err := remediationPatch(pb, cs, watched)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(cs) == 0 {
+		return nil, "no remediation actions needed", nil
+	}
+	taken := make([]string, len(cs))
+	for i, c := range cs {
+		taken[i] = c.String()
+	}
+	return desired, "remediation actions: " + strings.Join(taken, ", "), nil
+}
+
+// playbookAction returns the named action of the supplied playbook.
+func playbookAction(pb *v1alpha1.Playbook, name string) (v1alpha1.Action, bool) {
+	for _, a := range pb.Actions {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return v1alpha1.Action{}, false
+}
+
+// remediationPatch renders the supplied actions and merges them into a single
+// patch of the supplied watched resource. Actions are merged in order, and may
+// not set the same field to different values.
+func remediationPatch(pb *v1alpha1.Playbook, cs []chosenAction, watched map[string]any) (map[string]*fnv1.Resource, error) {
+	if len(cs) == 0 {
+		return nil, nil
+	}
+
+	patch := map[string]any{}
+	for i, c := range cs {
+		a, _ := playbookAction(pb, c.Action)
+		p, err := renderActionPatch(a, c.Parameters)
+		if err != nil {
+			return nil, errors.Wrapf(err, "action %d: cannot render patch for %q", i, c.Action)
+		}
+		if err := mergePatch(patch, p, ""); err != nil {
+			return nil, errors.Wrapf(err, "action %d: cannot merge patch for %q", i, c.Action)
+		}
+	}
+
+	// The patch always targets the watched resource, whatever the action's
+	// patch says.
+	w := &unstructured.Unstructured{Object: watched}
+	u := &unstructured.Unstructured{Object: patch}
+	u.SetAPIVersion(w.GetAPIVersion())
+	u.SetKind(w.GetKind())
+	u.SetName(w.GetName())
+	u.SetNamespace(w.GetNamespace())
+
+	s, err := structpb.NewStruct(u.Object)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot convert patch")
+	}
+	return map[string]*fnv1.Resource{resourceKey(w): {Resource: s}}, nil
+}
+
+// renderActionPatch renders the supplied action's patch template with the
+// supplied parameters. Parameters are rendered as JSON literals, so they can't
+// change the structure of the patch.
+func renderActionPatch(a v1alpha1.Action, params map[string]any) (map[string]any, error) {
+	t, err := template.New(a.Name).Option("missingkey=error").Parse(a.Patch)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse patch template")
+	}
+	literals := make(map[string]string, len(params))
+	for k, v := range params {
+		j, err := json.Marshal(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot encode parameter %q", k)
+		}
+		literals[k] = string(j)
+	}
+	b := &bytes.Buffer{}
+	if err := t.Execute(b, map[string]any{"Params": literals}); err != nil {
+		return nil, errors.Wrap(err, "cannot execute patch template")
+	}
+	p := map[string]any{}
+	if err := yaml.Unmarshal(b.Bytes(), &p); err != nil {
+		return nil, errors.Wrap(err, "cannot parse rendered patch as a YAML map")
+	}
+	return p, nil
+}
+
+// mergePatch merges src into dst. Maps are merged recursively. Any other
+// field set in both must have the same value.
+func mergePatch(dst, src map[string]any, path string) error {
+	for k, sv := range src {
+		p := k
+		if path != "" {
+			p = path + "." + k
+		}
+		dv, ok := dst[k]
+		if !ok {
+			dst[k] = sv
+			continue
+		}
+		dm, dok := dv.(map[string]any)
+		sm, sok := sv.(map[string]any)
+		if dok && sok {
+			if err := mergePatch(dm, sm, p); err != nil {
+				return err
+			}
+			continue
+		}
+		if !reflect.DeepEqual(dv, sv) {
+			return errors.Errorf("conflicting values for field %s", p)
+		}
+	}
+	return nil
+}
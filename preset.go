@@ -0,0 +1,140 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/crossplane/function-sdk-go/errors"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+)
+
+// builtinPresets are the presets built into the function. Each preset is a
+// directory named for the preset and its version, e.g. krm-compose/v1,
+// containing a system.md system prompt and a user.md user prompt template.
+// Both are templates, and include prompt library fragments by reference.
+//
+//go:embed presets
+var builtinPresets embed.FS
+
+// presetTaskTemplate is the name of the template presets use to include the
+// user prompt, e.g. {{ template "task" . }}.
+const presetTaskTemplate = "task"
+
+// presetPipelines maps each built in preset to the kind of pipeline its
+// prompts are written for.
+var presetPipelines = map[string]string{
+	"krm-compose": "composition",
+	"krm-operate": "operation",
+}
+
+// A preset is a built in, versioned pair of prompts.
+type preset struct {
+	system string
+	user   string
+}
+
+// loadPreset returns the named preset.
+func loadPreset(name string) (preset, error) {
+	dir := path.Join("presets", name)
+	if !fs.ValidPath(dir) || path.Dir(path.Dir(dir)) != "presets" {
+		return preset{}, errors.Errorf("invalid preset %q: presets are named <name>/<version>, e.g. krm-compose/v1", name)
+	}
+	sys, err := builtinPresets.ReadFile(path.Join(dir, "system.md"))
+	if err != nil {
+		return preset{}, errors.Errorf("unknown preset %q", name)
+	}
+	usr, err := builtinPresets.ReadFile(path.Join(dir, "user.md"))
+	if err != nil {
+		return preset{}, errors.Errorf("unknown preset %q", name)
+	}
+	return preset{system: string(sys), user: string(usr)}, nil
+}
+
+// validatePresetPipeline returns an error if the named preset is written for a
+// different kind of pipeline than the one the function is running in.
+func validatePresetPipeline(name string, composition bool) error {
+	want, ok := presetPipelines[path.Dir(name)]
+	if !ok {
+		return nil
+	}
+	got := "operation"
+	if composition {
+		got = "composition"
+	}
+	if want != got {
+		return errors.Errorf("preset %q can only be used in %s pipelines", name, want)
+	}
+	return nil
+}
+
+// presetSystemData is the data preset system prompts are rendered with.
+type presetSystemData struct {
+	// Manifests is true unless the input asks Claude for findings or
+	// playbook actions instead of manifests.
+	Manifests bool
+}
+
+// presetSystemPrompt returns the rendered system prompt of the supplied input's
+// preset.
+func (l promptLibrary) presetSystemPrompt(in *v1alpha1.Prompt) (string, error) {
+	p, err := loadPreset(in.Preset)
+	if err != nil {
+		return "", err
+	}
+	t, err := template.New(in.Preset).Funcs(l.funcs()).Parse(p.system)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot parse system prompt of preset %q", in.Preset)
+	}
+	b := &strings.Builder{}
+	data := presetSystemData{Manifests: !reportEnabled(in) && !playbookEnabled(in)}
+	if err := t.Execute(b, data); err != nil {
+		return "", errors.Wrapf(err, "cannot render system prompt of preset %q", in.Preset)
+	}
+	return b.String(), nil
+}
+
+// promptTemplate returns the user prompt template for the supplied input. If
+// the input uses a preset the user prompt is parsed as the preset's task.
+func promptTemplate(in *v1alpha1.Prompt, lib promptLibrary) (*template.Template, error) {
+	fns := lib.funcs()
+	t, err := parseTemplate("prompt", in.UserPrompt, fns)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse userPrompt")
+	}
+	if in.Preset == "" {
+		return t, nil
+	}
+
+	p, err := loadPreset(in.Preset)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := template.New(in.Preset).Funcs(fns).Parse(p.user)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse user prompt of preset %q", in.Preset)
+	}
+	if _, err := pt.AddParseTree(presetTaskTemplate, t.Tree); err != nil {
+		return nil, errors.Wrapf(err, "cannot add userPrompt to preset %q", in.Preset)
+	}
+	return pt, nil
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/types/known/structpb"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/crossplane/function-sdk-go/logging"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/response"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+)
+
+// annotationLastInvoked records when Claude was last invoked for a watched
+// resource, in RFC 3339 format.
+const annotationLastInvoked = "claude.fn.upbound.io/last-invoked"
+
+// A rateLimiter tracks invocations of Claude by each Prompt. Its zero value is
+// ready to use.
+type rateLimiter struct {
+	mu sync.Mutex
+
+	// cooling maps each Prompt and watched resource UID that is cooling down
+	// to the time its cooldown expires.
+	cooling map[string]time.Time
+	// calls reserved by each Prompt within the last minute, oldest first.
+	calls map[string][]time.Time
+}
+
+// Reserve an invocation of Claude by the Prompt identified by the supplied key
+// for the watched resource with the supplied UID, if the supplied rate limit
+// allows it. The UID may be empty if there is no watched resource. The
+// persisted time is the last invocation recorded on the watched resource, if
+// any. A nil rate limit allows every invocation.
+//
+// If the invocation is allowed Reserve counts it towards the limits
+// immediately, so concurrent runs can't exceed them, and returns a function
+// that releases the reservation if the invocation fails. If it isn't allowed
+// Reserve returns a reason.
+func (l *rateLimiter) Reserve(key string, rl *v1alpha1.RateLimit, uid string, persisted, now time.Time) (func(), bool, string) {
+	if rl == nil {
+		return func() {}, true, ""
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now)
+
+	cooling := key + "/" + uid
+	if wait := l.cooldown(rl, uid, cooling, persisted, now); wait > 0 {
+		return nil, false, fmt.Sprintf("watched resource is cooling down for another %s", wait.Round(time.Second))
+	}
+	if rl.MaxCallsPerMinute != nil && len(l.calls[key]) >= *rl.MaxCallsPerMinute {
+		return nil, false, fmt.Sprintf("limit of %d calls per minute reached", *rl.MaxCallsPerMinute)
+	}
+
+	if l.calls == nil {
+		l.calls = map[string][]time.Time{}
+	}
+	l.calls[key] = append(l.calls[key], now)
+
+	var expires time.Time
+	if rl.Cooldown != nil && uid != "" {
+		if l.cooling == nil {
+			l.cooling = map[string]time.Time{}
+		}
+		expires = now.Add(rl.Cooldown.Duration)
+		l.cooling[cooling] = expires
+	}
+
+	return func() { l.release(key, cooling, now, expires) }, true, ""
+}
+
+// release a reservation made at the supplied time. The cooldown is only
+// forgotten if no later reservation replaced it.
+func (l *rateLimiter) release(key, cooling string, at, expires time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	calls := l.calls[key]
+	for i := len(calls) - 1; i >= 0; i-- {
+		if calls[i].Equal(at) {
+			l.calls[key] = append(calls[:i:i], calls[i+1:]...)
+			break
+		}
+	}
+	if !expires.IsZero() && l.cooling[cooling].Equal(expires) {
+		delete(l.cooling, cooling)
+	}
+}
+
+// prune forgets calls that fell out of the last minute, and cooldowns that
+// expired.
+func (l *rateLimiter) prune(now time.Time) {
+	for key, calls := range l.calls {
+		for len(calls) > 0 && now.Sub(calls[0]) >= time.Minute {
+			calls = calls[1:]
+		}
+		if len(calls) == 0 {
+			delete(l.calls, key)
+			continue
+		}
+		l.calls[key] = calls
+	}
+	for cooling, expires := range l.cooling {
+		if !now.Before(expires) {
+			delete(l.cooling, cooling)
+		}
+	}
+}
+
+// cooldown returns how much longer the watched resource with the supplied UID
+// is cooling down for the supplied Prompt. It returns zero or less if it isn't
+// cooling down.
+func (l *rateLimiter) cooldown(rl *v1alpha1.RateLimit, uid, cooling string, persisted, now time.Time) time.Duration {
+	if rl.Cooldown == nil || uid == "" {
+		return 0
+	}
+	expires := l.cooling[cooling]
+	if !persisted.IsZero() && persisted.Add(rl.Cooldown.Duration).After(expires) {
+		expires = persisted.Add(rl.Cooldown.Duration)
+	}
+	return expires.Sub(now)
+}
+
+// rateLimited returns true, and reports why, if the input's rate limit doesn't
+// allow Claude to be invoked for the supplied watched resource, which may be
+// nil. If it's allowed it returns a function that releases the invocation's
+// reservation, to be called if the invocation fails.
+func (f *Function) rateLimited(log logging.Logger, d pipelineDetails, watched map[string]any) (func(), bool) {
+	release, ok, reason := f.limiter.Reserve(rateLimitKey(d.in), d.in.RateLimit, watchedUID(watched), lastInvoked(watched), f.now())
+	if ok {
+		return release, false
+	}
+	log.Debug("Rate limited, skipping", "reason", reason)
+	response.ConditionTrue(d.rsp, "FunctionSuccess", "Success").TargetCompositeAndClaim()
+	response.Normalf(d.rsp, "skipping, %s", reason)
+	return nil, true
+}
+
+// rateLimitKey identifies the supplied Prompt to the rate limiter. Crossplane
+// doesn't tell the function which Operation it's running for, so Prompts are
+// identified by their content.
+func rateLimitKey(in *v1alpha1.Prompt) string {
+	// Identical Prompts marshal identically, so they share a key.
+	j, _ := json.Marshal(in) //nolint:errchkjson // A Prompt always marshals.
+	sum := sha256.Sum256(j)
+	return hex.EncodeToString(sum[:])
+}
+
+// watchedUID returns the UID of the supplied watched resource, or an empty
+// string if it's nil.
+func watchedUID(watched map[string]any) string {
+	if watched == nil {
+		return ""
+	}
+	return string((&unstructured.Unstructured{Object: watched}).GetUID())
+}
+
+// lastInvoked returns the last invocation time persisted on the supplied
+// watched resource, or the zero time if there is none.
+func lastInvoked(watched map[string]any) time.Time {
+	u := &unstructured.Unstructured{Object: watched}
+	t, err := time.Parse(time.RFC3339, u.GetAnnotations()[annotationLastInvoked])
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// persistLastInvoked adds the supplied invocation time to the desired state of
+// the supplied watched resource.
+func persistLastInvoked(desired map[string]*fnv1.Resource, watched map[string]any, now time.Time) (map[string]*fnv1.Resource, error) {
+	desired, p, err := watchedPatch(desired, watched)
+	if err != nil {
+		return nil, err
+	}
+	a := subStruct(subStruct(p, "metadata"), "annotations")
+	a.Fields[annotationLastInvoked] = structpb.NewStringValue(now.UTC().Format(time.RFC3339))
+	return desired, nil
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/types/known/structpb"
+	"sigs.k8s.io/yaml"
+
+	"github.com/crossplane/function-sdk-go/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/response"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+)
+
+const (
+	// annotationRationale records why Claude composed a resource the way it
+	// did.
+	annotationRationale = "claude.fn.upbound.io/rationale"
+
+	// defaultRationaleMaxLength is the default maximum length of a single
+	// resource's rationale.
+	defaultRationaleMaxLength = 256
+
+	rationaleTag = "rationale"
+)
+
+// rationaleInstructions are appended to the system prompt when a rationale is
+// requested.
+const rationaleInstructions = `
+After the YAML stream, explain your decisions inside <rationale></rationale>
+tags. The content of the tags must be a YAML map. Each key must be the
+"upbound.io/name" annotation of a manifest you created, updated, or deleted.
+Each value must be a single sentence explaining why. Do not put anything else
+inside the tags, and do not put the tags inside the YAML stream.`
+
+// rationaleEnabled returns true if the supplied input asks for a rationale.
+func rationaleEnabled(in *v1alpha1.Prompt) bool {
+	return in.Rationale != nil && in.Rationale.Enabled
+}
+
+// splitRationale splits the supplied response into its YAML stream and the
+// per-resource rationale that follows it, if any.
+func splitRationale(resp string) (string, map[string]string, error) {
+	manifests, body, found, err := splitSection(resp, rationaleTag)
+	if err != nil || !found {
+		return manifests, nil, err
+	}
+
+	r := map[string]string{}
+	if err := yaml.Unmarshal([]byte(body), &r); err != nil {
+		return manifests, nil, errors.Wrap(err, "cannot parse rationale as a YAML map")
+	}
+	return manifests, r, nil
+}
+
+// splitSection removes the first section delimited by the supplied tag, e.g.
+// <tag>body</tag>, from the supplied response. It returns the remaining
+// response, the section's body, and whether the section was found.
+func splitSection(resp, tag string) (string, string, bool, error) {
+	open, closing := "<"+tag+">", "</"+tag+">"
+
+	start := strings.Index(resp, open)
+	if start < 0 {
+		return resp, "", false, nil
+	}
+	end := strings.Index(resp[start:], closing)
+	if end < 0 {
+		return resp, "", false, errors.Errorf("missing closing %s tag", closing)
+	}
+	end += start
+
+	body := stripMarkdownCodeBlocks(resp[start+len(open) : end])
+	return resp[:start] + resp[end+len(closing):], body, true, nil
+}
+
+// reportRationale reports the supplied rationale as results, truncating each
+// to the configured maximum length. If requested, each rationale is also
+// added to the corresponding desired resource as an annotation.
+func reportRationale(rsp *fnv1.RunFunctionResponse, r *v1alpha1.Rationale, rationale map[string]string, dcds map[string]*fnv1.Resource) {
+	limit := defaultRationaleMaxLength
+	if r.MaxLength != nil {
+		limit = *r.MaxLength
+	}
+
+	names := make([]string, 0, len(rationale))
+	for name := range rationale {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		why := truncate(strings.TrimSpace(rationale[name]), limit)
+		response.Normalf(rsp, "rationale for %s: %s", name, why)
+
+		dcd, ok := dcds[name]
+		if !ok || !r.Annotate {
+			continue
+		}
+		a := subStruct(subStruct(dcd.GetResource(), "metadata"), "annotations")
+		a.Fields[annotationRationale] = structpb.NewStringValue(why)
+	}
+}
+
+// truncate the supplied string to at most limit characters, marking it as
+// truncated with an ellipsis.
+func truncate(s string, limit int) string {
+	r := []rune(s)
+	if len(r) <= limit {
+		return s
+	}
+	if limit <= 3 {
+		return string(r[:limit])
+	}
+	return string(r[:limit-3]) + "..."
+}
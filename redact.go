@@ -0,0 +1,367 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/crossplane/function-sdk-go/errors"
+	"github.com/crossplane/function-sdk-go/logging"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/response"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+)
+
+// placeholderPrefix prefixes the placeholders that replace redacted values.
+const placeholderPrefix = "REDACTED_"
+
+// defaultRedactKeys match the keys of values that are redacted by default.
+// They match keys whose values are themselves secrets, not keys that name or
+// reference secrets, e.g. secretName or keyRef.
+var defaultRedactKeys = []string{
+	`(?i)passw(or)?d$`,
+	`(?i)token$`,
+	`(?i)private[-_]?key$`,
+	`(?i)kubeconfig$`,
+}
+
+// A redactor replaces sensitive values in resources with placeholders before
+// they're supplied to the prompt template, and restores them in resources
+// produced from Claude's response. A nil redactor leaves resources untouched.
+type redactor struct {
+	keys  []*regexp.Regexp
+	paths []string
+
+	// redactions by placeholder.
+	values map[string]redaction
+}
+
+// A redaction is a value that was replaced by a placeholder, and where it was.
+type redaction struct {
+	resource redactedResource
+	path     string
+	value    string
+}
+
+// A redactedResource identifies the resource a value was redacted from.
+type redactedResource struct {
+	APIVersion string
+	Kind       string
+	Namespace  string
+	Name       string
+}
+
+// redactedResourceOf returns the identity of the supplied resource.
+func redactedResourceOf(j []byte) redactedResource {
+	return redactedResource{
+		APIVersion: gjson.GetBytes(j, "apiVersion").String(),
+		Kind:       gjson.GetBytes(j, "kind").String(),
+		Namespace:  gjson.GetBytes(j, "metadata.namespace").String(),
+		Name:       gjson.GetBytes(j, "metadata.name").String(),
+	}
+}
+
+// String returns the identity of the resource.
+func (r redactedResource) String() string {
+	return fmt.Sprintf("%s/%s/%s/%s", r.APIVersion, r.Kind, r.Namespace, r.Name)
+}
+
+// restorableIn returns true if a value redacted from this resource may be
+// restored in the supplied resource. Resources produced from Claude's response
+// often omit their name and namespace, e.g. composed resources, so they're
+// only compared if the supplied resource specifies them.
+func (r redactedResource) restorableIn(o redactedResource) bool {
+	return r.APIVersion == o.APIVersion && r.Kind == o.Kind &&
+		(o.Namespace == "" || r.Namespace == o.Namespace) &&
+		(o.Name == "" || r.Name == o.Name)
+}
+
+// newRedactor returns a redactor for the supplied input, or nil if the input
+// disables redaction.
+func newRedactor(in *v1alpha1.Prompt) (*redactor, error) {
+	r := &redactor{values: map[string]redaction{}}
+	patterns := defaultRedactKeys
+	if rd := in.Redact; rd != nil {
+		if rd.Disabled {
+			return nil, nil
+		}
+		patterns = append(append([]string{}, patterns...), rd.KeyPatterns...)
+		r.paths = rd.Paths
+	}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid redaction key pattern %q", p)
+		}
+		r.keys = append(r.keys, re)
+	}
+	return r, nil
+}
+
+// Redacted returns the number of distinct values redacted.
+func (r *redactor) Redacted() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.values)
+}
+
+// reportRedacted reports how many values the supplied redactor, which may be
+// nil, redacted.
+func reportRedacted(rsp *fnv1.RunFunctionResponse, log logging.Logger, r *redactor) {
+	if r.Redacted() == 0 {
+		return
+	}
+	log.Debug("Redacted sensitive values", "count", r.Redacted())
+	response.Normalf(rsp, "redacted %d sensitive values", r.Redacted())
+}
+
+// Object returns a copy of the supplied object with sensitive values replaced
+// by placeholders. The data of Secrets, string values whose key matches a
+// redaction key pattern, the values of environment variables whose name
+// matches a pattern, and values at the configured paths are redacted.
+func (r *redactor) Object(obj map[string]any) (map[string]any, error) {
+	if r == nil {
+		return obj, nil
+	}
+	j, err := json.Marshal(obj)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot convert resource to JSON")
+	}
+	id := redactedResourceOf(j)
+
+	if j, err = r.redactPaths(id, j); err != nil {
+		return nil, err
+	}
+
+	out := map[string]any{}
+	if err := json.Unmarshal(j, &out); err != nil {
+		return nil, errors.Wrap(err, "cannot parse redacted resource")
+	}
+
+	if id.APIVersion == "v1" && id.Kind == "Secret" {
+		for _, f := range []string{"data", "stringData"} {
+			if v, ok := out[f]; ok {
+				out[f] = r.redactAll(id, f, v)
+			}
+		}
+	}
+
+	return r.walk(id, "", out).(map[string]any), nil
+}
+
+// contextResource identifies values redacted from the pipeline context. It
+// can't be restored in any resource.
+var contextResource = redactedResource{Kind: "Context"}
+
+// Context returns the supplied pipeline context with string values whose key
+// matches a redaction key pattern, and the values of environment variables
+// whose name matches a pattern, replaced by placeholders. The supplied context
+// is modified in place. Placeholders in the context are never restored.
+func (r *redactor) Context(ctx map[string]any) map[string]any {
+	if r == nil {
+		return ctx
+	}
+	return r.walk(contextResource, "", ctx).(map[string]any)
+}
+
+// redactPaths redacts every string value at the configured paths of the
+// supplied JSON object.
+func (r *redactor) redactPaths(id redactedResource, j []byte) ([]byte, error) {
+	for _, p := range r.paths {
+		v := gjson.GetBytes(j, p)
+		if !v.Exists() {
+			continue
+		}
+		var val any
+		if err := json.Unmarshal([]byte(v.Raw), &val); err != nil {
+			return nil, errors.Wrapf(err, "cannot parse value at path %s", p)
+		}
+		var err error
+		if j, err = sjson.SetBytes(j, p, r.redactAll(id, p, val)); err != nil {
+			return nil, errors.Wrapf(err, "cannot redact value at path %s", p)
+		}
+	}
+	return j, nil
+}
+
+// walk redacts string values whose key matches a redaction key pattern, and
+// the values of environment variables whose name matches a pattern.
+func (r *redactor) walk(id redactedResource, path string, v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		if name, ok := t["name"].(string); ok && r.sensitive(name) {
+			if val, ok := t["value"].(string); ok {
+				t["value"] = r.placeholder(id, join(path, "value"), val)
+			}
+		}
+		for k, val := range t {
+			p := join(path, k)
+			if s, ok := val.(string); ok && r.sensitive(k) {
+				t[k] = r.placeholder(id, p, s)
+				continue
+			}
+			t[k] = r.walk(id, p, val)
+		}
+	case []any:
+		for i, val := range t {
+			t[i] = r.walk(id, join(path, fmt.Sprint(i)), val)
+		}
+	}
+	return v
+}
+
+// redactAll replaces every string value within the supplied value.
+func (r *redactor) redactAll(id redactedResource, path string, v any) any {
+	switch t := v.(type) {
+	case string:
+		return r.placeholder(id, path, t)
+	case map[string]any:
+		for k, val := range t {
+			t[k] = r.redactAll(id, join(path, k), val)
+		}
+	case []any:
+		for i, val := range t {
+			t[i] = r.redactAll(id, join(path, fmt.Sprint(i)), val)
+		}
+	}
+	return v
+}
+
+// sensitive returns true if the supplied key matches a redaction key pattern.
+func (r *redactor) sensitive(key string) bool {
+	for _, re := range r.keys {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// placeholder returns the placeholder for the value at the supplied path of
+// the supplied resource. Placeholders are derived from the value's location,
+// not the value, so they're stable across calls and reveal nothing about the
+// value.
+func (r *redactor) placeholder(id redactedResource, path, value string) string {
+	if value == "" || strings.HasPrefix(value, placeholderPrefix) {
+		return value
+	}
+	red := redaction{resource: id, path: path, value: value}
+	loc := id.String() + "\x00" + path
+	for n := 0; ; n++ {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d", loc, n)))
+		ph := placeholderPrefix + strings.ToUpper(hex.EncodeToString(sum[:6]))
+		if existing, ok := r.values[ph]; ok && existing != red {
+			continue
+		}
+		r.values[ph] = red
+		return ph
+	}
+}
+
+// placeholders matches the placeholders that replace redacted values.
+var placeholders = regexp.MustCompile(placeholderPrefix + `[0-9A-F]{12}`)
+
+// Restore replaces placeholders in the string values of the supplied resources
+// with the values they redacted. A placeholder is only restored at the path it
+// was redacted from, in a resource that could be the one it was redacted from.
+// Restore returns an error if a placeholder appears anywhere else, so Claude
+// can't move a sensitive value to a different resource or field.
+func (r *redactor) Restore(rs map[string]*fnv1.Resource) error {
+	if r == nil || len(r.values) == 0 {
+		return nil
+	}
+	for name, res := range rs {
+		obj := res.GetResource().AsMap()
+		j, err := json.Marshal(obj)
+		if err != nil {
+			return errors.Wrapf(err, "cannot convert resource %q to JSON", name)
+		}
+		restored, err := r.restore(redactedResourceOf(j), "", obj)
+		if err != nil {
+			return errors.Wrapf(err, "cannot restore redacted values of resource %q", name)
+		}
+		s, err := structpb.NewStruct(restored.(map[string]any))
+		if err != nil {
+			return errors.Wrapf(err, "cannot restore redacted values of resource %q", name)
+		}
+		res.Resource = s
+	}
+	return nil
+}
+
+// restore replaces the placeholders within the supplied value, which is at the
+// supplied path of the supplied resource.
+func (r *redactor) restore(id redactedResource, path string, v any) (any, error) {
+	switch t := v.(type) {
+	case string:
+		return r.restoreString(id, path, t)
+	case map[string]any:
+		for k, val := range t {
+			restored, err := r.restore(id, join(path, k), val)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = restored
+		}
+	case []any:
+		for i, val := range t {
+			restored, err := r.restore(id, join(path, fmt.Sprint(i)), val)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = restored
+		}
+	}
+	return v, nil
+}
+
+// restoreString replaces the placeholders within the supplied string, which is
+// at the supplied path of the supplied resource. Unknown placeholders are left
+// as is.
+func (r *redactor) restoreString(id redactedResource, path, s string) (string, error) {
+	var err error
+	out := placeholders.ReplaceAllStringFunc(s, func(ph string) string {
+		red, ok := r.values[ph]
+		if !ok {
+			return ph
+		}
+		if red.path != path || !red.resource.restorableIn(id) {
+			err = errors.Errorf("placeholder %s at %s was redacted from %s of %s", ph, path, red.path, red.resource)
+			return ph
+		}
+		return red.value
+	})
+	return out, err
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return escapePath(key)
+	}
+	return path + "." + escapePath(key)
+}
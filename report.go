@@ -0,0 +1,135 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/crossplane/function-sdk-go/errors"
+	"github.com/crossplane/function-sdk-go/logging"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/response"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+)
+
+// defaultReportOutputField is the field of the operation's output findings
+// are written to if none is configured.
+const defaultReportOutputField = "findings"
+
+// reportInstructions are appended to the system prompt in report mode. Each
+// field they describe is a field of a finding.
+const reportInstructions = `
+Do not return any Kubernetes manifests. Respond only with a YAML list of
+findings. Each finding must have the following fields:
+- severity: One of "info", "warning", or "error".
+- title: A short summary of the finding.
+- detail: An explanation of the finding, including how to address it.
+- path: The path of the affected field, e.g. "spec.replicas". Omit this field
+  if the finding doesn't relate to a specific field.
+Respond with an empty list if there are no findings.`
+
+// Severities of a finding.
+const (
+	severityInfo    = "info"
+	severityWarning = "warning"
+	severityError   = "error"
+)
+
+// A finding produced by a report-only operation.
+type finding struct {
+	Severity string `json:"severity"`
+	Title    string `json:"title"`
+	Detail   string `json:"detail,omitempty"`
+	Path     string `json:"path,omitempty"`
+}
+
+// String returns a concise, human readable representation of the finding.
+func (f finding) String() string {
+	s := f.Title
+	if f.Detail != "" {
+		s = fmt.Sprintf("%s: %s", s, f.Detail)
+	}
+	if f.Path != "" {
+		s = fmt.Sprintf("%s (field %s)", s, f.Path)
+	}
+	return s
+}
+
+// reportEnabled returns true if the supplied input asks for report mode.
+func reportEnabled(in *v1alpha1.Prompt) bool {
+	return in.Report != nil && in.Report.Enabled
+}
+
+// findingsFrom parses the supplied response as a list of findings.
+func findingsFrom(resp string) ([]finding, error) {
+	fs := make([]finding, 0)
+	if err := yaml.Unmarshal([]byte(stripMarkdownCodeBlocks(resp)), &fs); err != nil {
+		return nil, errors.Wrap(err, "cannot parse findings as a YAML list")
+	}
+	for i, f := range fs {
+		switch f.Severity {
+		case severityInfo, severityWarning, severityError:
+		default:
+			return nil, errors.Errorf("finding %d has invalid severity %q", i, f.Severity)
+		}
+		if f.Title == "" {
+			return nil, errors.Errorf("finding %d is missing a title", i)
+		}
+	}
+	return fs, nil
+}
+
+// reportOperation reports the findings in the supplied response, and writes
+// them and any output value. Report mode never produces desired resources. Any
+// error is also reported as a fatal result.
+func (f *Function) reportOperation(log logging.Logger, d pipelineDetails, watched map[string]any, resp string, out any) error {
+	fs, err := findingsFrom(resp)
+	if err != nil {
+		err = errors.Wrap(err, "did not receive findings from Claude")
+		response.Fatal(d.rsp, err)
+		return err
+	}
+	if err := reportFindings(d.rsp, d.in.Report, fs); err != nil {
+		response.Fatal(d.rsp, err)
+		return err
+	}
+	log.Debug("Reported findings", "findingCount", len(fs))
+	response.ConditionTrue(d.rsp, "FunctionSuccess", "Success").TargetCompositeAndClaim()
+	return f.setDesired(d, watched, nil, out)
+}
+
+// reportFindings reports the supplied findings as results, and writes them to
+// the operation's output. Warnings and errors are reported as warning
+// results.
+func reportFindings(rsp *fnv1.RunFunctionResponse, r *v1alpha1.Report, fs []finding) error {
+	for _, f := range fs {
+		if f.Severity == severityInfo {
+			response.Normal(rsp, f.String())
+			continue
+		}
+		response.Warning(rsp, errors.New(f.String()))
+	}
+
+	field := r.OutputField
+	if field == "" {
+		field = defaultReportOutputField
+	}
+	return errors.Wrap(response.SetOutput(rsp, map[string]any{field: fs}), "cannot write findings to output")
+}
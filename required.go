@@ -0,0 +1,123 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"text/template"
+
+	"github.com/crossplane/function-sdk-go/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+)
+
+// TODO(tnthornton) reference const from c/c instead. Currently too many
+// conflicting dependencies are pulled in when updating c/c in this repo.
+const watchedResourceKey = "ops.crossplane.io/watched-resource"
+
+// requirementPrefix prefixes the names of the resources the function requires
+// for its own use, e.g. Events. Required resources may not use it.
+const requirementPrefix = "claude.fn.upbound.io/"
+
+// requirements returns the resource selectors for the supplied required
+// resources. Templated selector values are rendered with the supplied data,
+// i.e. the watched resource in an operation pipeline or the observed XR in a
+// composition pipeline.
+func requirements(rrs []v1alpha1.RequiredResource, data map[string]any) (*fnv1.Requirements, error) {
+	if len(rrs) == 0 {
+		return nil, nil
+	}
+
+	out := &fnv1.Requirements{Resources: make(map[string]*fnv1.ResourceSelector, len(rrs))}
+	for _, rr := range rrs {
+		rs, err := selector(rr, data)
+		if err != nil {
+			return nil, err
+		}
+		out.Resources[rr.Name] = rs
+	}
+	return out, nil
+}
+
+// selector returns the resource selector for the supplied required resource.
+func selector(rr v1alpha1.RequiredResource, data map[string]any) (*fnv1.ResourceSelector, error) {
+	if rr.Name == watchedResourceKey || strings.HasPrefix(rr.Name, requirementPrefix) {
+		return nil, errors.Errorf("required resource name %q is reserved", rr.Name)
+	}
+	if (rr.MatchName == nil) == (rr.MatchLabels == nil) {
+		return nil, errors.Errorf("required resource %q must specify exactly one of matchName and matchLabels", rr.Name)
+	}
+
+	rs := &fnv1.ResourceSelector{ApiVersion: rr.APIVersion, Kind: rr.Kind}
+	if rr.Namespace != nil {
+		ns, err := renderSelectorValue(*rr.Namespace, data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot render namespace of required resource %q", rr.Name)
+		}
+		rs.Namespace = &ns
+	}
+	if rr.MatchName != nil {
+		n, err := renderSelectorValue(*rr.MatchName, data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot render matchName of required resource %q", rr.Name)
+		}
+		rs.Match = &fnv1.ResourceSelector_MatchName{MatchName: n}
+		return rs, nil
+	}
+
+	ls := make(map[string]string, len(rr.MatchLabels))
+	for k, v := range rr.MatchLabels {
+		rv, err := renderSelectorValue(v, data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot render label %q of required resource %q", k, rr.Name)
+		}
+		ls[k] = rv
+	}
+	rs.Match = &fnv1.ResourceSelector_MatchLabels{MatchLabels: &fnv1.MatchLabels{Labels: ls}}
+	return rs, nil
+}
+
+// renderSelectorValue renders the supplied selector value as a Go template. It
+// returns an error if the template references a missing field, rather than
+// rendering a value that silently selects nothing.
+func renderSelectorValue(v string, data any) (string, error) {
+	if !strings.Contains(v, "{{") {
+		return v, nil
+	}
+	t, err := template.New("selector").Option("missingkey=error").Parse(v)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot parse template")
+	}
+	b := &strings.Builder{}
+	if err := t.Execute(b, data); err != nil {
+		return "", errors.Wrap(err, "cannot execute template")
+	}
+	return b.String(), nil
+}
+
+// requirementsSatisfied returns true if Crossplane has supplied resources
+// (possibly none) for every one of the supplied requirements.
+func requirementsSatisfied(rq *fnv1.Requirements, rr map[string][]resource.Required) bool {
+	for name := range rq.GetResources() {
+		if _, ok := rr[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+
+	"github.com/crossplane/function-sdk-go/errors"
+	"github.com/crossplane/function-sdk-go/logging"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/response"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+)
+
+// annotationOmittedFields lists the top level fields removed from a resource
+// because it exceeded the maximum size.
+const annotationOmittedFields = "claude.fn.upbound.io/omitted-fields"
+
+// annotationNoise are annotations removed from every sanitized resource.
+var annotationNoise = []string{
+	"kubectl.kubernetes.io/last-applied-configuration",
+}
+
+// identityPaths are always kept by include rules.
+var identityPaths = []string{"apiVersion", "kind", "metadata.name", "metadata.namespace"}
+
+// A sanitizer removes noise from resources before they're supplied to the
+// prompt template. A nil sanitizer leaves resources untouched.
+type sanitizer struct {
+	cfg *v1alpha1.Sanitize
+
+	// Sanitized is the number of resources sanitized.
+	Sanitized int
+	// Stripped is the number of bytes of JSON removed.
+	Stripped int
+}
+
+// newSanitizer returns a sanitizer for the supplied input, or nil if the
+// input doesn't enable sanitization.
+func newSanitizer(in *v1alpha1.Prompt) *sanitizer {
+	if in.Sanitize == nil || !in.Sanitize.Enabled {
+		return nil
+	}
+	return &sanitizer{cfg: in.Sanitize}
+}
+
+// StrippedTokens returns the approximate number of tokens removed.
+func (s *sanitizer) StrippedTokens() int {
+	return s.Stripped / charsPerToken
+}
+
+// reportSanitized reports how much the supplied sanitizer, which may be nil,
+// stripped from resources.
+func reportSanitized(rsp *fnv1.RunFunctionResponse, log logging.Logger, s *sanitizer) {
+	if s == nil {
+		return
+	}
+	log.Debug("Sanitized resources", "resources", s.Sanitized, "stripped-bytes", s.Stripped)
+	response.Normalf(rsp, "sanitized %d resources, stripping about %d tokens", s.Sanitized, s.StrippedTokens())
+}
+
+// Object returns a sanitized copy of the supplied object.
+func (s *sanitizer) Object(obj map[string]any) (map[string]any, error) {
+	if s == nil {
+		return obj, nil
+	}
+	j, err := json.Marshal(obj)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot convert resource to JSON")
+	}
+	before := len(j)
+
+	if j, err = s.sanitize(j); err != nil {
+		return nil, err
+	}
+
+	out := map[string]any{}
+	if err := json.Unmarshal(j, &out); err != nil {
+		return nil, errors.Wrap(err, "cannot parse sanitized resource")
+	}
+	s.Sanitized++
+	s.Stripped += before - len(j)
+	return out, nil
+}
+
+// sanitize returns the supplied JSON object with noise removed, the input's
+// rules applied, and its size capped.
+func (s *sanitizer) sanitize(j []byte) ([]byte, error) {
+	j, err := deletePaths(j, noisePaths(s.cfg.KeepStatus))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot remove metadata noise")
+	}
+
+	apiVersion, kind := gjson.GetBytes(j, "apiVersion").String(), gjson.GetBytes(j, "kind").String()
+	for _, r := range s.cfg.Rules {
+		if !sanitizeRuleMatches(r, apiVersion, kind) {
+			continue
+		}
+		if j, err = applySanitizeRule(j, r); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.cfg.MaxSize != nil {
+		return capSize(j, *s.cfg.MaxSize)
+	}
+	return j, nil
+}
+
+// noisePaths returns the paths of the fields removed from every resource.
+func noisePaths(keepStatus bool) []string {
+	paths := make([]string, 0, 1+len(metadataNoise)+len(annotationNoise))
+	if !keepStatus {
+		paths = append(paths, "status")
+	}
+	for _, f := range metadataNoise {
+		paths = append(paths, "metadata."+f)
+	}
+	for _, a := range annotationNoise {
+		paths = append(paths, "metadata.annotations."+escapePath(a))
+	}
+	return paths
+}
+
+// sanitizeRuleMatches returns true if the supplied rule applies to resources
+// of the supplied apiVersion and kind.
+func sanitizeRuleMatches(r v1alpha1.SanitizeRule, apiVersion, kind string) bool {
+	return (r.APIVersion == "" || r.APIVersion == apiVersion) && (r.Kind == "" || r.Kind == kind)
+}
+
+// applySanitizeRule returns the supplied JSON object with only the fields the
+// supplied rule includes, less the fields it excludes.
+func applySanitizeRule(j []byte, r v1alpha1.SanitizeRule) ([]byte, error) {
+	var err error
+	if len(r.Include) > 0 {
+		if j, err = include(j, append(identityPaths, r.Include...)); err != nil {
+			return nil, err
+		}
+	}
+	j, err = deletePaths(j, r.Exclude)
+	return j, errors.Wrap(err, "cannot exclude fields")
+}
+
+// deletePaths returns the supplied JSON object without the supplied paths.
+func deletePaths(j []byte, paths []string) ([]byte, error) {
+	for _, p := range paths {
+		if !gjson.GetBytes(j, p).Exists() {
+			continue
+		}
+		var err error
+		if j, err = sjson.DeleteBytes(j, p); err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// include returns only the supplied paths of the supplied JSON object.
+func include(j []byte, paths []string) ([]byte, error) {
+	out := []byte("{}")
+	for _, p := range paths {
+		v := gjson.GetBytes(j, p)
+		if !v.Exists() {
+			continue
+		}
+		var err error
+		if out, err = sjson.SetRawBytes(out, p, []byte(v.Raw)); err != nil {
+			return nil, errors.Wrapf(err, "cannot include field %s", p)
+		}
+	}
+	return out, nil
+}
+
+// capSize removes the largest top level fields, other than apiVersion, kind,
+// and metadata, from the supplied JSON object until it's no larger than the
+// supplied size. Removed fields are listed in an annotation.
+func capSize(j []byte, size int) ([]byte, error) {
+	if len(j) <= size {
+		return j, nil
+	}
+
+	type field struct {
+		name string
+		size int
+	}
+	fields := []field{}
+	gjson.ParseBytes(j).ForEach(func(k, v gjson.Result) bool {
+		switch k.String() {
+		case "apiVersion", "kind", "metadata":
+		default:
+			fields = append(fields, field{name: k.String(), size: len(v.Raw)})
+		}
+		return true
+	})
+	sort.SliceStable(fields, func(a, b int) bool { return fields[a].size > fields[b].size })
+
+	omitted := []string{}
+	var err error
+	for _, f := range fields {
+		if len(j) <= size {
+			break
+		}
+		if j, err = sjson.DeleteBytes(j, escapePath(f.name)); err != nil {
+			return nil, errors.Wrapf(err, "cannot omit field %s", f.name)
+		}
+		omitted = append(omitted, f.name)
+	}
+	if len(omitted) == 0 {
+		return j, nil
+	}
+	sort.Strings(omitted)
+	j, err = sjson.SetBytes(j, "metadata.annotations."+escapePath(annotationOmittedFields), strings.Join(omitted, ","))
+	return j, errors.Wrap(err, "cannot annotate omitted fields")
+}
+
+// escapePath escapes the supplied key for use in a gjson or sjson path.
+func escapePath(key string) string {
+	r := strings.NewReplacer(".", `\.`, "*", `\*`, "?", `\?`, "|", `\|`, "#", `\#`, "@", `\@`, ":", `\:`)
+	return r.Replace(key)
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/crossplane/function-sdk-go/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/request"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+)
+
+const (
+	// annotationPaused pauses the function for the annotated XR or watched
+	// resource when set to "true".
+	annotationPaused = "claude.fn.upbound.io/paused"
+
+	// annotationPrefix prefixes the annotations this function manages.
+	annotationPrefix = "claude.fn.upbound.io/"
+)
+
+// skipSubject returns the resource skip rules match against; the observed XR
+// in a composition pipeline, or the watched resource in an operation
+// pipeline. It returns nil if there is no such resource.
+func skipSubject(req *fnv1.RunFunctionRequest) (map[string]any, error) {
+	if inCompositionPipeline(req) {
+		return req.GetObserved().GetComposite().GetResource().AsMap(), nil
+	}
+	rrs, err := request.GetRequiredResources(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get required resources")
+	}
+	if rs := rrs[watchedResourceKey]; len(rs) == 1 {
+		return rs[0].Resource.UnstructuredContent(), nil
+	}
+	return nil, nil
+}
+
+// skipReason returns a reason to skip invoking Claude, or an empty string if
+// Claude should be invoked.
+func skipReason(req *fnv1.RunFunctionRequest, in *v1alpha1.Prompt) (string, error) {
+	obj, err := skipSubject(req)
+	if err != nil {
+		return "", err
+	}
+	if obj == nil {
+		return "", nil
+	}
+	u := &unstructured.Unstructured{Object: obj}
+
+	if u.GetAnnotations()[annotationPaused] == "true" {
+		return fmt.Sprintf("%s is paused by the %s annotation", resourceKey(u), annotationPaused), nil
+	}
+
+	if in.Skip == nil {
+		return "", nil
+	}
+	for _, r := range in.Skip.Rules {
+		match, err := skipRuleMatches(r, u, req.GetObserved().GetResources())
+		if err != nil {
+			return "", errors.Wrapf(err, "cannot evaluate skip rule %q", r.Name)
+		}
+		if match {
+			return fmt.Sprintf("%s matched skip rule %q", resourceKey(u), r.Name), nil
+		}
+	}
+	return "", nil
+}
+
+// skipRuleMatches returns true if all of the supplied rule's conditions match
+// the supplied resource.
+func skipRuleMatches(r v1alpha1.SkipRule, u *unstructured.Unstructured, ocds map[string]*fnv1.Resource) (bool, error) {
+	if !hasConditions(r) {
+		return false, errors.New("rule has no conditions")
+	}
+
+	match, err := selectorMatches(r.Selector, u)
+	if err != nil || !match {
+		return false, err
+	}
+	if !annotationsMatch(r.MatchAnnotations, u) {
+		return false, nil
+	}
+	if len(r.Namespaces) > 0 && !slices.Contains(r.Namespaces, u.GetNamespace()) {
+		return false, nil
+	}
+
+	if r.Expression == "" {
+		return true, nil
+	}
+	return evalSkipExpression(r.Expression, u.Object, ocds)
+}
+
+// hasConditions returns true if the supplied rule has any conditions.
+func hasConditions(r v1alpha1.SkipRule) bool {
+	return r.Selector != nil || len(r.MatchAnnotations) > 0 || len(r.Namespaces) > 0 || r.Expression != ""
+}
+
+// selectorMatches returns true if the supplied label selector, which may be
+// nil, matches the supplied resource.
+func selectorMatches(s *metav1.LabelSelector, u *unstructured.Unstructured) (bool, error) {
+	if s == nil {
+		return true, nil
+	}
+	sel, err := metav1.LabelSelectorAsSelector(s)
+	if err != nil {
+		return false, errors.Wrap(err, "invalid selector")
+	}
+	return sel.Matches(labels.Set(u.GetLabels())), nil
+}
+
+// annotationsMatch returns true if the supplied resource has all of the
+// supplied annotations.
+func annotationsMatch(want map[string]string, u *unstructured.Unstructured) bool {
+	a := u.GetAnnotations()
+	for k, v := range want {
+		if got, ok := a[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// evalSkipExpression evaluates the supplied CEL expression against the
+// supplied resource and observed composed resources.
+func evalSkipExpression(expr string, obj map[string]any, ocds map[string]*fnv1.Resource) (bool, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("object", cel.DynType),
+		cel.Variable("resources", cel.MapType(cel.StringType, cel.DynType)),
+	)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot create CEL environment")
+	}
+	ast, iss := env.Compile(expr)
+	if iss.Err() != nil {
+		return false, errors.Wrap(iss.Err(), "cannot compile CEL expression")
+	}
+	if !ast.OutputType().IsExactType(cel.BoolType) && !ast.OutputType().IsExactType(cel.DynType) {
+		return false, errors.Errorf("CEL expression must evaluate to a bool, not %s", ast.OutputType())
+	}
+	prg, err := env.Program(ast)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot create CEL program")
+	}
+
+	resources := make(map[string]any, len(ocds))
+	for name, ocd := range ocds {
+		resources[name] = ocd.GetResource().AsMap()
+	}
+	out, _, err := prg.Eval(map[string]any{"object": obj, "resources": resources})
+	if err != nil {
+		return false, errors.Wrap(err, "cannot evaluate CEL expression")
+	}
+	b, ok := out.Value().(bool)
+	if !ok {
+		return false, errors.Errorf("CEL expression must evaluate to a bool, not %T", out.Value())
+	}
+	return b, nil
+}
+
+// holdObserved keeps the observed composed resources, and the annotations this
+// function manages on the XR, as desired state, and writes any recorded
+// context outputs again, so that skipping a composition doesn't delete or
+// change anything.
+func holdObserved(req *fnv1.RunFunctionRequest, in *v1alpha1.Prompt, rsp *fnv1.RunFunctionResponse) {
+	if !inCompositionPipeline(req) {
+		return
+	}
+	if rsp.GetDesired() == nil {
+		rsp.Desired = &fnv1.State{}
+	}
+	for name, dcd := range desiredFromObserved(req.GetObserved().GetResources()) {
+		if rsp.GetDesired().GetResources() == nil {
+			rsp.Desired.Resources = map[string]*fnv1.Resource{}
+		}
+		if _, ok := rsp.GetDesired().GetResources()[name]; !ok {
+			rsp.Desired.Resources[name] = dcd
+		}
+	}
+
+	held := map[string]string{}
+	for k, v := range annotations(req.GetObserved().GetComposite()) {
+		if strings.HasPrefix(k, annotationPrefix) && k != annotationPaused {
+			held[k] = v
+		}
+	}
+	if len(held) > 0 {
+		setCompositeAnnotations(rsp, held)
+	}
+	holdContextOutputs(req, in, rsp)
+}
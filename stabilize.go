@@ -0,0 +1,200 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/crossplane/function-sdk-go/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+)
+
+const (
+	// annotationSpecFingerprint records the fingerprint of the XR spec (and
+	// prompt) that the current composed resources were derived from.
+	annotationSpecFingerprint = "claude.fn.upbound.io/spec-fingerprint"
+	// annotationComposedAt records when Claude last composed resources for
+	// the XR, in RFC 3339 format.
+	annotationComposedAt = "claude.fn.upbound.io/composed-at"
+)
+
+// metadataNoise are metadata fields the API server manages. They must not be
+// sent back as desired state.
+var metadataNoise = []string{
+	"uid",
+	"resourceVersion",
+	"generation",
+	"creationTimestamp",
+	"deletionTimestamp",
+	"deletionGracePeriodSeconds",
+	"managedFields",
+	"ownerReferences",
+	"selfLink",
+}
+
+// stabilizationEnabled returns true if the supplied input asks for
+// stabilization.
+func stabilizationEnabled(in *v1alpha1.Prompt) bool {
+	return in.Stabilization != nil && in.Stabilization.Enabled
+}
+
+// specFingerprint returns a fingerprint of the supplied XR's spec, combined
+// with the input used to compose it. The input is fingerprinted after its
+// system prompt and preset are resolved using the supplied prompt library,
+// and the library's fragments are included because templates may include
+// any of them. Changing the spec, the input, a preset, or a fragment produces
+// a different fingerprint.
+func specFingerprint(xr *fnv1.Resource, in *v1alpha1.Prompt, lib promptLibrary) (string, error) {
+	system, err := lib.systemPrompt(in)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot resolve system prompt")
+	}
+	var presetUser string
+	if in.Preset != "" {
+		p, err := loadPreset(in.Preset)
+		if err != nil {
+			return "", err
+		}
+		presetUser = p.user
+	}
+
+	// encoding/json sorts map keys, so this is stable across calls.
+	j, err := json.Marshal(struct {
+		Spec             any              `json:"spec"`
+		Input            *v1alpha1.Prompt `json:"input"`
+		SystemPrompt     string           `json:"systemPrompt"`
+		PresetUserPrompt string           `json:"presetUserPrompt,omitempty"`
+		Fragments        promptLibrary    `json:"fragments"`
+	}{
+		Spec:             xr.GetResource().AsMap()["spec"],
+		Input:            in,
+		SystemPrompt:     system,
+		PresetUserPrompt: presetUser,
+		Fragments:        lib,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot marshal XR spec to JSON")
+	}
+	sum := sha256.Sum256(j)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// canReuseObserved returns true if the observed composed resources were
+// composed from an XR spec matching the supplied fingerprint, and are not due
+// to be refreshed. If they can't be reused it returns a reason.
+func canReuseObserved(req *fnv1.RunFunctionRequest, s *v1alpha1.Stabilization, fingerprint string, now time.Time) (bool, string) {
+	if len(req.GetObserved().GetResources()) == 0 {
+		return false, "no observed composed resources"
+	}
+
+	a := annotations(req.GetObserved().GetComposite())
+	if a[annotationSpecFingerprint] != fingerprint {
+		return false, "XR spec changed since last composition"
+	}
+
+	if s.RefreshInterval == nil {
+		return true, ""
+	}
+	at, err := time.Parse(time.RFC3339, a[annotationComposedAt])
+	if err != nil {
+		return false, "cannot determine time of last composition"
+	}
+	if now.Sub(at) >= s.RefreshInterval.Duration {
+		return false, "refresh interval elapsed"
+	}
+	return true, ""
+}
+
+// desiredFromObserved converts the supplied observed composed resources to
+// desired composed resources by stripping their status and the metadata that
+// is managed by the API server.
+func desiredFromObserved(ocds map[string]*fnv1.Resource) map[string]*fnv1.Resource {
+	out := make(map[string]*fnv1.Resource, len(ocds))
+	for name, ocd := range ocds {
+		s, _ := proto.Clone(ocd.GetResource()).(*structpb.Struct)
+		if s == nil {
+			s = &structpb.Struct{}
+		}
+		delete(s.GetFields(), "status")
+		if meta := s.GetFields()["metadata"].GetStructValue(); meta != nil {
+			for _, f := range metadataNoise {
+				delete(meta.GetFields(), f)
+			}
+		}
+		out[name] = &fnv1.Resource{Resource: s}
+	}
+	return out
+}
+
+// annotations returns the metadata.annotations of the supplied resource.
+func annotations(r *fnv1.Resource) map[string]string {
+	out := map[string]string{}
+	a := r.GetResource().GetFields()["metadata"].GetStructValue().GetFields()["annotations"].GetStructValue()
+	for k, v := range a.GetFields() {
+		out[k] = v.GetStringValue()
+	}
+	return out
+}
+
+// setCompositeAnnotations sets the supplied annotations on the desired XR,
+// creating any intermediate fields as needed.
+func setCompositeAnnotations(rsp *fnv1.RunFunctionResponse, kv map[string]string) {
+	a := subStruct(subStruct(desiredComposite(rsp), "metadata"), "annotations")
+	for k, v := range kv {
+		a.Fields[k] = structpb.NewStringValue(v)
+	}
+}
+
+// desiredComposite returns the desired XR of the supplied response, creating
+// it if it does not exist.
+func desiredComposite(rsp *fnv1.RunFunctionResponse) *structpb.Struct {
+	if rsp.GetDesired() == nil {
+		rsp.Desired = &fnv1.State{}
+	}
+	if rsp.GetDesired().GetComposite() == nil {
+		rsp.Desired.Composite = &fnv1.Resource{}
+	}
+	if rsp.GetDesired().GetComposite().GetResource() == nil {
+		rsp.Desired.Composite.Resource = &structpb.Struct{}
+	}
+	return rsp.GetDesired().GetComposite().GetResource()
+}
+
+// subStruct returns the struct at the supplied key, creating it if it does
+// not exist.
+func subStruct(s *structpb.Struct, key string) *structpb.Struct {
+	if s.Fields == nil {
+		s.Fields = map[string]*structpb.Value{}
+	}
+	v := s.GetFields()[key].GetStructValue()
+	if v == nil {
+		v = &structpb.Struct{}
+		s.Fields[key] = structpb.NewStructValue(v)
+	}
+	if v.Fields == nil {
+		v.Fields = map[string]*structpb.Value{}
+	}
+	return v
+}
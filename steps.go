@@ -0,0 +1,165 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/crossplane/function-sdk-go/errors"
+	"github.com/crossplane/function-sdk-go/logging"
+
+	"github.com/upbound/function-claude/input/v1alpha1"
+)
+
+// stepName matches valid step names. Names must be usable as template field
+// names, e.g. {{ .Steps.plan.Output }}.
+var stepName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// runSteps runs every step of the input's prompt chain except the last, and
+// returns pipeline details for the last step. The returned details' input
+// uses the last step's prompts and model in place of its own, and their steps
+// hold the output of each earlier step. The supplied function returns the
+// variables used to render a step's prompts. If the input has no steps the
+// supplied details are returned unchanged.
+func (f *Function) runSteps(ctx context.Context, log logging.Logger, d pipelineDetails, lib promptLibrary, unchanged bool, vars func(input string) (*Variables, error)) (pipelineDetails, error) {
+	if len(d.in.Steps) == 0 {
+		return d, nil
+	}
+	if err := validateSteps(d.in); err != nil {
+		return d, err
+	}
+
+	d.steps = make(map[string]StepVariables, len(d.in.Steps))
+	last := len(d.in.Steps) - 1
+	for _, s := range d.in.Steps[:last] {
+		sd, data, err := stepDetails(d, lib, s, vars)
+		if err != nil {
+			return d, err
+		}
+		user, err := renderStep(lib, s.Name, "userPrompt", s.UserPrompt, data)
+		if err != nil {
+			return d, err
+		}
+		system, err := lib.systemPrompt(sd.in)
+		if err != nil {
+			return d, errors.Wrapf(err, "cannot build system prompt of step %q", s.Name)
+		}
+		if err := checkBudget(sd.in.Budget, system, user); err != nil {
+			return d, errors.Wrapf(err, "step %q", s.Name)
+		}
+		gen, err := generationOption(sd.in)
+		if err != nil {
+			return d, errors.Wrap(err, "invalid generation parameters")
+		}
+
+		log.Debug("Running step", "step", s.Name, "prompt", user)
+		out, err := f.invoke(ctx, log, sd, system, user, unchanged, gen)
+		if err != nil {
+			return d, errors.Wrapf(err, "failed to run step %q", s.Name)
+		}
+		log.Debug("Ran step", "step", s.Name, "output", out)
+		d.steps[s.Name] = StepVariables{Output: strings.TrimSpace(out)}
+	}
+
+	sd, _, err := stepDetails(d, lib, d.in.Steps[last], vars)
+	return sd, err
+}
+
+// stepDetails returns pipeline details for the supplied step, and the
+// variables used to render its prompts.
+func stepDetails(d pipelineDetails, lib promptLibrary, s v1alpha1.PromptStep, vars func(input string) (*Variables, error)) (pipelineDetails, *Variables, error) {
+	data, err := vars(s.UserPrompt)
+	if err != nil {
+		return d, nil, errors.Wrapf(err, "cannot build prompt variables for step %q", s.Name)
+	}
+	data.Steps = d.steps
+
+	system, err := renderStep(lib, s.Name, "systemPrompt", s.SystemPrompt, data)
+	if err != nil {
+		return d, nil, err
+	}
+	d.in = stepInput(d.in, s, system)
+	return d, data, nil
+}
+
+// validateSteps returns an error if the input's steps are invalid. Inputs
+// aren't validated against their schema, so this repeats its constraints.
+func validateSteps(in *v1alpha1.Prompt) error {
+	if in.UserPrompt != "" {
+		return errors.New("userPrompt and steps are mutually exclusive")
+	}
+	// A preset wraps the userPrompt, which steps replace.
+	if in.Preset != "" {
+		return errors.New("preset and steps are mutually exclusive")
+	}
+	seen := make(map[string]bool, len(in.Steps))
+	for _, s := range in.Steps {
+		if err := validateStep(in, s, seen); err != nil {
+			return err
+		}
+		seen[s.Name] = true
+	}
+	return nil
+}
+
+// validateStep returns an error if the supplied step of the supplied input is
+// invalid, or if an earlier step has the same name.
+func validateStep(in *v1alpha1.Prompt, s v1alpha1.PromptStep, seen map[string]bool) error {
+	if !stepName.MatchString(s.Name) {
+		return errors.Errorf("invalid step name %q: must match %s", s.Name, stepName)
+	}
+	if seen[s.Name] {
+		return errors.Errorf("duplicate step name %q", s.Name)
+	}
+	if s.ModelName != "" && choosesModel(in) {
+		return errors.Errorf("step %q: modelName can't be combined with models or modelRoutes", s.Name)
+	}
+	return nil
+}
+
+// renderStep renders the named prompt template of a step.
+func renderStep(lib promptLibrary, step, field, text string, data *Variables) (string, error) {
+	t, err := parseTemplate(step, text, lib.funcs())
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot parse %s of step %q", field, step)
+	}
+	out := &strings.Builder{}
+	if err := t.Execute(out, data); err != nil {
+		return "", errors.Wrapf(err, "cannot build %s of step %q from template", field, step)
+	}
+	return out.String(), nil
+}
+
+// stepInput returns a copy of the supplied input that uses the supplied step's
+// rendered system prompt, user prompt template, and model. A step without a
+// system prompt or model uses the input's. Steps always use the input's
+// systemPromptRef. validateSteps ensures a step's model never needs to be
+// combined with the input's models or modelRoutes.
+func stepInput(in *v1alpha1.Prompt, s v1alpha1.PromptStep, system string) *v1alpha1.Prompt {
+	out := *in
+	out.Steps = nil
+	out.UserPrompt = s.UserPrompt
+	if system != "" {
+		out.SystemPrompt = system
+	}
+	if s.ModelName != "" {
+		out.ModelName = s.ModelName
+	}
+	return &out
+}
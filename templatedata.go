@@ -0,0 +1,355 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/types/known/structpb"
+	"sigs.k8s.io/yaml"
+
+	"github.com/crossplane/function-sdk-go/errors"
+	fnv1 "github.com/crossplane/function-sdk-go/proto/v1"
+	"github.com/crossplane/function-sdk-go/resource"
+)
+
+// Variables used to form the prompt. The same variables are available in
+// composition and operation pipelines, though some are only set in one of
+// them.
+type Variables struct {
+	// Input is the unrendered user prompt.
+	Input string
+
+	// Composite is the observed XR. It renders as YAML. Only set in
+	// composition pipelines.
+	Composite *Value
+
+	// Composed is the observed composed resources, keyed by name. It renders
+	// as a stream of YAML manifests annotated with their upbound.io/name.
+	// Only set in composition pipelines.
+	Composed *Value
+
+	// Watched is the watched resource. It renders as indented JSON. Only
+	// set in operation pipelines.
+	Watched *Value
+
+	// Resources is equivalent to Watched.
+	Resources *Value
+
+	// Required resources keyed by requirement name. Each is a list of
+	// resources that renders as an indented JSON array.
+	Required map[string]*Value
+
+	// Desired state produced by previous functions in the pipeline.
+	Desired DesiredVariables
+
+	// Context is the pipeline context, with sensitive values redacted.
+	Context map[string]any
+
+	// Meta is information about the request.
+	Meta MetaVariables
+
+	// Events about the watched resource, deduplicated and most recent
+	// first, one per line. Only set in operation pipelines with events
+	// enabled.
+	Events string
+
+	// Steps are the earlier steps of a prompt chain, keyed by step name.
+	Steps map[string]StepVariables
+}
+
+// StepVariables are the results of a step of a prompt chain.
+type StepVariables struct {
+	// Output is Claude's response to the step.
+	Output string
+}
+
+// DesiredVariables are the desired state produced by previous functions in the
+// pipeline.
+type DesiredVariables struct {
+	// Composite is the desired XR. It renders as YAML.
+	Composite *Value
+
+	// Resources are the desired composed resources, keyed by name. Each
+	// renders as YAML.
+	Resources map[string]*Value
+}
+
+// MetaVariables are information about the request.
+type MetaVariables struct {
+	// Tag that uniquely identifies the request.
+	Tag string
+
+	// Credentials are the names of the credentials supplied to the function.
+	// Their data is never exposed to the template.
+	Credentials []string
+}
+
+// A Value supplied to a prompt template. Using a Value directly in a template,
+// e.g. {{ .Composite }}, renders its default format. Its parsed object and
+// other formats are available as fields, e.g. {{ .Composite.Object.spec }} or
+// {{ .Composite.JSON }}.
+type Value struct {
+	// Object is the parsed value.
+	Object any
+
+	// YAML rendering of the value.
+	YAML string
+
+	// JSON rendering of the value, indented.
+	JSON string
+
+	rendered string
+	format   string
+}
+
+// String returns the default rendering of the value.
+func (v *Value) String() string {
+	if v == nil {
+		return ""
+	}
+	return v.rendered
+}
+
+// MarshalJSON returns the value's object as JSON, so that functions like
+// toJson and toYaml encode a Value as the object it represents.
+func (v *Value) MarshalJSON() ([]byte, error) {
+	if v == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(v.Object)
+}
+
+// formatOf returns the default format of the supplied template value, or JSON
+// if it isn't a Value.
+func formatOf(v any) string {
+	if val, ok := v.(*Value); ok && val != nil && val.format != "" {
+		return val.format
+	}
+	return formatJSON
+}
+
+// Formats a Value may render as by default.
+const (
+	formatYAML = "yaml"
+	formatJSON = "json"
+)
+
+// newValue returns a Value for the supplied object, rendering as the supplied
+// format by default.
+func newValue(obj any, format string) (*Value, error) {
+	j, err := json.MarshalIndent(obj, "", "    ")
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot convert value to JSON")
+	}
+	y, err := yaml.Marshal(obj)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot convert value to YAML")
+	}
+	v := &Value{Object: obj, YAML: string(y), JSON: string(j), rendered: string(j), format: format}
+	if format == formatYAML {
+		v.rendered = string(y)
+	}
+	return v, nil
+}
+
+// resourceFilters prepare resources before they're supplied to the prompt
+// template. Observed and required resources are sanitized then redacted.
+// Desired resources are only redacted. Either filter may be nil. Observed
+// composed resources named in stubs are summarized as stubs.
+type resourceFilters struct {
+	sanitizer *sanitizer
+	redactor  *redactor
+	stubs     map[string]bool
+}
+
+func (f resourceFilters) observed(obj map[string]any) (map[string]any, error) {
+	obj, err := f.sanitizer.Object(obj)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot sanitize resource")
+	}
+	obj, err = f.redactor.Object(obj)
+	return obj, errors.Wrap(err, "cannot redact resource")
+}
+
+func (f resourceFilters) desired(obj map[string]any) (map[string]any, error) {
+	obj, err := f.redactor.Object(obj)
+	return obj, errors.Wrap(err, "cannot redact resource")
+}
+
+// observedResources returns filtered copies of the supplied observed resources.
+func (f resourceFilters) observedResources(rs map[string]*fnv1.Resource) (map[string]*fnv1.Resource, error) {
+	out := make(map[string]*fnv1.Resource, len(rs))
+	for name, r := range rs {
+		if f.stubs[name] {
+			r = stub(r)
+		}
+		fr, err := f.observedResource(r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot prepare resource %q", name)
+		}
+		out[name] = fr
+	}
+	return out, nil
+}
+
+// observedResource returns a filtered copy of the supplied observed resource.
+func (f resourceFilters) observedResource(r *fnv1.Resource) (*fnv1.Resource, error) {
+	if r == nil || (f.sanitizer == nil && f.redactor == nil) {
+		return r, nil
+	}
+	obj, err := f.observed(r.GetResource().AsMap())
+	if err != nil {
+		return nil, err
+	}
+	s, err := structpb.NewStruct(obj)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot convert filtered resource")
+	}
+	return &fnv1.Resource{Resource: s, Ready: r.GetReady()}, nil
+}
+
+// templateVariables returns the variables common to composition and operation
+// pipelines.
+func templateVariables(req *fnv1.RunFunctionRequest, input string, rr map[string][]resource.Required, f resourceFilters) (*Variables, error) {
+	vars := &Variables{
+		Input:   input,
+		Context: f.redactor.Context(req.GetContext().AsMap()),
+		Meta:    MetaVariables{Tag: req.GetMeta().GetTag()},
+	}
+
+	for name := range req.GetCredentials() {
+		vars.Meta.Credentials = append(vars.Meta.Credentials, name)
+	}
+	sort.Strings(vars.Meta.Credentials)
+
+	var err error
+	vars.Required, err = requiredValues(rr, f)
+	if err != nil {
+		return nil, err
+	}
+
+	if xr := req.GetDesired().GetComposite(); xr != nil {
+		obj, err := f.desired(xr.GetResource().AsMap())
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot prepare desired XR")
+		}
+		vars.Desired.Composite, err = newValue(obj, formatYAML)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot render desired XR")
+		}
+	}
+	vars.Desired.Resources = make(map[string]*Value, len(req.GetDesired().GetResources()))
+	for name, r := range req.GetDesired().GetResources() {
+		obj, err := f.desired(r.GetResource().AsMap())
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot prepare desired composed resource %q", name)
+		}
+		vars.Desired.Resources[name], err = newValue(obj, formatYAML)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot render desired composed resource %q", name)
+		}
+	}
+
+	return vars, nil
+}
+
+// compositionVariables returns the variables for a composition pipeline.
+func compositionVariables(req *fnv1.RunFunctionRequest, input string, rr map[string][]resource.Required, f resourceFilters) (*Variables, error) {
+	vars, err := templateVariables(req, input, rr, f)
+	if err != nil {
+		return nil, err
+	}
+
+	xr, err := f.observedResource(req.GetObserved().GetComposite())
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot prepare observed XR")
+	}
+	vars.Composite, err = newValue(xr.GetResource().AsMap(), formatYAML)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot render observed XR")
+	}
+	// Preserve the historical rendering of the XR.
+	if vars.Composite.rendered, err = CompositeToYAML(xr); err != nil {
+		return nil, err
+	}
+
+	ocds, err := f.observedResources(req.GetObserved().GetResources())
+	if err != nil {
+		return nil, err
+	}
+	vars.Composed, err = newValue(asMaps(ocds), formatYAML)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot render observed composed resources")
+	}
+	if vars.Composed.rendered, err = ComposedToYAML(ocds); err != nil {
+		return nil, err
+	}
+
+	return vars, nil
+}
+
+// operationVariables returns the variables for an operation pipeline. The
+// watched resource may be nil.
+func operationVariables(req *fnv1.RunFunctionRequest, input string, rr map[string][]resource.Required, watched map[string]any, events string, f resourceFilters) (*Variables, error) {
+	vars, err := templateVariables(req, input, rr, f)
+	if err != nil {
+		return nil, err
+	}
+	vars.Events = events
+
+	if watched == nil {
+		return vars, nil
+	}
+	if watched, err = f.observed(watched); err != nil {
+		return nil, errors.Wrap(err, "cannot prepare watched resource")
+	}
+	vars.Watched, err = newValue(watched, formatJSON)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot render watched resource")
+	}
+	vars.Resources = vars.Watched
+	return vars, nil
+}
+
+// requiredValues returns the supplied required resources, keyed by requirement
+// name. The watched resource and resources the function requires for its own
+// use are omitted.
+func requiredValues(rr map[string][]resource.Required, f resourceFilters) (map[string]*Value, error) {
+	out := make(map[string]*Value, len(rr))
+	for name, rs := range rr {
+		if name == watchedResourceKey || strings.HasPrefix(name, requirementPrefix) {
+			continue
+		}
+		objs := make([]any, len(rs))
+		for i, r := range rs {
+			obj, err := f.observed(r.Resource.UnstructuredContent())
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot prepare required resources %q", name)
+			}
+			objs[i] = obj
+		}
+		v, err := newValue(objs, formatJSON)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot render required resources %q", name)
+		}
+		out[name] = v
+	}
+	return out, nil
+}
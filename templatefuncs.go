@@ -0,0 +1,257 @@
+/*
+Copyright 2025 The Upbound Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/tidwall/gjson"
+	"sigs.k8s.io/yaml"
+
+	"github.com/crossplane/function-sdk-go/errors"
+)
+
+// charsPerToken approximates the number of characters in a token of English
+// text or Kubernetes YAML.
+const charsPerToken = 4
+
+// parseErrorRegex matches the position text/template adds to parse errors,
+// e.g. "template: prompt:3: ".
+var parseErrorRegex = regexp.MustCompile(`^template: [^:]*:(\d+): `)
+
+// templateFuncs returns the functions available to prompt templates; sprig's
+// functions plus Kubernetes aware helpers.
+func templateFuncs() template.FuncMap {
+	fns := sprig.TxtFuncMap()
+	fns["toYaml"] = toYAML
+	fns["fromYaml"] = fromYAML
+	fns["gjson"] = gjsonGet
+	fns["getResource"] = getResource
+	fns["stripManagedFields"] = stripManagedFields
+	fns["composedByKind"] = composedByKind
+	fns["truncateTokens"] = truncateTokens
+	fns["cacheBreakpoint"] = func() string { return cacheBreakpointMarker }
+	return fns
+}
+
+// parseTemplate parses the supplied prompt template with the supplied
+// functions. Parse errors include the line and column of the action that
+// caused them.
+func parseTemplate(name, text string, fns template.FuncMap) (*template.Template, error) {
+	t, err := template.New(name).Funcs(fns).Parse(text)
+	if err == nil {
+		return t, nil
+	}
+
+	m := parseErrorRegex.FindStringSubmatch(err.Error())
+	if m == nil {
+		return nil, err
+	}
+	line, _ := strconv.Atoi(m[1])
+	msg := strings.TrimPrefix(err.Error(), m[0])
+	return nil, errors.Errorf("line %d, column %d: %s", line, errorColumn(name, text, fns, line, msg), msg)
+}
+
+// errorColumn returns the column of the action on the supplied line that
+// causes the supplied parse error. text/template only reports the line of a
+// parse error, so each action on the line is parsed in turn until one produces
+// the error. It returns 1 if no action produces the error.
+func errorColumn(name, text string, fns template.FuncMap, line int, msg string) int {
+	lines := strings.Split(text, "\n")
+	if line < 1 || line > len(lines) {
+		return 1
+	}
+	prefix := strings.Join(lines[:line-1], "\n")
+	if line > 1 {
+		prefix += "\n"
+	}
+	l := lines[line-1]
+
+	for start := 0; ; {
+		i := strings.Index(l[start:], "{{")
+		if i < 0 {
+			return 1
+		}
+		i += start
+		end := len(l)
+		if j := strings.Index(l[i:], "}}"); j >= 0 {
+			end = i + j + 2
+		}
+		_, err := template.New(name).Funcs(fns).Parse(prefix + l[:end])
+		if err != nil && strings.HasSuffix(err.Error(), msg) {
+			return len([]rune(l[:i])) + 1
+		}
+		start = end
+		if start >= len(l) {
+			return 1
+		}
+	}
+}
+
+// object returns the parsed object of the supplied template value. Values
+// that are strings are parsed as JSON or YAML.
+func object(v any) any {
+	switch o := v.(type) {
+	case *Value:
+		if o == nil {
+			return nil
+		}
+		return o.Object
+	case string:
+		var out any
+		if err := yaml.Unmarshal([]byte(o), &out); err != nil {
+			return o
+		}
+		return out
+	}
+	return v
+}
+
+// toYAML returns the supplied value as YAML.
+func toYAML(v any) (string, error) {
+	y, err := yaml.Marshal(object(v))
+	return strings.TrimSuffix(string(y), "\n"), errors.Wrap(err, "cannot convert value to YAML")
+}
+
+// fromYAML parses the supplied YAML.
+func fromYAML(s string) (any, error) {
+	var out any
+	err := yaml.Unmarshal([]byte(s), &out)
+	return out, errors.Wrap(err, "cannot parse YAML")
+}
+
+// gjsonGet returns the value at the supplied gjson path of the supplied
+// value, e.g. {{ .Composite | gjson "spec.parameters.region" }}. It returns
+// nil if the path doesn't exist.
+func gjsonGet(path string, v any) (any, error) {
+	j, err := json.Marshal(object(v))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot convert value to JSON")
+	}
+	r := gjson.GetBytes(j, path)
+	if !r.Exists() {
+		return nil, nil
+	}
+	return r.Value(), nil
+}
+
+// getResource returns the named resource of the supplied map of resources,
+// e.g. {{ getResource .Composed "bucket" }}. It returns nil if there is no
+// such resource.
+func getResource(resources any, name string) (*Value, error) {
+	switch rs := resources.(type) {
+	case map[string]*Value:
+		return rs[name], nil
+	case *Value:
+		// A missing resource, e.g. one returned by getResource, is nil.
+		if rs == nil {
+			return nil, nil
+		}
+		return getResource(rs.Object, name)
+	case map[string]map[string]any:
+		if r, ok := rs[name]; ok {
+			return newValue(r, formatYAML)
+		}
+	case map[string]any:
+		if r, ok := rs[name]; ok {
+			return newValue(r, formatYAML)
+		}
+	}
+	return nil, nil
+}
+
+// stripManagedFields returns a copy of the supplied resource, or list of
+// resources, without metadata.managedFields.
+func stripManagedFields(v any) (*Value, error) {
+	// Round trip through JSON to deep copy the value.
+	j, err := json.Marshal(object(v))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot convert value to JSON")
+	}
+	var o any
+	if err := json.Unmarshal(j, &o); err != nil {
+		return nil, errors.Wrap(err, "cannot parse value as JSON")
+	}
+
+	strip := func(r any) {
+		if m, ok := r.(map[string]any); ok {
+			if meta, ok := m["metadata"].(map[string]any); ok {
+				delete(meta, "managedFields")
+			}
+		}
+	}
+	switch t := o.(type) {
+	case []any:
+		for _, r := range t {
+			strip(r)
+		}
+	case map[string]any:
+		strip(t)
+	}
+
+	return newValue(o, formatOf(v))
+}
+
+// composedByKind returns the supplied composed resources of the supplied kind,
+// sorted by name, e.g. {{ composedByKind "Bucket" .Composed }}.
+func composedByKind(kind string, composed any) (*Value, error) {
+	rs := map[string]any{}
+	switch c := object(composed).(type) {
+	case map[string]map[string]any:
+		for name, r := range c {
+			rs[name] = r
+		}
+	case map[string]any:
+		rs = c
+	case map[string]*Value:
+		for name, r := range c {
+			rs[name] = r.Object
+		}
+	}
+
+	names := make([]string, 0, len(rs))
+	for name, r := range rs {
+		if m, ok := r.(map[string]any); ok && m["kind"] == kind {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	out := make([]any, len(names))
+	for i, name := range names {
+		out[i] = rs[name]
+	}
+	return newValue(out, formatYAML)
+}
+
+// truncateTokens truncates the supplied text to approximately the supplied
+// number of tokens, e.g. {{ .Watched | truncateTokens 2000 }}. Truncated text
+// ends with an ellipsis.
+func truncateTokens(tokens int, v any) string {
+	s := fmt.Sprint(v)
+	if tokens < 0 {
+		tokens = 0
+	}
+	return truncate(s, tokens*charsPerToken)
+}